@@ -35,7 +35,10 @@ var runCmd = &cobra.Command{
 		buffer := queue.NewMetricsBuffer()
 		go common.ServeStats()
 
-		queue.RunSender(config.InfluxDB, buffer)
+		err = queue.RunSender(config.InfluxDB, buffer)
+		if err != nil {
+			common.Log.WithError(err).Panic("Could not start sending metrics")
+		}
 		queue.Consume(config, buffer)
 	},
 }
@@ -14,8 +14,17 @@ type NsqConfig struct {
 	ClientConfig *nsq.Config
 }
 
+type KubernetesTagsConfig struct {
+	Namespace   bool
+	Container   bool
+	Labels      []string
+	LabelPrefix *string
+}
+
 type KubernetesConfig struct {
-	AnnotationKey string
+	AnnotationKey       string
+	AnnotationCacheSize int
+	Tags                KubernetesTagsConfig
 }
 
 type InfluxDbConfig struct {
@@ -27,24 +36,243 @@ type InfluxDbConfig struct {
 	RetentionPolicy string
 	SendInterval    time.Duration
 	BatchSize       int
+	Precision       string
+	Uniquifier      string
+	SequenceTag     string
 }
 
 type RulesConfig struct {
-	Id             string
-	UrlRegexp      string
+	Id               string
+	UrlRegexp        string
+	FrontendRegexp   string
+	MethodRegexp     string
+	NamespaceRegexp  string
+	LabelSelector    string
+	ClusterRegexp    string
+	DatacenterRegexp string
+	HostRegexp       string
+	Conditions       map[string]string
+	Sampling         float64
+	TopK             TopKConfig
+	Apdex            ApdexConfig
+}
+
+type TopKConfig struct {
+	Dimensions []string
+	K          int
+}
+
+type ApdexConfig struct {
+	Satisfied     time.Duration
+	Tolerating    time.Duration
+	DurationField string
+}
+
+type FlattenConfig struct {
+	Separator      string
+	MaxDepth       int
+	Slices         string
+	SliceSeparator string
+	Allow          []string
+	Deny           []string
+}
+
+type RedactionConfig struct {
+	Enabled         *bool
+	AllowHeaders    []string
+	DenyPatterns    []string
+	DisableDefaults bool
+	Mode            string
+	Mask            string
+	HashKey         string
+}
+
+type AnonymizationKeyConfig struct {
+	Id        string
+	Secret    string
+	ValidFrom string
+}
+
+type AnonymizationConfig struct {
+	Mode       string
+	Fields     []string
+	IPv4Prefix int
+	IPv6Prefix int
+	Keys       []AnonymizationKeyConfig
+}
+
+type GeoIPConfig struct {
+	CityDatabase    string
+	ASNDatabase     string
+	UseForwardedFor bool
+	CacheSize       int
+	ReloadInterval  time.Duration
+}
+
+type UserAgentConfig struct {
+	Enabled   bool
+	Field     string
+	CacheSize int
+	RulesFile string
+}
+
+type RouteTemplatesConfig struct {
 	FrontendRegexp string
-	MethodRegexp   string
-	Sampling       float64
+	Templates      []string
+}
+
+type RoutesConfig struct {
+	Enabled              bool
+	DisableNormalization bool
+	Frontends            []RouteTemplatesConfig
+	QueryParams          []string
+}
+
+type DerivedFieldConfig struct {
+	Name       string
+	Expression string
+	Tag        bool
+}
+
+type FieldSchemaConfig struct {
+	Field      string
+	Type       string
+	Unit       string
+	SourceUnit string
+}
+
+type DeadLetterConfig struct {
+	Output      string
+	NsqdAddress string
+	Topic       string
+	Path        string
+	MaxFileSize int64
+	MaxFiles    int
+	LogInterval time.Duration
+}
+
+type DeduplicationConfig struct {
+	Enabled    bool
+	Key        string
+	Window     time.Duration
+	MaxEntries int
+}
+
+type LateDataConfig struct {
+	MaxAge          time.Duration
+	MaxFutureSkew   time.Duration
+	Action          string
+	FutureAction    string
+	RetentionPolicy string
+}
+
+type TagLimitConfig struct {
+	Tag       string
+	MaxValues int
+}
+
+type CardinalityConfig struct {
+	MaxSeries       int
+	MaxValuesPerTag int
+	TagLimits       []TagLimitConfig
+	Action          string
+	ResetInterval   time.Duration
+}
+
+type UniqueClientsConfig struct {
+	Enabled    bool
+	Field      string
+	Precision  uint8
+	EmitSketch *bool
+}
+
+type AggregationConfig struct {
+	Interval        time.Duration
+	Measurement     string
+	TopKMeasurement string
+	SLOMeasurement  string
+	UniqueClients   UniqueClientsConfig
+}
+
+type SLOConfig struct {
+	Name             string
+	FrontendRegexp   string
+	GoodStatusRegexp string
+	MaxDuration      time.Duration
+	DurationField    string
+	Target           float64
+	Windows          []time.Duration
+	BudgetWindow     time.Duration
+}
+
+type AlertRuleConfig struct {
+	Name             string
+	FrontendRegexp   string
+	Metric           string
+	DurationField    string
+	Threshold        float64
+	ResolveThreshold *float64
+	Window           time.Duration
+	For              time.Duration
+	MinRequests      int64
+}
+
+type AlertsConfig struct {
+	WebhookURL     string
+	Timeout        time.Duration
+	RepeatInterval time.Duration
+	Rules          []AlertRuleConfig
+}
+
+type BackendHealthConfig struct {
+	Enabled          bool
+	InstanceField    string
+	DurationField    string
+	Measurement      string
+	MinRequests      int64
+	MinInstances     int
+	ErrorRatioMargin float64
+	LatencyFactor    float64
+}
+
+type VersionsConfig struct {
+	Enabled          bool
+	Field            string
+	BackendURLRegexp string
+	Mapping          map[string]string
+	Baseline         string
+	DurationField    string
+	Measurement      string
+	MinRequests      int64
 }
 
 type Config struct {
-	Nsq        NsqConfig
-	LogLevel   string
-	LogAsJson  bool
-	Kubernetes KubernetesConfig
-	InfluxDB   InfluxDbConfig
-	Rules      []RulesConfig
-	Fields     []string
+	Nsq              NsqConfig
+	LogLevel         string
+	LogAsJson        bool
+	Kubernetes       KubernetesConfig
+	InfluxDB         InfluxDbConfig
+	Rules            []RulesConfig
+	Fields           []string
+	Flatten          FlattenConfig
+	Redaction        RedactionConfig
+	Anonymization    AnonymizationConfig
+	GeoIP            GeoIPConfig
+	UserAgent        UserAgentConfig
+	Routes           RoutesConfig
+	DerivedFields    []DerivedFieldConfig
+	Schema           []FieldSchemaConfig
+	DeadLetter       DeadLetterConfig
+	TimestampSources []string
+	Deduplication    DeduplicationConfig
+	LateData         LateDataConfig
+	Cardinality      CardinalityConfig
+	Aggregation      AggregationConfig
+	SLOs             []SLOConfig
+	Alerts           AlertsConfig
+	BackendHealth    BackendHealthConfig
+	Versions         VersionsConfig
+	Tags             []string
 }
 
 func NewConfig() Config {
@@ -1,83 +1,273 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SliceMode defines how slices are flattened
+type SliceMode string
 
-	log "github.com/Sirupsen/logrus"
+const (
+	// SliceIndex flattens every item of a slice separately using its index as a key (i.e. "items.0")
+	SliceIndex SliceMode = "index"
+	// SliceJoin joins primitive items of a slice into a single string (slices with maps or other
+	// slices inside fall back to SliceIndex)
+	SliceJoin SliceMode = "join"
+	// SliceSkip drops slices altogether
+	SliceSkip SliceMode = "skip"
 )
 
-// Flatten takes a structure and turns into a flat map[string]string.
+// FlattenOptions control how nested structures are turned into flat maps
+type FlattenOptions struct {
+	Separator      string           // joins keys of nested values ("." by default)
+	MaxDepth       int              // values nested deeper are dropped (0 - no limit)
+	Slices         SliceMode        // how slices are handled (SliceIndex by default)
+	SliceSeparator string           // joins items in SliceJoin mode ("," by default)
+	Allow          []*regexp.Regexp // when not empty only keys matching any of the patterns are kept
+	Deny           []*regexp.Regexp // keys matching any of the patterns are dropped
+}
+
+var jsonNumberType = reflect.TypeOf(json.Number(""))
+
+// DefaultFlattenOptions are used by Flatten
+var DefaultFlattenOptions = FlattenOptions{Separator: ".", Slices: SliceIndex, SliceSeparator: ","}
+
+// NewFlattenOptions creates options out of the config, compiling all the patterns
+func NewFlattenOptions(config FlattenConfig) (FlattenOptions, error) {
+	opts := DefaultFlattenOptions
+	opts.MaxDepth = config.MaxDepth
+
+	if len(config.Separator) > 0 {
+		opts.Separator = config.Separator
+	}
+
+	if len(config.SliceSeparator) > 0 {
+		opts.SliceSeparator = config.SliceSeparator
+	}
+
+	switch SliceMode(config.Slices) {
+	case "":
+	case SliceIndex, SliceJoin, SliceSkip:
+		opts.Slices = SliceMode(config.Slices)
+	default:
+		return opts, fmt.Errorf("unknown slice mode: %s", config.Slices)
+	}
+
+	var err error
+	if opts.Allow, err = compilePatterns(config.Allow); err != nil {
+		return opts, err
+	}
+
+	if opts.Deny, err = compilePatterns(config.Deny); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	result := []*regexp.Regexp{}
+	for _, pattern := range patterns {
+		rxp, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rxp)
+	}
+
+	return result, nil
+}
+
+// Flatten takes a structure and turns into a flat map[string]interface{} using default options.
 //
 // Within the "thing" parameter, only primitive values are allowed. Structs are
-// not supported. Therefore, it can only be slices, maps, primitives, and
+// not supported. Therefore, it can only be slices, maps, pointers, primitives, and
 // any combination of those together.
 //
 // See the tests for examples of what inputs are turned into.
-func Flatten(thing map[string]interface{}) map[string]interface{} {
-	result := make(map[string]interface{})
+func Flatten(thing map[string]interface{}) (map[string]interface{}, error) {
+	return FlattenWithOptions(thing, DefaultFlattenOptions)
+}
+
+// FlattenWithOptions works like Flatten but allows to control the way keys and slices are handled.
+//
+// Integers are returned as int64 (unsigned ones as well unless they overflow int64 - float64 is used then),
+// floats as float64 and json.Number as int64 or float64 depending on its value.
+// An error is returned for maps with non-string keys and values of unsupported types.
+func FlattenWithOptions(thing map[string]interface{}, opts FlattenOptions) (map[string]interface{}, error) {
+	f := flattener{opts: opts, result: make(map[string]interface{})}
 
 	for k, raw := range thing {
-		flatten(result, k, reflect.ValueOf(raw))
+		if err := f.flatten(k, 1, reflect.ValueOf(raw)); err != nil {
+			return nil, err
+		}
+	}
+
+	return f.result, nil
+}
+
+type flattener struct {
+	opts   FlattenOptions
+	result map[string]interface{}
+}
+
+func (f *flattener) set(key string, value interface{}) {
+	if len(f.opts.Allow) > 0 && !matchesAny(f.opts.Allow, key) {
+		return
+	}
+
+	if matchesAny(f.opts.Deny, key) {
+		return
+	}
+
+	f.result[key] = value
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, rxp := range patterns {
+		if rxp.MatchString(value) {
+			return true
+		}
 	}
 
-	return result
+	return false
 }
 
-func flatten(result map[string]interface{}, prefix string, v reflect.Value) {
-	if v.Kind() == reflect.Interface {
+func (f *flattener) flatten(prefix string, depth int, v reflect.Value) error {
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
 		v = v.Elem()
 	}
 
+	if f.opts.MaxDepth > 0 && depth > f.opts.MaxDepth {
+		return nil
+	}
+
+	if value, ok := primitiveValue(v); ok {
+		f.set(prefix, value)
+		return nil
+	}
+
 	switch v.Kind() {
-	case reflect.Bool:
-		if v.Bool() {
-			result[prefix] = true
-		} else {
-			result[prefix] = false
-		}
-	case reflect.Int:
-		result[prefix] = v.Int()
-	case reflect.Float64:
-		result[prefix] = v.Float()
-	case reflect.Float32:
-		result[prefix] = v.Float()
 	case reflect.Map:
-		flattenMap(result, prefix, v)
-	case reflect.Slice:
-		flattenSlice(result, prefix, v)
-	case reflect.String:
-		result[prefix] = v.String()
+		return f.flattenMap(prefix, depth, v)
+	case reflect.Slice, reflect.Array:
+		return f.flattenSlice(prefix, depth, v)
 	case reflect.Invalid:
-		return
+		return nil
 	default:
-		Log.WithFields(log.Fields{
-			"prefix": prefix,
-			"value":  v,
-		}).Debug("error flattening value - unknown type")
-		return
+		return fmt.Errorf("%s: unsupported value type: %s", prefix, v.Type())
 	}
 }
 
-func flattenMap(result map[string]interface{}, prefix string, v reflect.Value) {
+// primitiveValue converts booleans, numbers and strings into the types used in the result
+func primitiveValue(v reflect.Value) (interface{}, bool) {
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return float64(v.Uint()), true
+		}
+		return int64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String:
+		if v.Type() == jsonNumberType {
+			return numberValue(json.Number(v.String())), true
+		}
+		return v.String(), true
+	}
+
+	return nil, false
+}
+
+func numberValue(number json.Number) interface{} {
+	if value, err := number.Int64(); err == nil {
+		return value
+	}
+
+	if value, err := number.Float64(); err == nil {
+		return value
+	}
+
+	return number.String()
+}
+
+func (f *flattener) flattenMap(prefix string, depth int, v reflect.Value) error {
 	for _, k := range v.MapKeys() {
-		if k.Kind() == reflect.Interface {
-			k = k.Elem()
+		key := k
+		if key.Kind() == reflect.Interface {
+			key = key.Elem()
 		}
 
-		if k.Kind() != reflect.String {
-			panic(fmt.Sprintf("%s: map key is not string: %s", prefix, k))
+		if key.Kind() != reflect.String {
+			return fmt.Errorf("%s: map key is not string: %v", prefix, k)
 		}
 
-		flatten(result, fmt.Sprintf("%s.%s", prefix, k.String()), v.MapIndex(k))
+		if err := f.flatten(prefix+f.opts.Separator+key.String(), depth+1, v.MapIndex(k)); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func flattenSlice(result map[string]interface{}, prefix string, v reflect.Value) {
-	prefix = prefix + "."
+func (f *flattener) flattenSlice(prefix string, depth int, v reflect.Value) error {
+	switch f.opts.Slices {
+	case SliceSkip:
+		return nil
+	case SliceJoin:
+		if joined, ok := f.joinSlice(v); ok {
+			f.set(prefix, joined)
+			return nil
+		}
+	}
 
-	result[prefix+"#"] = fmt.Sprintf("%d", v.Len())
 	for i := 0; i < v.Len(); i++ {
-		flatten(result, fmt.Sprintf("%s%d", prefix, i), v.Index(i))
+		if err := f.flatten(prefix+f.opts.Separator+strconv.Itoa(i), depth+1, v.Index(i)); err != nil {
+			return err
+		}
 	}
+
+	return nil
+}
+
+// joinSlice joins primitive items of a slice; it fails when slice holds other kinds of values
+func (f *flattener) joinSlice(v reflect.Value) (string, bool) {
+	items := make([]string, 0, v.Len())
+
+	for i := 0; i < v.Len(); i++ {
+		item := v.Index(i)
+		for item.Kind() == reflect.Interface || item.Kind() == reflect.Ptr {
+			if item.IsNil() {
+				break
+			}
+			item = item.Elem()
+		}
+
+		if item.Kind() == reflect.Interface || item.Kind() == reflect.Ptr {
+			// nil item
+			items = append(items, "")
+			continue
+		}
+
+		value, ok := primitiveValue(item)
+		if !ok {
+			return "", false
+		}
+		items = append(items, fmt.Sprint(value))
+	}
+
+	return strings.Join(items, f.opts.SliceSeparator), true
 }
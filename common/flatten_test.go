@@ -0,0 +1,193 @@
+package common_test
+
+import (
+	"encoding/json"
+	"math"
+	"regexp"
+
+	. "github.com/Wikia/nsq-traefik-consumer/common"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type flattenCase struct {
+	description string
+	input       map[string]interface{}
+	options     FlattenOptions
+	expected    map[string]interface{}
+}
+
+func withOptions(change func(*FlattenOptions)) FlattenOptions {
+	opts := DefaultFlattenOptions
+	change(&opts)
+	return opts
+}
+
+var _ = Describe("Flatten", func() {
+	text := "text"
+	number := 42
+	var nilPointer *int
+
+	cases := []flattenCase{
+		{
+			description: "primitive values",
+			input:       map[string]interface{}{"s": "foo", "b": true, "f": 1.5, "i": 3, "nil": nil},
+			expected:    map[string]interface{}{"s": "foo", "b": true, "f": 1.5, "i": int64(3)},
+		},
+		{
+			description: "all integer kinds",
+			input: map[string]interface{}{
+				"i8": int8(-8), "i16": int16(-16), "i32": int32(-32), "i64": int64(math.MinInt64),
+				"u8": uint8(8), "u16": uint16(16), "u32": uint32(32), "u64": uint64(64), "u": uint(1),
+				"overflow": uint64(math.MaxUint64),
+			},
+			expected: map[string]interface{}{
+				"i8": int64(-8), "i16": int64(-16), "i32": int64(-32), "i64": int64(math.MinInt64),
+				"u8": int64(8), "u16": int64(16), "u32": int64(32), "u64": int64(64), "u": int64(1),
+				"overflow": float64(math.MaxUint64),
+			},
+		},
+		{
+			description: "float kinds",
+			input:       map[string]interface{}{"f32": float32(0.5), "f64": 0.25},
+			expected:    map[string]interface{}{"f32": 0.5, "f64": 0.25},
+		},
+		{
+			description: "json.Number values",
+			input:       map[string]interface{}{"int": json.Number("12"), "float": json.Number("1.5"), "big": json.Number("1e400")},
+			expected:    map[string]interface{}{"int": int64(12), "float": 1.5, "big": "1e400"},
+		},
+		{
+			description: "pointers",
+			input:       map[string]interface{}{"text": &text, "number": &number, "nil": nilPointer, "nested": map[string]interface{}{"p": &text}},
+			expected:    map[string]interface{}{"text": "text", "number": int64(42), "nested.p": "text"},
+		},
+		{
+			description: "nested maps",
+			input:       map[string]interface{}{"a": map[string]interface{}{"b": map[string]string{"c": "d"}, "e": 1}},
+			expected:    map[string]interface{}{"a.b.c": "d", "a.e": int64(1)},
+		},
+		{
+			description: "maps with interface keys",
+			input:       map[string]interface{}{"a": map[interface{}]interface{}{"b": "c"}},
+			expected:    map[string]interface{}{"a.b": "c"},
+		},
+		{
+			description: "slices by index",
+			input:       map[string]interface{}{"list": []interface{}{"a", 1, map[string]interface{}{"x": "y"}}},
+			expected:    map[string]interface{}{"list.0": "a", "list.1": int64(1), "list.2.x": "y"},
+		},
+		{
+			description: "arrays by index",
+			input:       map[string]interface{}{"list": [2]string{"a", "b"}},
+			expected:    map[string]interface{}{"list.0": "a", "list.1": "b"},
+		},
+		{
+			description: "slices joined",
+			input:       map[string]interface{}{"list": []interface{}{"a", 1, 1.5, true, nil}, "empty": []string{}},
+			options:     withOptions(func(opts *FlattenOptions) { opts.Slices = SliceJoin; opts.SliceSeparator = "|" }),
+			expected:    map[string]interface{}{"list": "a|1|1.5|true|", "empty": ""},
+		},
+		{
+			description: "slices with maps falling back to indexes when joining",
+			input:       map[string]interface{}{"list": []interface{}{"a", map[string]interface{}{"x": "y"}}},
+			options:     withOptions(func(opts *FlattenOptions) { opts.Slices = SliceJoin }),
+			expected:    map[string]interface{}{"list.0": "a", "list.1.x": "y"},
+		},
+		{
+			description: "slices skipped",
+			input:       map[string]interface{}{"list": []string{"a"}, "a": map[string]interface{}{"list": []int{1}, "b": "c"}},
+			options:     withOptions(func(opts *FlattenOptions) { opts.Slices = SliceSkip }),
+			expected:    map[string]interface{}{"a.b": "c"},
+		},
+		{
+			description: "custom separator",
+			input:       map[string]interface{}{"a": map[string]interface{}{"b": "c", "d": []string{"e"}}},
+			options:     withOptions(func(opts *FlattenOptions) { opts.Separator = "_" }),
+			expected:    map[string]interface{}{"a_b": "c", "a_d_0": "e"},
+		},
+		{
+			description: "max depth",
+			input:       map[string]interface{}{"a": "b", "c": map[string]interface{}{"d": "e", "f": map[string]interface{}{"g": "h"}}},
+			options:     withOptions(func(opts *FlattenOptions) { opts.MaxDepth = 2 }),
+			expected:    map[string]interface{}{"a": "b", "c.d": "e"},
+		},
+		{
+			description: "allowed keys",
+			input:       map[string]interface{}{"request_path": "/", "request__cookie": "x", "origin_status": 200},
+			options: withOptions(func(opts *FlattenOptions) {
+				opts.Allow = []*regexp.Regexp{regexp.MustCompile(`^request_[a-z]`), regexp.MustCompile(`status$`)}
+			}),
+			expected: map[string]interface{}{"request_path": "/", "origin_status": int64(200)},
+		},
+		{
+			description: "denied keys",
+			input:       map[string]interface{}{"request_path": "/", "request__cookie": "x", "a": map[string]interface{}{"secret": "y", "b": "c"}},
+			options:     withOptions(func(opts *FlattenOptions) { opts.Deny = []*regexp.Regexp{regexp.MustCompile(`cookie|secret`)} }),
+			expected:    map[string]interface{}{"request_path": "/", "a.b": "c"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		It("should flatten "+c.description, func() {
+			options := c.options
+			if options.Separator == "" {
+				options = DefaultFlattenOptions
+			}
+
+			result, err := FlattenWithOptions(c.input, options)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(c.expected))
+		})
+	}
+
+	It("should use default options", func() {
+		result, err := Flatten(map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": 1}}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(map[string]interface{}{"a.0.b": int64(1)}))
+	})
+
+	errorCases := map[string]map[string]interface{}{
+		"non-string map keys":  {"a": map[int]string{1: "b"}},
+		"non-string interface": {"a": map[interface{}]interface{}{1.5: "b"}},
+		"structs":              {"a": struct{ B string }{"c"}},
+		"channels":             {"a": make(chan int)},
+		"nested invalid types": {"a": []interface{}{func() {}}},
+	}
+
+	for description, input := range errorCases {
+		input := input
+		It("should return error for "+description, func() {
+			_, err := Flatten(input)
+			Expect(err).To(HaveOccurred())
+		})
+	}
+
+	Describe("NewFlattenOptions()", func() {
+		It("should use defaults for empty config", func() {
+			opts, err := NewFlattenOptions(FlattenConfig{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.Separator).To(Equal("."))
+			Expect(opts.Slices).To(Equal(SliceIndex))
+		})
+
+		It("should compile patterns", func() {
+			opts, err := NewFlattenOptions(FlattenConfig{Separator: "_", Slices: "join", Allow: []string{"^a"}, Deny: []string{"b$"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.Separator).To(Equal("_"))
+			Expect(opts.Slices).To(Equal(SliceJoin))
+			Expect(opts.Allow).To(HaveLen(1))
+			Expect(opts.Deny).To(HaveLen(1))
+		})
+
+		It("should reject invalid config", func() {
+			_, err := NewFlattenOptions(FlattenConfig{Slices: "count"})
+			Expect(err).To(HaveOccurred())
+
+			_, err = NewFlattenOptions(FlattenConfig{Deny: []string{"("}})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
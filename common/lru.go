@@ -0,0 +1,99 @@
+package common
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRUCache is a size bounded cache which evicts least recently used entries first.
+// It is safe for concurrent use.
+type LRUCache struct {
+	sync.Mutex
+	size  int
+	items map[interface{}]*list.Element
+	order *list.List
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+// NewLRUCache creates cache holding at most size entries
+func NewLRUCache(size int) *LRUCache {
+	if size <= 0 {
+		size = 1
+	}
+
+	return &LRUCache{
+		size:  size,
+		items: make(map[interface{}]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+// Get returns value stored under the key and marks it as recently used
+func (c *LRUCache) Get(key interface{}) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	element, has := c.items[key]
+	if !has {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+// Add stores value under the key and returns true when another entry had to be evicted to make room for it
+func (c *LRUCache) Add(key, value interface{}) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, has := c.items[key]; has {
+		c.order.MoveToFront(element)
+		element.Value.(*lruEntry).value = value
+		return false
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+
+	if c.order.Len() <= c.size {
+		return false
+	}
+
+	oldest := c.order.Back()
+	c.order.Remove(oldest)
+	delete(c.items, oldest.Value.(*lruEntry).key)
+
+	return true
+}
+
+// Remove deletes entry stored under the key
+func (c *LRUCache) Remove(key interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, has := c.items[key]; has {
+		c.order.Remove(element)
+		delete(c.items, key)
+	}
+}
+
+// Purge removes all the entries from the cache
+func (c *LRUCache) Purge() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.items = make(map[interface{}]*list.Element, c.size)
+	c.order.Init()
+}
+
+// Len returns number of entries in the cache
+func (c *LRUCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.order.Len()
+}
@@ -0,0 +1,53 @@
+package common_test
+
+import (
+	. "github.com/Wikia/nsq-traefik-consumer/common"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LRUCache", func() {
+	var cache *LRUCache
+
+	BeforeEach(func() {
+		cache = NewLRUCache(2)
+	})
+
+	It("should return stored values", func() {
+		Expect(cache.Add("a", 1)).To(BeFalse())
+
+		value, has := cache.Get("a")
+		Expect(has).To(BeTrue())
+		Expect(value).To(Equal(1))
+
+		_, has = cache.Get("b")
+		Expect(has).To(BeFalse())
+	})
+
+	It("should evict least recently used entry", func() {
+		cache.Add("a", 1)
+		cache.Add("b", 2)
+		cache.Get("a")
+
+		Expect(cache.Add("c", 3)).To(BeTrue())
+		Expect(cache.Len()).To(Equal(2))
+
+		_, has := cache.Get("b")
+		Expect(has).To(BeFalse(), "b was used least recently")
+		_, has = cache.Get("a")
+		Expect(has).To(BeTrue())
+	})
+
+	It("should overwrite existing entries", func() {
+		cache.Add("a", 1)
+		Expect(cache.Add("a", 2)).To(BeFalse())
+
+		value, _ := cache.Get("a")
+		Expect(value).To(Equal(2))
+		Expect(cache.Len()).To(Equal(1))
+
+		cache.Remove("a")
+		Expect(cache.Len()).To(BeZero())
+	})
+})
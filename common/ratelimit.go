@@ -0,0 +1,45 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// LogLimiter lets through at most one log message per interval for every key, so a flood of
+// failing messages doesn't flood the logs as well
+type LogLimiter struct {
+	sync.Mutex
+	interval   time.Duration
+	last       map[string]time.Time
+	suppressed map[string]int64
+	now        func() time.Time
+}
+
+// NewLogLimiter creates limiter letting through one message per interval (every message when interval is 0)
+func NewLogLimiter(interval time.Duration) *LogLimiter {
+	return &LogLimiter{
+		interval:   interval,
+		last:       map[string]time.Time{},
+		suppressed: map[string]int64{},
+		now:        time.Now,
+	}
+}
+
+// Allow reports whether message with the given key should be logged and how many messages
+// with that key were suppressed since the last one
+func (l *LogLimiter) Allow(key string) (bool, int64) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	if last, has := l.last[key]; has && now.Sub(last) < l.interval {
+		l.suppressed[key]++
+		return false, 0
+	}
+
+	suppressed := l.suppressed[key]
+	l.last[key] = now
+	l.suppressed[key] = 0
+
+	return true, suppressed
+}
@@ -0,0 +1,39 @@
+package common_test
+
+import (
+	"time"
+
+	. "github.com/Wikia/nsq-traefik-consumer/common"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LogLimiter", func() {
+	It("should let through one message per interval for every key", func() {
+		limiter := NewLogLimiter(50 * time.Millisecond)
+
+		Expect(limiter.Allow("a")).To(BeTrue())
+		Expect(limiter.Allow("a")).To(BeFalse())
+		Expect(limiter.Allow("a")).To(BeFalse())
+		Expect(limiter.Allow("b")).To(BeTrue())
+
+		time.Sleep(60 * time.Millisecond)
+
+		allowed, suppressed := limiter.Allow("a")
+		Expect(allowed).To(BeTrue())
+		Expect(suppressed).To(Equal(int64(2)))
+
+		allowed, suppressed = limiter.Allow("b")
+		Expect(allowed).To(BeTrue())
+		Expect(suppressed).To(BeZero())
+	})
+
+	It("should let through everything without interval", func() {
+		limiter := NewLogLimiter(0)
+
+		for i := 0; i < 3; i++ {
+			Expect(limiter.Allow("a")).To(BeTrue())
+		}
+	})
+})
@@ -0,0 +1,16 @@
+package common
+
+import "os"
+
+// Replica identifies this instance of the consumer (host name of the POD) - many replicas share
+// the NSQ channel, so each of them sees only a part of the traffic
+var Replica = replicaName()
+
+func replicaName() string {
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		return "unknown"
+	}
+
+	return hostname
+}
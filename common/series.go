@@ -0,0 +1,27 @@
+package common
+
+import (
+	"sort"
+	"strings"
+)
+
+// SeriesKey identifies series of a point - measurement followed by tags sorted by their keys
+// (like InfluxDB does it, i.e. `measurement,a=1,b=2`)
+func SeriesKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	key := strings.Builder{}
+	key.WriteString(measurement)
+	for _, k := range keys {
+		key.WriteByte(',')
+		key.WriteString(k)
+		key.WriteByte('=')
+		key.WriteString(tags[k])
+	}
+
+	return key.String()
+}
@@ -0,0 +1,15 @@
+package common_test
+
+import (
+	. "github.com/Wikia/nsq-traefik-consumer/common"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SeriesKey", func() {
+	It("should list tags sorted by their keys", func() {
+		Expect(SeriesKey("requests", map[string]string{"b": "2", "a": "1"})).To(Equal("requests,a=1,b=2"))
+		Expect(SeriesKey("requests", nil)).To(Equal("requests"))
+	})
+})
@@ -3,14 +3,31 @@ package common
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/fukata/golang-stats-api-handler"
 	"github.com/rcrowley/go-metrics"
 )
 
+var statsProviders = struct {
+	sync.RWMutex
+	providers map[string]func() interface{}
+}{providers: map[string]func() interface{}{}}
+
+// RegisterStatsProvider exposes value returned by the provider as JSON on /stats/<name> endpoint.
+// Provider registered again with the same name replaces the previous one.
+func RegisterStatsProvider(name string, provider func() interface{}) {
+	statsProviders.Lock()
+	defer statsProviders.Unlock()
+
+	statsProviders.providers[name] = provider
+}
+
 func ServeStats() {
 	http.HandleFunc("/stats/gc", stats_api.Handler)
 	http.HandleFunc("/stats/internal", handleInternalMetrics)
+	http.HandleFunc("/stats/", HandleStatsProviders)
 	http.ListenAndServe(":8080", nil)
 }
 
@@ -28,6 +45,15 @@ func handleInternalMetrics(resp http.ResponseWriter, req *http.Request) {
 		case metrics.Gauge:
 			gauge := metric.(metrics.Gauge)
 			data[name] = gauge.Value()
+		case metrics.Histogram:
+			histogram := metric.(metrics.Histogram).Snapshot()
+			percentiles := histogram.Percentiles([]float64{0.5, 0.95, 0.99})
+			data[name+"_cnt"] = histogram.Count()
+			data[name+"_mean"] = histogram.Mean()
+			data[name+"_p50"] = percentiles[0]
+			data[name+"_p95"] = percentiles[1]
+			data[name+"_p99"] = percentiles[2]
+			data[name+"_max"] = histogram.Max()
 		}
 	})
 
@@ -45,3 +71,25 @@ func handleInternalMetrics(resp http.ResponseWriter, req *http.Request) {
 
 	return
 }
+
+// HandleStatsProviders serves values of providers registered with RegisterStatsProvider
+func HandleStatsProviders(resp http.ResponseWriter, req *http.Request) {
+	statsProviders.RLock()
+	provider, has := statsProviders.providers[strings.TrimPrefix(req.URL.Path, "/stats/")]
+	statsProviders.RUnlock()
+
+	if !has {
+		http.NotFound(resp, req)
+		return
+	}
+
+	bytes, err := json.Marshal(provider())
+	if err != nil {
+		Log.WithError(err).WithField("path", req.URL.Path).Error("Error encoding stats into json")
+		resp.WriteHeader(500)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(bytes)
+}
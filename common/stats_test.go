@@ -0,0 +1,34 @@
+package common_test
+
+import (
+	"net/http/httptest"
+
+	. "github.com/Wikia/nsq-traefik-consumer/common"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HandleStatsProviders", func() {
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		HandleStatsProviders(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder
+	}
+
+	It("should serve values of registered providers as JSON", func() {
+		RegisterStatsProvider("test", func() interface{} { return map[string]int{"value": 1} })
+
+		resp := get("/stats/test")
+		Expect(resp.Code).To(Equal(200))
+		Expect(resp.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(resp.Body.String()).To(MatchJSON(`{"value": 1}`))
+
+		RegisterStatsProvider("test", func() interface{} { return []string{} })
+		Expect(get("/stats/test").Body.String()).To(MatchJSON(`[]`))
+	})
+
+	It("should respond with 404 for unknown providers", func() {
+		Expect(get("/stats/unknown").Code).To(Equal(404))
+	})
+})
@@ -0,0 +1,343 @@
+// Package expression implements small expression language used to compute values out of parsed logs.
+//
+// Supported are number, string ("..." or '...') and boolean literals, field names (fields with
+// characters not allowed in names can be read with field("name")), arithmetic (+ - * / %), string
+// concatenation (+), comparisons (== != < <= > >=), regexp matching (=~ !~ with a literal pattern),
+// logical operators (&& || !), conditional operator (cond ? a : b) and a few functions (see Functions).
+//
+// All numbers are float64. Operations on missing fields (and division by zero) give nil, which
+// means that the value can't be computed.
+package expression
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// Expression is a parsed expression ready to be evaluated
+type Expression struct {
+	source string
+	root   node
+}
+
+// Parse compiles expression source
+func Parse(source string) (*Expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+	root, err := p.parse(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s", p.peek())
+	}
+
+	return &Expression{source: source, root: root}, nil
+}
+
+// MustParse is like Parse but panics on errors; it is meant for expressions defined in the code
+func MustParse(source string) *Expression {
+	e, err := Parse(source)
+	if err != nil {
+		panic(err)
+	}
+
+	return e
+}
+
+// Evaluate computes value of the expression using given fields; the result is float64, string, bool or nil
+func (e *Expression) Evaluate(fields map[string]interface{}) (interface{}, error) {
+	return e.root.eval(fields)
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+type node interface {
+	eval(fields map[string]interface{}) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n literal) eval(map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+type variable struct {
+	name string
+}
+
+func (n variable) eval(fields map[string]interface{}) (interface{}, error) {
+	return normalize(fields[n.name]), nil
+}
+
+type unary struct {
+	op      string
+	operand node
+}
+
+func (n unary) eval(fields map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(fields)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "-":
+		if number, ok := value.(float64); ok {
+			return -number, nil
+		}
+	case "!":
+		if b, ok := value.(bool); ok {
+			return !b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("operator %s can't be used with %s", n.op, typeName(value))
+}
+
+type logical struct {
+	op          string
+	left, right node
+}
+
+func (n logical) eval(fields map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(fields)
+	if err != nil || left == nil {
+		return nil, err
+	}
+
+	b, ok := left.(bool)
+	if !ok {
+		return nil, fmt.Errorf("operator %s can't be used with %s", n.op, typeName(left))
+	}
+
+	// short circuit
+	if n.op == "&&" && !b || n.op == "||" && b {
+		return b, nil
+	}
+
+	right, err := n.right.eval(fields)
+	if err != nil || right == nil {
+		return nil, err
+	}
+
+	if _, ok := right.(bool); !ok {
+		return nil, fmt.Errorf("operator %s can't be used with %s", n.op, typeName(right))
+	}
+
+	return right, nil
+}
+
+type conditional struct {
+	condition, then, otherwise node
+}
+
+func (n conditional) eval(fields map[string]interface{}) (interface{}, error) {
+	condition, err := n.condition.eval(fields)
+	if err != nil || condition == nil {
+		return nil, err
+	}
+
+	b, ok := condition.(bool)
+	if !ok {
+		return nil, fmt.Errorf("condition has to be boolean, got %s", typeName(condition))
+	}
+
+	if b {
+		return n.then.eval(fields)
+	}
+
+	return n.otherwise.eval(fields)
+}
+
+type match struct {
+	negated bool
+	operand node
+	pattern *regexp.Regexp
+}
+
+func (n match) eval(fields map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(fields)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	return n.pattern.MatchString(toString(value)) != n.negated, nil
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+func (n binary) eval(fields map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(fields)
+	if err != nil || left == nil {
+		return nil, err
+	}
+
+	right, err := n.right.eval(fields)
+	if err != nil || right == nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	}
+
+	if l, ok := left.(float64); ok {
+		if r, ok := right.(float64); ok {
+			return arithmetic(n.op, l, r)
+		}
+	}
+
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			switch n.op {
+			case "<":
+				return l < r, nil
+			case "<=":
+				return l <= r, nil
+			case ">":
+				return l > r, nil
+			case ">=":
+				return l >= r, nil
+			}
+		}
+	}
+
+	if n.op == "+" {
+		_, leftIsString := left.(string)
+		_, rightIsString := right.(string)
+		if leftIsString || rightIsString {
+			return toString(left) + toString(right), nil
+		}
+	}
+
+	return nil, fmt.Errorf("operator %s can't be used with %s and %s", n.op, typeName(left), typeName(right))
+}
+
+func arithmetic(op string, l, r float64) (interface{}, error) {
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, nil
+		}
+		return l / r, nil
+	case "%":
+		if r == 0 {
+			return nil, nil
+		}
+		return math.Mod(l, r), nil
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	}
+
+	return nil, fmt.Errorf("unknown operator: %s", op)
+}
+
+type call struct {
+	name string
+	fn   Function
+	args []node
+}
+
+func (n call) eval(fields map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for idx, arg := range n.args {
+		value, err := arg.eval(fields)
+		if err != nil {
+			return nil, err
+		}
+		args[idx] = value
+	}
+
+	if n.fn.Lazy {
+		return n.fn.Call(fields, args)
+	}
+
+	for _, arg := range args {
+		if arg == nil {
+			return nil, nil
+		}
+	}
+
+	value, err := n.fn.Call(fields, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", n.name, err)
+	}
+
+	return value, nil
+}
+
+// normalize converts values coming from parsed logs into types used by expressions
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64, string, bool, nil:
+		return v
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
@@ -0,0 +1,92 @@
+package expression_test
+
+import (
+	. "github.com/Wikia/nsq-traefik-consumer/expression"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Expression", func() {
+	fields := map[string]interface{}{
+		"origin_status":       503.0,
+		"duration":            int64(1500000),
+		"origin_duration":     1200000.0,
+		"origin_content_size": 3000.0,
+		"request_method":      "GET",
+		"request__user-agent": "curl/7.54.0",
+		"ua_bot":              true,
+		"nested.value":        "x",
+		"empty":               nil,
+	}
+
+	expressions := []struct {
+		source   string
+		expected interface{}
+	}{
+		{`floor(origin_status / 100) + "xx"`, "5xx"},
+		{`origin_status >= 500`, true},
+		{`(duration - origin_duration) / 1e6`, 0.3},
+		{`duration / 1000000`, 1.5},
+		{`origin_content_size / (duration / 1e9)`, 2e6},
+		{`1 + 2 * 3 - 4 % 3`, 6.0},
+		{`-(1 + 2)`, -3.0},
+		{`request_method == "GET" && !ua_bot`, false},
+		{`request_method != 'POST' || missing > 1`, true},
+		{`origin_status < 400 ? "ok" : origin_status < 500 ? "client" : "server"`, "server"},
+		{`field("request__user-agent") =~ "^curl/"`, true},
+		{`request_method !~ "(?i)^post$"`, true},
+		{`lower(request_method) + "-" + string(origin_status)`, "get-503"},
+		{`number("12.5") + 1`, 13.5},
+		{`number("abc")`, nil},
+		{`min(3, 1, 2) + max(1, 5) + abs(-1) + ceil(0.2) + round(0.6)`, 9.0},
+		{`has("nested.value") && nested.value == "x"`, true},
+		{`has("empty")`, false},
+		{`contains(field("request__user-agent"), "7.54")`, true},
+		// minus is an operator, not a part of the name
+		{`request__user-agent`, nil},
+		{`coalesce(missing, empty, "default")`, "default"},
+		{`missing + 1`, nil},
+		{`missing > 1 ? "a" : "b"`, nil},
+		{`duration / 0`, nil},
+		{`"a" < "b"`, true},
+		{`true != false`, true},
+		{`null`, nil},
+	}
+
+	for _, e := range expressions {
+		e := e
+		It("should evaluate "+e.source, func() {
+			expr, err := Parse(e.source)
+			Expect(err).NotTo(HaveOccurred())
+
+			value, err := expr.Evaluate(fields)
+			Expect(err).NotTo(HaveOccurred())
+			switch expected := e.expected.(type) {
+			case nil:
+				Expect(value).To(BeNil())
+			case float64:
+				Expect(value).To(BeNumerically("~", expected, 1e-9))
+			default:
+				Expect(value).To(Equal(e.expected))
+			}
+		})
+	}
+
+	It("should report type errors on evaluation", func() {
+		for _, source := range []string{`request_method * 2`, `!origin_status`, `ua_bot && "x"`, `floor("x")`, `origin_status ? 1 : 2`} {
+			expr, err := Parse(source)
+			Expect(err).NotTo(HaveOccurred(), source)
+
+			_, err = expr.Evaluate(fields)
+			Expect(err).To(HaveOccurred(), source)
+		}
+	})
+
+	It("should reject invalid expressions", func() {
+		for _, source := range []string{``, `1 +`, `(1`, `a ? b`, `unknown(1)`, `floor(1, 2)`, `a =~ b`, `a =~ "("`, `"abc`, `a # b`, `1 2`} {
+			_, err := Parse(source)
+			Expect(err).To(HaveOccurred(), source)
+		}
+	})
+})
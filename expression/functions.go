@@ -0,0 +1,105 @@
+package expression
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Function can be called from expressions. Unless it's lazy, nil arguments make the result nil
+// without calling it.
+type Function struct {
+	MinArgs int
+	MaxArgs int // -1 means no limit
+	Lazy    bool
+	Call    func(fields map[string]interface{}, args []interface{}) (interface{}, error)
+}
+
+// Functions available in expressions
+var Functions = map[string]Function{
+	"floor": numeric(math.Floor),
+	"ceil":  numeric(math.Ceil),
+	"round": numeric(math.Round),
+	"abs":   numeric(math.Abs),
+	"min": {MinArgs: 1, MaxArgs: -1, Call: func(_ map[string]interface{}, args []interface{}) (interface{}, error) {
+		return reduce(args, math.Min)
+	}},
+	"max": {MinArgs: 1, MaxArgs: -1, Call: func(_ map[string]interface{}, args []interface{}) (interface{}, error) {
+		return reduce(args, math.Max)
+	}},
+	"number": {MinArgs: 1, MaxArgs: 1, Call: func(_ map[string]interface{}, args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case float64:
+			return v, nil
+		case bool:
+			if v {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		default:
+			number, err := strconv.ParseFloat(strings.TrimSpace(toString(v)), 64)
+			if err != nil {
+				// not a number - value can't be computed
+				return nil, nil
+			}
+			return number, nil
+		}
+	}},
+	"string": {MinArgs: 1, MaxArgs: 1, Call: func(_ map[string]interface{}, args []interface{}) (interface{}, error) {
+		return toString(args[0]), nil
+	}},
+	"lower": text(strings.ToLower),
+	"upper": text(strings.ToUpper),
+	"contains": {MinArgs: 2, MaxArgs: 2, Call: func(_ map[string]interface{}, args []interface{}) (interface{}, error) {
+		return strings.Contains(toString(args[0]), toString(args[1])), nil
+	}},
+	"field": {MinArgs: 1, MaxArgs: 1, Call: func(fields map[string]interface{}, args []interface{}) (interface{}, error) {
+		return normalize(fields[toString(args[0])]), nil
+	}},
+	"has": {MinArgs: 1, MaxArgs: 1, Call: func(fields map[string]interface{}, args []interface{}) (interface{}, error) {
+		value, has := fields[toString(args[0])]
+		return has && value != nil, nil
+	}},
+	"coalesce": {MinArgs: 1, MaxArgs: -1, Lazy: true, Call: func(_ map[string]interface{}, args []interface{}) (interface{}, error) {
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}},
+}
+
+func numeric(fn func(float64) float64) Function {
+	return Function{MinArgs: 1, MaxArgs: 1, Call: func(_ map[string]interface{}, args []interface{}) (interface{}, error) {
+		number, ok := args[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("number expected, got %s", typeName(args[0]))
+		}
+		return fn(number), nil
+	}}
+}
+
+func text(fn func(string) string) Function {
+	return Function{MinArgs: 1, MaxArgs: 1, Call: func(_ map[string]interface{}, args []interface{}) (interface{}, error) {
+		return fn(toString(args[0])), nil
+	}}
+}
+
+func reduce(args []interface{}, fn func(float64, float64) float64) (interface{}, error) {
+	result := math.NaN()
+	for idx, arg := range args {
+		number, ok := arg.(float64)
+		if !ok {
+			return nil, fmt.Errorf("number expected, got %s", typeName(arg))
+		}
+		if idx == 0 {
+			result = number
+		} else {
+			result = fn(result, number)
+		}
+	}
+
+	return result, nil
+}
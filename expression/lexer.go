@@ -0,0 +1,126 @@
+package expression
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{} // parsed value of numbers and strings
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+
+	return fmt.Sprintf("%q at offset %d", t.text, t.pos)
+}
+
+// operators are sorted so the longer ones are matched first
+var operators = []string{
+	"==", "!=", "<=", ">=", "&&", "||", "=~", "!~",
+	"+", "-", "*", "/", "%", "<", ">", "!", "(", ")", ",", "?", ":",
+}
+
+func tokenize(src string) ([]token, error) {
+	tokens := []token{}
+
+	for pos := 0; pos < len(src); {
+		c := src[pos]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case isDigit(c) || c == '.' && pos+1 < len(src) && isDigit(src[pos+1]):
+			end := pos
+			for end < len(src) && (isDigit(src[end]) || src[end] == '.' || src[end] == 'e' || src[end] == 'E' ||
+				(src[end] == '+' || src[end] == '-') && (src[end-1] == 'e' || src[end-1] == 'E')) {
+				end++
+			}
+			value, err := strconv.ParseFloat(src[pos:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at offset %d", src[pos:end], pos)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[pos:end], value: value, pos: pos})
+			pos = end
+		case c == '"' || c == '\'':
+			end := pos + 1
+			for end < len(src) && src[end] != c {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", pos)
+			}
+			value, err := unquote(src[pos : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %s", pos, err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: src[pos : end+1], value: value, pos: pos})
+			pos = end + 1
+		case isIdentStart(c):
+			end := pos
+			for end < len(src) && isIdentPart(src[end]) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[pos:end], pos: pos})
+			pos = end
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[pos:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: pos})
+					pos += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character '%c' at offset %d", c, pos)
+			}
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+// unquote handles both double and single quoted strings with Go escape sequences
+func unquote(quoted string) (string, error) {
+	if quoted[0] == '\'' {
+		inner := quoted[1 : len(quoted)-1]
+		inner = strings.Replace(inner, `\'`, `'`, -1)
+		inner = strings.Replace(inner, `"`, `\"`, -1)
+		quoted = `"` + inner + `"`
+	}
+
+	return strconv.Unquote(quoted)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '.'
+}
@@ -0,0 +1,175 @@
+package expression
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const unaryPrecedence = 8
+
+var precedence = map[string]int{
+	"?":  1,
+	"||": 2,
+	"&&": 3,
+	"==": 4, "!=": 4, "=~": 4, "!~": 4,
+	"<": 5, "<=": 5, ">": 5, ">=": 5,
+	"+": 6, "-": 6,
+	"*": 7, "/": 7, "%": 7,
+}
+
+// parser is a simple precedence climbing parser
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) expect(op string) error {
+	if t := p.next(); t.kind != tokenOperator || t.text != op {
+		return fmt.Errorf("expected %q, got %s", op, t)
+	}
+
+	return nil
+}
+
+func (p *parser) parse(minPrecedence int) (node, error) {
+	left, err := p.parsePrefix()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		prec, isBinary := precedence[t.text]
+		if t.kind != tokenOperator || !isBinary || prec < minPrecedence {
+			return left, nil
+		}
+		p.next()
+
+		switch t.text {
+		case "?":
+			then, err := p.parse(0)
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			// right associative
+			otherwise, err := p.parse(prec)
+			if err != nil {
+				return nil, err
+			}
+			left = conditional{condition: left, then: then, otherwise: otherwise}
+		case "=~", "!~":
+			pattern := p.next()
+			if pattern.kind != tokenString {
+				return nil, fmt.Errorf("operator %s needs a string literal with a pattern, got %s", t.text, pattern)
+			}
+			rxp, err := regexp.Compile(pattern.value.(string))
+			if err != nil {
+				return nil, err
+			}
+			left = match{negated: t.text == "!~", operand: left, pattern: rxp}
+		default:
+			right, err := p.parse(prec + 1)
+			if err != nil {
+				return nil, err
+			}
+			if t.text == "&&" || t.text == "||" {
+				left = logical{op: t.text, left: left, right: right}
+			} else {
+				left = binary{op: t.text, left: left, right: right}
+			}
+		}
+	}
+}
+
+func (p *parser) parsePrefix() (node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenNumber, tokenString:
+		return literal{t.value}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "null":
+			return literal{nil}, nil
+		}
+
+		if next := p.peek(); next.kind == tokenOperator && next.text == "(" {
+			return p.parseCall(t)
+		}
+
+		return variable{t.text}, nil
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			inner, err := p.parse(0)
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "-", "!":
+			operand, err := p.parse(unaryPrecedence)
+			if err != nil {
+				return nil, err
+			}
+			return unary{op: t.text, operand: operand}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %s", t)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, has := Functions[name.text]
+	if !has {
+		return nil, fmt.Errorf("unknown function %q at offset %d", name.text, name.pos)
+	}
+
+	p.next() // (
+	args := []node{}
+
+	if t := p.peek(); t.kind == tokenOperator && t.text == ")" {
+		p.next()
+	} else {
+		for {
+			arg, err := p.parse(0)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			t := p.next()
+			if t.kind == tokenOperator && t.text == ")" {
+				break
+			}
+			if t.kind != tokenOperator || t.text != "," {
+				return nil, fmt.Errorf("expected \",\" or \")\", got %s", t)
+			}
+		}
+	}
+
+	if len(args) < fn.MinArgs || fn.MaxArgs >= 0 && len(args) > fn.MaxArgs {
+		return nil, fmt.Errorf("wrong number of arguments for %s: %d", name.text, len(args))
+	}
+
+	return call{name: name.text, fn: fn, args: args}, nil
+}
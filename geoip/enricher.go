@@ -0,0 +1,292 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/oschwald/maxminddb-golang"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+const (
+	DefaultCacheSize      = 10000
+	DefaultReloadInterval = time.Minute
+
+	CountryField = "geo_country"
+	RegionField  = "geo_region"
+	ASNField     = "geo_asn"
+	ASOrgField   = "geo_as_org"
+)
+
+// Location holds information found for a single IP address
+type Location struct {
+	Country string
+	Region  string
+	ASN     uint64
+	ASOrg   string
+}
+
+type cityRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+type asnRecord struct {
+	Number       uint64 `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// database keeps reader for a single MMDB file and reloads it when the file changes
+type database struct {
+	sync.RWMutex
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+func openDatabase(path string) (*database, error) {
+	db := database{path: path}
+	_, err := db.reload()
+	return &db, err
+}
+
+// reload opens database again if the file was modified and reports whether it happened
+func (db *database) reload() (bool, error) {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+
+	db.RLock()
+	unchanged := info.ModTime().Equal(db.modTime)
+	db.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	// database is kept in memory instead of being mapped, so lookups still using the previous reader
+	// are safe when it's replaced
+	buffer, err := os.ReadFile(db.path)
+	if err != nil {
+		return false, err
+	}
+
+	reader, err := maxminddb.FromBytes(buffer)
+	if err != nil {
+		return false, err
+	}
+
+	db.Lock()
+	db.reader = reader
+	db.modTime = info.ModTime()
+	db.Unlock()
+
+	return true, nil
+}
+
+func (db *database) lookup(ip net.IP, result interface{}) error {
+	db.RLock()
+	reader := db.reader
+	db.RUnlock()
+
+	return reader.Lookup(ip, result)
+}
+
+// Enricher adds country, region and autonomous system of the client to parsed logs
+type Enricher struct {
+	city            *database
+	asn             *database
+	useForwardedFor bool
+	cache           *common.LRUCache
+	lookups         stats.Counter
+	failures        stats.Counter
+	stop            chan struct{}
+}
+
+// NewEnricher opens configured databases; it returns nil when no database is configured
+func NewEnricher(config common.GeoIPConfig) (*Enricher, error) {
+	if len(config.CityDatabase) == 0 && len(config.ASNDatabase) == 0 {
+		return nil, nil
+	}
+
+	e := Enricher{
+		useForwardedFor: config.UseForwardedFor,
+		lookups:         stats.GetOrRegisterCounter("geoip_lookups", stats.DefaultRegistry),
+		failures:        stats.GetOrRegisterCounter("geoip_failures", stats.DefaultRegistry),
+		stop:            make(chan struct{}),
+	}
+
+	cacheSize := config.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = DefaultCacheSize
+	}
+	e.cache = common.NewLRUCache(cacheSize)
+
+	var err error
+	if len(config.CityDatabase) > 0 {
+		if e.city, err = openDatabase(config.CityDatabase); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.ASNDatabase) > 0 {
+		if e.asn, err = openDatabase(config.ASNDatabase); err != nil {
+			return nil, err
+		}
+	}
+
+	interval := config.ReloadInterval
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	go e.watch(interval)
+
+	return &e, nil
+}
+
+// Close stops watching database files for changes
+func (e *Enricher) Close() {
+	close(e.stop)
+}
+
+func (e *Enricher) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			e.Reload()
+		}
+	}
+}
+
+// Reload opens database files again if they changed since they were loaded
+func (e *Enricher) Reload() {
+	reloaded := false
+
+	for _, db := range []*database{e.city, e.asn} {
+		if db == nil {
+			continue
+		}
+
+		changed, err := db.reload()
+		if err != nil {
+			common.Log.WithError(err).WithField("path", db.path).Error("Could not reload GeoIP database")
+			continue
+		}
+
+		if changed {
+			common.Log.WithField("path", db.path).Info("GeoIP database reloaded")
+			reloaded = true
+		}
+	}
+
+	if reloaded {
+		// results from the previous versions of the databases can't be trusted anymore
+		e.cache.Purge()
+	}
+}
+
+// Enrich looks up client address and adds geo_* fields to the parsed log
+func (e *Enricher) Enrich(parsedLog map[string]interface{}) {
+	address := e.clientAddress(parsedLog)
+	if len(address) == 0 {
+		return
+	}
+
+	location, err := e.Lookup(address)
+	if err != nil {
+		e.failures.Inc(1)
+		common.Log.WithError(err).WithField("address", address).Debug("GeoIP lookup failed")
+		return
+	}
+
+	if len(location.Country) > 0 {
+		parsedLog[CountryField] = location.Country
+	}
+	if len(location.Region) > 0 {
+		parsedLog[RegionField] = location.Region
+	}
+	if location.ASN > 0 {
+		parsedLog[ASNField] = int64(location.ASN)
+	}
+	if len(location.ASOrg) > 0 {
+		parsedLog[ASOrgField] = location.ASOrg
+	}
+}
+
+// clientAddress picks first hop of X-Forwarded-For (when enabled) or client_host
+func (e *Enricher) clientAddress(parsedLog map[string]interface{}) string {
+	if e.useForwardedFor {
+		if chain, ok := parsedLog["request__x-forwarded-for"].(string); ok {
+			if first := strings.TrimSpace(strings.SplitN(chain, ",", 2)[0]); len(first) > 0 {
+				return first
+			}
+		}
+	}
+
+	host, _ := parsedLog["client_host"].(string)
+	return host
+}
+
+// Lookup returns location of the address using cache when possible
+func (e *Enricher) Lookup(address string) (Location, error) {
+	if cached, has := e.cache.Get(address); has {
+		return cached.(Location), nil
+	}
+
+	location := Location{}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+
+	if ip == nil {
+		return location, &net.ParseError{Type: "IP address", Text: address}
+	}
+
+	e.lookups.Inc(1)
+
+	if e.city != nil {
+		record := cityRecord{}
+		if err := e.city.lookup(ip, &record); err != nil {
+			return location, err
+		}
+		location.Country = record.Country.ISOCode
+		if len(record.Subdivisions) > 0 {
+			location.Region = record.Subdivisions[0].ISOCode
+		}
+	}
+
+	if e.asn != nil {
+		record := asnRecord{}
+		if err := e.asn.lookup(ip, &record); err != nil {
+			return location, err
+		}
+		location.ASN = record.Number
+		location.ASOrg = record.Organization
+	}
+
+	e.cache.Add(address, location)
+
+	if log.GetLevel() >= log.DebugLevel {
+		common.Log.WithField("address", address).WithField("location", location).Debug("GeoIP lookup")
+	}
+
+	return location, nil
+}
@@ -0,0 +1,161 @@
+package geoip_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/geoip"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func cityRecord(country, region string) map[string]interface{} {
+	return map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": country, "names": map[string]interface{}{"en": strings.Repeat(country, 20)}},
+		"subdivisions": []interface{}{map[string]interface{}{"iso_code": region}},
+		"location":     map[string]interface{}{"latitude": 37.3394, "longitude": -121.895, "accuracy_radius": uint16(20)},
+		"is_in_eu":     country == "PL",
+	}
+}
+
+var testNetworks = []TestNetwork{
+	{CIDR: "10.0.0.0/8", Record: cityRecord("US", "CA")},
+	{CIDR: "192.168.1.0/24", Record: cityRecord("PL", "WP")},
+	{CIDR: "2001:db8::/32", Record: cityRecord("DE", "BE")},
+}
+
+var _ = Describe("Enricher", func() {
+	var (
+		dir      string
+		config   common.GeoIPConfig
+		enricher *Enricher
+	)
+
+	asnNetworks := []TestNetwork{
+		{CIDR: "10.0.0.0/8", Record: map[string]interface{}{"autonomous_system_number": uint32(64512), "autonomous_system_organization": "Example Org"}},
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "geoip")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = common.GeoIPConfig{
+			CityDatabase: filepath.Join(dir, "city.mmdb"),
+			ASNDatabase:  filepath.Join(dir, "asn.mmdb"),
+		}
+		Expect(WriteTestDatabase(config.CityDatabase, 28, "GeoIP2-City", testNetworks)).To(Succeed())
+		Expect(WriteTestDatabase(config.ASNDatabase, 24, "GeoLite2-ASN", asnNetworks)).To(Succeed())
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		enricher, err = NewEnricher(config)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if enricher != nil {
+			enricher.Close()
+		}
+		os.RemoveAll(dir)
+	})
+
+	It("should add country, region and ASN of the client", func() {
+		parsedLog := map[string]interface{}{"client_host": "10.1.2.3"}
+		enricher.Enrich(parsedLog)
+
+		Expect(parsedLog).To(Equal(map[string]interface{}{
+			"client_host": "10.1.2.3",
+			CountryField:  "US",
+			RegionField:   "CA",
+			ASNField:      int64(64512),
+			ASOrgField:    "Example Org",
+		}))
+	})
+
+	It("should skip unknown and invalid addresses", func() {
+		parsedLog := map[string]interface{}{"client_host": "8.8.8.8"}
+		enricher.Enrich(parsedLog)
+		Expect(parsedLog).To(HaveLen(1))
+
+		parsedLog = map[string]interface{}{"client_host": "localhost"}
+		enricher.Enrich(parsedLog)
+		Expect(parsedLog).To(HaveLen(1))
+	})
+
+	Context("with X-Forwarded-For enabled", func() {
+		BeforeEach(func() {
+			config.UseForwardedFor = true
+		})
+
+		It("should use the first hop", func() {
+			parsedLog := map[string]interface{}{"client_host": "10.1.2.3", "request__x-forwarded-for": "2001:db8::1, 10.1.2.3"}
+			enricher.Enrich(parsedLog)
+
+			Expect(parsedLog).To(HaveKeyWithValue(CountryField, "DE"))
+			Expect(parsedLog).NotTo(HaveKey(ASNField))
+		})
+	})
+
+	It("should reload databases when they change", func() {
+		location, err := enricher.Lookup("192.168.1.1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(location.Country).To(Equal("PL"))
+
+		Expect(WriteTestDatabase(config.CityDatabase, 32, "GeoIP2-City", []TestNetwork{{CIDR: "192.168.0.0/16", Record: cityRecord("CZ", "10")}})).To(Succeed())
+		future := time.Now().Add(time.Hour)
+		Expect(os.Chtimes(config.CityDatabase, future, future)).To(Succeed())
+
+		enricher.Reload()
+
+		location, err = enricher.Lookup("192.168.1.1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(location.Country).To(Equal("CZ"))
+	})
+
+	Context("with a short reload interval", func() {
+		BeforeEach(func() {
+			config.ReloadInterval = 10 * time.Millisecond
+		})
+
+		It("should stop reloading databases once closed", func() {
+			enricher.Close()
+			closed := enricher
+			enricher = nil
+
+			Expect(WriteTestDatabase(config.CityDatabase, 32, "GeoIP2-City", []TestNetwork{{CIDR: "192.168.0.0/16", Record: cityRecord("CZ", "10")}})).To(Succeed())
+			future := time.Now().Add(time.Hour)
+			Expect(os.Chtimes(config.CityDatabase, future, future)).To(Succeed())
+
+			Consistently(func() string {
+				location, _ := closed.Lookup("192.168.1.1")
+				return location.Country
+			}, "100ms").Should(Equal("PL"))
+		})
+	})
+
+	It("should do nothing without databases", func() {
+		empty, err := NewEnricher(common.GeoIPConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(empty).To(BeNil())
+	})
+
+	It("should fail on missing database", func() {
+		_, err := NewEnricher(common.GeoIPConfig{CityDatabase: filepath.Join(dir, "missing.mmdb")})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail on files which are not MaxMind databases", func() {
+		invalid := filepath.Join(dir, "invalid.mmdb")
+		Expect(ioutil.WriteFile(invalid, []byte("definitely not a database"), 0644)).To(Succeed())
+
+		_, err := NewEnricher(common.GeoIPConfig{CityDatabase: invalid})
+		Expect(err).To(HaveOccurred())
+	})
+})
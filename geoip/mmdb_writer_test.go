@@ -0,0 +1,269 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"sort"
+)
+
+// This file contains a minimal MaxMind DB writer used to generate test fixtures
+
+// metadataMarker separates search tree and data section from the database metadata
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const dataSectionSeparatorSize = 16
+
+// data types of the MaxMind DB data section
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+type TestNetwork struct {
+	CIDR   string
+	Record map[string]interface{}
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	data     [2]int // index of the network + 1 (0 - no data)
+	id       uint
+}
+
+// BuildTestDatabase creates IPv6 database (with IPv4 networks mapped into ::/96) holding given networks
+func BuildTestDatabase(recordSize uint, databaseType string, networks []TestNetwork) []byte {
+	root := &trieNode{}
+
+	for idx, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.CIDR)
+		if err != nil {
+			panic(err)
+		}
+
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if ipv4 := ipNet.IP.To4(); ipv4 != nil {
+			ip = append(make([]byte, 12), ipv4...)
+			ones += 96
+		}
+
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i>>3] >> (7 - uint(i&7))) & 1
+			if i == ones-1 {
+				node.data[bit] = idx + 1
+				break
+			}
+			if node.children[bit] == nil {
+				node.children[bit] = &trieNode{}
+			}
+			node = node.children[bit]
+		}
+	}
+
+	// number nodes breadth first
+	nodes := []*trieNode{root}
+	for i := 0; i < len(nodes); i++ {
+		nodes[i].id = uint(i)
+		for _, child := range nodes[i].children {
+			if child != nil {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	nodeCount := uint(len(nodes))
+
+	data := newTestEncoder(true)
+	offsets := make([]uint, len(networks))
+	for idx, network := range networks {
+		offsets[idx] = uint(data.Len())
+		data.encode(network.Record)
+	}
+
+	tree := &bytes.Buffer{}
+	for _, node := range nodes {
+		records := [2]uint{}
+		for bit := 0; bit < 2; bit++ {
+			switch {
+			case node.children[bit] != nil:
+				records[bit] = node.children[bit].id
+			case node.data[bit] > 0:
+				records[bit] = nodeCount + dataSectionSeparatorSize + offsets[node.data[bit]-1]
+			default:
+				records[bit] = nodeCount
+			}
+		}
+		writeNode(tree, recordSize, records[0], records[1])
+	}
+
+	buffer := &bytes.Buffer{}
+	buffer.Write(tree.Bytes())
+	buffer.Write(make([]byte, dataSectionSeparatorSize))
+	buffer.Write(data.Bytes())
+	buffer.Write(metadataMarker)
+
+	metadata := newTestEncoder(false)
+	metadata.encode(map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(6),
+		"database_type":               databaseType,
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1506816000),
+		"description":                 map[string]interface{}{"en": "Test database"},
+	})
+	buffer.Write(metadata.Bytes())
+
+	return buffer.Bytes()
+}
+
+// WriteTestDatabase stores database built by BuildTestDatabase in a file
+func WriteTestDatabase(path string, recordSize uint, databaseType string, networks []TestNetwork) error {
+	return os.WriteFile(path, BuildTestDatabase(recordSize, databaseType, networks), 0644)
+}
+
+func writeNode(buffer *bytes.Buffer, recordSize uint, left, right uint) {
+	switch recordSize {
+	case 24:
+		buffer.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+	case 28:
+		buffer.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left),
+			byte((left>>24)&0x0F)<<4 | byte((right>>24)&0x0F),
+			byte(right >> 16), byte(right >> 8), byte(right)})
+	case 32:
+		raw := make([]byte, 8)
+		binary.BigEndian.PutUint32(raw, uint32(left))
+		binary.BigEndian.PutUint32(raw[4:], uint32(right))
+		buffer.Write(raw)
+	default:
+		panic("unsupported record size")
+	}
+}
+
+type testEncoder struct {
+	bytes.Buffer
+	usePointers bool
+	strings     map[string]uint
+}
+
+func newTestEncoder(usePointers bool) *testEncoder {
+	return &testEncoder{usePointers: usePointers, strings: map[string]uint{}}
+}
+
+func (e *testEncoder) control(dataType uint, size uint) {
+	first := byte(0)
+	if dataType <= 7 {
+		first = byte(dataType << 5)
+	}
+
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+		first |= byte(size)
+	case size < 285:
+		first |= 29
+		sizeBytes = []byte{byte(size - 29)}
+	case size < 65821:
+		first |= 30
+		size -= 285
+		sizeBytes = []byte{byte(size >> 8), byte(size)}
+	default:
+		first |= 31
+		size -= 65821
+		sizeBytes = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+	}
+
+	e.WriteByte(first)
+	if dataType > 7 {
+		e.WriteByte(byte(dataType - 7))
+	}
+	e.Write(sizeBytes)
+}
+
+func (e *testEncoder) pointer(offset uint) {
+	if offset < 2048 {
+		e.Write([]byte{byte(typePointer<<5) | byte(offset>>8)&0x7, byte(offset)})
+		return
+	}
+
+	offset -= 2048
+	e.Write([]byte{byte(typePointer<<5) | 0x08 | byte(offset>>16)&0x7, byte(offset >> 8), byte(offset)})
+}
+
+func (e *testEncoder) uint(dataType uint, value uint64) {
+	raw := []byte{}
+	for value > 0 {
+		raw = append([]byte{byte(value)}, raw...)
+		value >>= 8
+	}
+	e.control(dataType, uint(len(raw)))
+	e.Write(raw)
+}
+
+func (e *testEncoder) encode(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		if offset, has := e.strings[v]; has && e.usePointers {
+			e.pointer(offset)
+			return
+		}
+		e.strings[v] = uint(e.Len())
+		e.control(typeString, uint(len(v)))
+		e.WriteString(v)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		e.control(typeMap, uint(len(v)))
+		for _, key := range keys {
+			e.encode(key)
+			e.encode(v[key])
+		}
+	case []interface{}:
+		e.control(typeArray, uint(len(v)))
+		for _, item := range v {
+			e.encode(item)
+		}
+	case bool:
+		size := uint(0)
+		if v {
+			size = 1
+		}
+		e.control(typeBool, size)
+	case float64:
+		e.control(typeDouble, 8)
+		binary.Write(e, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		e.uint(typeUint16, uint64(v))
+	case uint32:
+		e.uint(typeUint32, uint64(v))
+	case int:
+		e.uint(typeUint32, uint64(v))
+	case uint64:
+		e.uint(typeUint64, v)
+	default:
+		panic("unsupported type")
+	}
+}
@@ -13,6 +13,7 @@ require (
 	github.com/nsqio/go-nsq v1.0.8-0.20170807022704-1336c299dd90
 	github.com/onsi/ginkgo v1.16.2
 	github.com/onsi/gomega v1.11.0
+	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/pelletier/go-toml v1.0.1-0.20170904195809-1d6b12b7cb29 // indirect
 	github.com/rcrowley/go-metrics v0.0.0-20161128210544-1f30fe9094a5
 	github.com/spf13/afero v0.0.0-20170901052352-ee1bd8ee15a1 // indirect
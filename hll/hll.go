@@ -0,0 +1,156 @@
+// Package hll implements HyperLogLog - cardinality estimation of large sets in constant memory. Sketches with the
+// same precision can be merged, so counts from many consumer replicas can be combined.
+package hll
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	MinPrecision     = 4
+	MaxPrecision     = 16
+	DefaultPrecision = 12
+
+	formatVersion = 1
+)
+
+// Sketch estimates number of distinct values added to it (with standard error of 1.04/sqrt(2^precision))
+type Sketch struct {
+	precision uint8
+	registers []uint8
+}
+
+// New creates an empty sketch using 2^precision registers (bytes)
+func New(precision uint8) (*Sketch, error) {
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil, fmt.Errorf("precision has to be between %d and %d", MinPrecision, MaxPrecision)
+	}
+
+	return &Sketch{precision: precision, registers: make([]uint8, 1<<precision)}, nil
+}
+
+// Precision returns number of bits used to pick a register
+func (s *Sketch) Precision() uint8 {
+	return s.precision
+}
+
+// Add adds a value to the set
+func (s *Sketch) Add(value []byte) {
+	h := fnv.New64a()
+	h.Write(value)
+	hash := mix(h.Sum64())
+
+	index := hash >> (64 - s.precision)
+	// position of the first set bit in the remaining bits (with a sentinel bit if all of them are zero)
+	rank := uint8(bits.LeadingZeros64(hash<<s.precision|1<<(s.precision-1)) + 1)
+
+	if rank > s.registers[index] {
+		s.registers[index] = rank
+	}
+}
+
+// AddString adds a text value to the set
+func (s *Sketch) AddString(value string) {
+	s.Add([]byte(value))
+}
+
+// Estimate returns approximate number of distinct values added
+func (s *Sketch) Estimate() uint64 {
+	m := float64(len(s.registers))
+
+	sum, zeros := 0.0, 0
+	for _, register := range s.registers {
+		sum += math.Ldexp(1, -int(register))
+		if register == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha(len(s.registers)) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small sets
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+// Merge adds all the values of the other sketch to this one
+func (s *Sketch) Merge(other *Sketch) error {
+	if s.precision != other.precision {
+		return fmt.Errorf("sketches with different precision can't be merged (%d and %d)", s.precision, other.precision)
+	}
+
+	for i, register := range other.registers {
+		if register > s.registers[i] {
+			s.registers[i] = register
+		}
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes the sketch as format version, precision and registers
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 2+len(s.registers))
+	data = append(data, formatVersion, s.precision)
+	return append(data, s.registers...), nil
+}
+
+// UnmarshalBinary decodes sketch encoded with MarshalBinary
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return errors.New("sketch data too short")
+	}
+
+	if data[0] != formatVersion {
+		return fmt.Errorf("unknown sketch format version: %d", data[0])
+	}
+
+	decoded, err := New(data[1])
+	if err != nil {
+		return err
+	}
+
+	if len(data)-2 != len(decoded.registers) {
+		return fmt.Errorf("expected %d registers, got %d", len(decoded.registers), len(data)-2)
+	}
+
+	for _, register := range data[2:] {
+		if register > 64-decoded.precision+1 {
+			return fmt.Errorf("invalid register value: %d", register)
+		}
+	}
+
+	copy(decoded.registers, data[2:])
+	*s = *decoded
+
+	return nil
+}
+
+func alpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+
+	return 0.7213 / (1 + 1.079/float64(m))
+}
+
+// mix spreads bits of FNV hash (its low bits are weak) - finalizer of SplitMix64
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,13 @@
+package hll_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestHll(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "HyperLogLog Suite")
+}
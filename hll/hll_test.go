@@ -0,0 +1,80 @@
+package hll_test
+
+import (
+	"fmt"
+
+	. "github.com/Wikia/nsq-traefik-consumer/hll"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sketch", func() {
+	fill := func(sketch *Sketch, from, to int) *Sketch {
+		for i := from; i < to; i++ {
+			sketch.AddString(fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff))
+		}
+		return sketch
+	}
+
+	newSketch := func() *Sketch {
+		sketch, err := New(DefaultPrecision)
+		Expect(err).NotTo(HaveOccurred())
+		return sketch
+	}
+
+	It("should reject invalid precision", func() {
+		for _, precision := range []uint8{0, MinPrecision - 1, MaxPrecision + 1} {
+			_, err := New(precision)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("should estimate cardinality within error bounds", func() {
+		for _, count := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+			estimate := float64(fill(newSketch(), 0, count).Estimate())
+			Expect(estimate).To(BeNumerically("~", count, 0.05*float64(count)+0.5), fmt.Sprint(count))
+		}
+	})
+
+	It("should ignore repeated values", func() {
+		sketch := fill(newSketch(), 0, 1000)
+		for i := 0; i < 10; i++ {
+			fill(sketch, 0, 1000)
+		}
+		Expect(float64(sketch.Estimate())).To(BeNumerically("~", 1000, 50))
+	})
+
+	It("should merge sketches", func() {
+		merged := fill(newSketch(), 0, 6000)
+		Expect(merged.Merge(fill(newSketch(), 4000, 10000))).To(Succeed())
+		Expect(float64(merged.Estimate())).To(BeNumerically("~", 10000, 500))
+
+		other, err := New(DefaultPrecision + 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(merged.Merge(other)).NotTo(Succeed())
+	})
+
+	It("should survive serialization", func() {
+		sketch := fill(newSketch(), 0, 5000)
+		data, err := sketch.MarshalBinary()
+		Expect(err).NotTo(HaveOccurred())
+
+		decoded := &Sketch{}
+		Expect(decoded.UnmarshalBinary(data)).To(Succeed())
+		Expect(decoded.Precision()).To(Equal(uint8(DefaultPrecision)))
+		Expect(decoded.Estimate()).To(Equal(sketch.Estimate()))
+	})
+
+	It("should reject invalid data", func() {
+		data, err := newSketch().MarshalBinary()
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, invalid := range [][]byte{nil, {1}, {2, DefaultPrecision}, {1, 30}, data[:100], append(append([]byte{}, data...), 0)} {
+			Expect((&Sketch{}).UnmarshalBinary(invalid)).NotTo(Succeed())
+		}
+
+		data[10] = 100
+		Expect((&Sketch{}).UnmarshalBinary(data)).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// DefaultAggregationInterval is used when Aggregation.Interval is not set
+const DefaultAggregationInterval = time.Minute
+
+// Observation is a log entry matched by a rule - aggregators get all of them (sampling doesn't apply)
+type Observation struct {
+	Rule   string                 // ID of the matched rule
+	Format string                 // log format of the entry
+	Fields map[string]interface{} // parsed log entry
+	Time   time.Time              // time of processing
+	Pod    PodConfig              // settings of the Traefik POD
+
+	// values of client fields before anonymization - they must not be sent anywhere
+	Clients map[string]interface{}
+}
+
+// Frontend returns name of the Traefik frontend which handled the request
+func (o Observation) Frontend() string {
+	frontend, _ := o.Fields["frontend_name"].(string)
+	return frontend
+}
+
+// Backend returns name of the Traefik backend which handled the request
+func (o Observation) Backend() string {
+	backend, _ := o.Fields["backend_name"].(string)
+	return backend
+}
+
+// Value returns the field as text (false when it's missing)
+func (o Observation) Value(field string) (string, bool) {
+	value, has := o.Fields[field]
+	if !has || value == nil {
+		return "", false
+	}
+
+	text := fmt.Sprint(value)
+	return text, len(text) > 0
+}
+
+// ClientValue is like Value, but returns the value from before anonymization for client fields
+func (o Observation) ClientValue(field string) (string, bool) {
+	if _, has := o.Clients[field]; has {
+		return Observation{Fields: o.Clients}.Value(field)
+	}
+
+	return o.Value(field)
+}
+
+// Duration returns value of the duration field (duration, origin_duration etc.) in milliseconds
+func (o Observation) Duration(field string) (float64, bool) {
+	value, ok := toFloat(o.Fields[field])
+	if !ok {
+		return 0, false
+	}
+
+	if unit, known := units[DefaultSourceUnits[o.Format][field]]; known {
+		value = value * unit.factor / units["ms"].factor
+	}
+
+	return value, true
+}
+
+// IsError tells whether the request failed on the server side (status 5xx)
+func (o Observation) IsError() bool {
+	status, ok := toFloat(o.Fields["origin_status"])
+	return ok && status >= 500
+}
+
+// Aggregator summarises log entries and periodically emits points of its own
+type Aggregator interface {
+	// Observe is called for every log entry matched by a rule
+	Observe(o Observation)
+	// Flush returns points summarising entries observed since the previous flush
+	Flush(now time.Time) []*client.Point
+}
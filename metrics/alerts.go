@@ -0,0 +1,392 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/influxdata/influxdb/client/v2"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+// Metrics alerts can be set on (besides latency_p<percentile>, i.e. latency_p99)
+const (
+	AlertErrorRatio = "error_ratio"
+
+	AlertLatencyPrefix = "latency_p"
+)
+
+// States of alerts
+const (
+	AlertInactive = "inactive"
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+const (
+	DefaultAlertWindow         = 5 * time.Minute
+	DefaultAlertWebhookTimeout = 10 * time.Second
+
+	// notifications waiting to be sent - new ones are dropped when webhook can't keep up
+	alertQueueSize = 100
+)
+
+// AlertNotification is sent (as JSON) to the webhook when alert starts firing, when it's resolved
+// and every repeat interval while it's firing
+type AlertNotification struct {
+	Alert       string     `json:"alert"`
+	Fingerprint string     `json:"fingerprint"` // the same for the alert of the frontend on every replica
+	Replica     string     `json:"replica"`     // consumer which evaluated the alert
+	Status      string     `json:"status"`
+	Frontend    string     `json:"frontend_name"`
+	Metric      string     `json:"metric"`
+	Value       float64    `json:"value"`
+	Threshold   float64    `json:"threshold"`
+	StartsAt    time.Time  `json:"starts_at"`
+	EndsAt      *time.Time `json:"ends_at,omitempty"`
+	NoData      bool       `json:"no_data,omitempty"` // resolved because there were not enough requests for a whole window
+}
+
+type alertRule struct {
+	name             string
+	frontend         *regexp.Regexp
+	metric           string
+	quantile         float64 // for latency metrics
+	durationField    string
+	threshold        float64
+	resolveThreshold float64
+	window           time.Duration
+	pendingFor       time.Duration
+	minRequests      int64
+}
+
+// value computes the metric of the alert - false is returned when there's not enough requests
+func (r *alertRule) value(s *requestStats) (float64, bool) {
+	if s.total == 0 || s.total < r.minRequests {
+		return 0, false
+	}
+
+	if r.metric == AlertErrorRatio {
+		return s.ErrorRatio(), true
+	}
+
+	if s.timed == 0 {
+		return 0, false
+	}
+
+	return s.latency.Quantile(r.quantile), true
+}
+
+type alertKey struct {
+	alert    string
+	frontend string
+}
+
+type alertState struct {
+	window   *statsWindow
+	state    string
+	since    time.Time // when the alert became pending or started firing
+	notified time.Time
+	lastData time.Time // when the alert was evaluated for the last time
+}
+
+// Alerts watches metrics of frontends over recent windows and notifies the webhook when they cross thresholds.
+// Alerts are pending for a while before they fire and resolve only after going below the (lower)
+// resolve threshold, so flapping values don't cause floods of notifications.
+type Alerts struct {
+	sync.Mutex
+	rules          []*alertRule
+	states         map[alertKey]*alertState
+	repeatInterval time.Duration
+	notifications  chan AlertNotification
+	webhookURL     string
+	httpClient     *http.Client
+	limiter        *common.LogLimiter
+	sent           stats.Counter
+	failed         stats.Counter
+	dropped        stats.Counter
+}
+
+// NewAlerts validates alert rules and starts sending notifications. It returns nil when there are no rules.
+func NewAlerts(config common.AlertsConfig) (*Alerts, error) {
+	if len(config.Rules) == 0 {
+		return nil, nil
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultAlertWebhookTimeout
+	}
+
+	a := Alerts{
+		states:         map[alertKey]*alertState{},
+		repeatInterval: config.RepeatInterval,
+		webhookURL:     config.WebhookURL,
+		httpClient:     &http.Client{Timeout: timeout},
+		limiter:        common.NewLogLimiter(time.Minute),
+		sent:           stats.GetOrRegisterCounter("alert_notifications_sent", stats.DefaultRegistry),
+		failed:         stats.GetOrRegisterCounter("alert_notification_errors", stats.DefaultRegistry),
+		dropped:        stats.GetOrRegisterCounter("alert_notifications_dropped", stats.DefaultRegistry),
+	}
+
+	names := map[string]bool{}
+	for _, cfg := range config.Rules {
+		rule, err := newAlertRule(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		if names[rule.name] {
+			return nil, fmt.Errorf("alert %q defined more than once", rule.name)
+		}
+		names[rule.name] = true
+
+		a.rules = append(a.rules, rule)
+	}
+
+	if len(a.webhookURL) > 0 {
+		a.notifications = make(chan AlertNotification, alertQueueSize)
+		go a.send()
+	}
+
+	return &a, nil
+}
+
+func newAlertRule(cfg common.AlertRuleConfig) (*alertRule, error) {
+	if len(cfg.Name) == 0 {
+		return nil, fmt.Errorf("alert name can't be empty")
+	}
+
+	rule := alertRule{
+		name:             cfg.Name,
+		metric:           cfg.Metric,
+		durationField:    cfg.DurationField,
+		threshold:        cfg.Threshold,
+		resolveThreshold: cfg.Threshold,
+		window:           cfg.Window,
+		pendingFor:       cfg.For,
+		minRequests:      cfg.MinRequests,
+	}
+
+	var err error
+	if rule.frontend, err = regexp.Compile(cfg.FrontendRegexp); err != nil {
+		return nil, fmt.Errorf("alert %q: %s", cfg.Name, err)
+	}
+
+	switch {
+	case rule.metric == AlertErrorRatio:
+	case strings.HasPrefix(rule.metric, AlertLatencyPrefix):
+		percentile, err := strconv.ParseFloat(strings.TrimPrefix(rule.metric, AlertLatencyPrefix), 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, fmt.Errorf("alert %q: invalid latency percentile: %s", cfg.Name, rule.metric)
+		}
+		rule.quantile = percentile / 100
+	default:
+		return nil, fmt.Errorf("alert %q: unknown metric: %s", cfg.Name, cfg.Metric)
+	}
+
+	if len(rule.durationField) == 0 {
+		rule.durationField = "duration"
+	}
+
+	if cfg.ResolveThreshold != nil {
+		rule.resolveThreshold = *cfg.ResolveThreshold
+		if rule.resolveThreshold > rule.threshold {
+			return nil, fmt.Errorf("alert %q: resolve threshold can't be higher than threshold", cfg.Name)
+		}
+	}
+
+	if rule.window == 0 {
+		rule.window = DefaultAlertWindow
+	}
+
+	if rule.window < windowResolution || rule.pendingFor < 0 || rule.minRequests < 0 {
+		return nil, fmt.Errorf("alert %q: window has to be at least %s, pending time and minimum requests can't be negative", cfg.Name, windowResolution)
+	}
+
+	return &rule, nil
+}
+
+func (a *Alerts) Observe(o Observation) {
+	frontend := o.Frontend()
+
+	a.Lock()
+	defer a.Unlock()
+
+	for _, rule := range a.rules {
+		if !rule.frontend.MatchString(frontend) {
+			continue
+		}
+
+		key := alertKey{alert: rule.name, frontend: frontend}
+		state, has := a.states[key]
+		if !has {
+			state = &alertState{window: newStatsWindow(rule.window), state: AlertInactive}
+			a.states[key] = state
+		}
+
+		state.window.Bucket(o.Time).Add(o, rule.durationField)
+	}
+}
+
+// Flush evaluates alerts - it doesn't emit any points
+func (a *Alerts) Flush(now time.Time) []*client.Point {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, rule := range a.rules {
+		for key, state := range a.states {
+			if key.alert != rule.name {
+				continue
+			}
+
+			summary := state.window.Sum(now)
+			if summary.total == 0 && state.state == AlertInactive {
+				// frontend without traffic within the window
+				delete(a.states, key)
+				continue
+			}
+
+			if value, ok := rule.value(summary); ok {
+				state.lastData = now
+				a.evaluate(rule, key, state, value, now)
+			} else {
+				a.evaluateWithoutData(rule, key, state, now)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *Alerts) evaluate(rule *alertRule, key alertKey, state *alertState, value float64, now time.Time) {
+	switch state.state {
+	case AlertInactive, AlertPending:
+		if value <= rule.threshold {
+			state.state = AlertInactive
+			return
+		}
+
+		if state.state == AlertInactive {
+			state.state = AlertPending
+			state.since = now
+		}
+
+		if now.Sub(state.since) >= rule.pendingFor {
+			state.state = AlertFiring
+			state.since = now
+			a.notify(rule, key, state, AlertFiring, value, now)
+		}
+	case AlertFiring:
+		if value < rule.resolveThreshold {
+			state.state = AlertInactive
+			a.notify(rule, key, state, AlertResolved, value, now)
+			return
+		}
+
+		if a.repeatInterval > 0 && now.Sub(state.notified) >= a.repeatInterval {
+			a.notify(rule, key, state, AlertFiring, value, now)
+		}
+	}
+}
+
+// evaluateWithoutData handles alerts of frontends with too few requests - pending alerts start over and firing
+// ones are resolved once there's not enough data for a whole window
+func (a *Alerts) evaluateWithoutData(rule *alertRule, key alertKey, state *alertState, now time.Time) {
+	switch state.state {
+	case AlertPending:
+		state.state = AlertInactive
+	case AlertFiring:
+		if now.Sub(state.lastData) >= rule.window {
+			state.state = AlertInactive
+			a.notify(rule, key, state, AlertResolved, 0, now)
+		}
+	}
+}
+
+func (a *Alerts) notify(rule *alertRule, key alertKey, state *alertState, status string, value float64, now time.Time) {
+	state.notified = now
+
+	notification := AlertNotification{
+		Alert:       key.alert,
+		Fingerprint: alertFingerprint(key),
+		Replica:     common.Replica,
+		Status:      status,
+		Frontend:    key.frontend,
+		Metric:      rule.metric,
+		Value:       value,
+		Threshold:   rule.threshold,
+		StartsAt:    state.since,
+	}
+
+	if status == AlertResolved {
+		notification.EndsAt = &now
+		notification.NoData = state.lastData.Before(now)
+	}
+
+	common.Log.WithFields(log.Fields{
+		"alert":         notification.Alert,
+		"status":        notification.Status,
+		"frontend_name": notification.Frontend,
+		"value":         notification.Value,
+	}).Warn("Alert state changed")
+
+	if a.notifications == nil {
+		return
+	}
+
+	select {
+	case a.notifications <- notification:
+	default:
+		a.dropped.Inc(1)
+	}
+}
+
+// alertFingerprint identifies the alert of the frontend, so receivers can deduplicate notifications of replicas
+func alertFingerprint(key alertKey) string {
+	return fmt.Sprintf("%016x", hashString(key.alert+"\x00"+key.frontend))
+}
+
+// send delivers notifications to the webhook one by one
+func (a *Alerts) send() {
+	for notification := range a.notifications {
+		err := a.post(notification)
+		if err == nil {
+			a.sent.Inc(1)
+			continue
+		}
+
+		a.failed.Inc(1)
+		if allowed, suppressed := a.limiter.Allow("webhook"); allowed {
+			common.Log.WithError(err).WithField("suppressed", suppressed).Error("Could not send alert notification")
+		}
+	}
+}
+
+func (a *Alerts) post(notification AlertNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.httpClient.Post(a.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
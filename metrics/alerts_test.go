@@ -0,0 +1,248 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type webhookReceiver struct {
+	sync.Mutex
+	server        *httptest.Server
+	notifications []AlertNotification
+}
+
+func newWebhookReceiver() *webhookReceiver {
+	r := &webhookReceiver{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		defer GinkgoRecover()
+
+		notification := AlertNotification{}
+		Expect(json.NewDecoder(req.Body).Decode(&notification)).To(Succeed())
+
+		r.Lock()
+		r.notifications = append(r.notifications, notification)
+		r.Unlock()
+	}))
+	return r
+}
+
+func (r *webhookReceiver) Received() []AlertNotification {
+	r.Lock()
+	defer r.Unlock()
+	return append([]AlertNotification{}, r.notifications...)
+}
+
+var _ = Describe("Alerts", func() {
+	start := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	resolveThreshold := 0.05
+
+	var (
+		receiver *webhookReceiver
+		config   common.AlertsConfig
+	)
+
+	BeforeEach(func() {
+		receiver = newWebhookReceiver()
+		config = common.AlertsConfig{
+			WebhookURL: receiver.server.URL,
+			Rules: []common.AlertRuleConfig{{
+				Name:             "errors",
+				FrontendRegexp:   "^api",
+				Metric:           AlertErrorRatio,
+				Threshold:        0.1,
+				ResolveThreshold: &resolveThreshold,
+				Window:           5 * time.Minute,
+			}},
+		}
+	})
+
+	AfterEach(func() {
+		receiver.server.Close()
+	})
+
+	newAlerts := func() *Alerts {
+		alerts, err := NewAlerts(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(alerts).NotTo(BeNil())
+		return alerts
+	}
+
+	observe := func(alerts *Alerts, at time.Time, frontend string, status float64, durationMs float64, count int) {
+		for i := 0; i < count; i++ {
+			alerts.Observe(Observation{Rule: "all", Format: Combined, Time: at, Fields: map[string]interface{}{
+				"frontend_name": frontend,
+				"origin_status": status,
+				"duration":      durationMs,
+			}})
+		}
+	}
+
+	statuses := func() []string {
+		result := []string{}
+		for _, notification := range receiver.Received() {
+			result = append(result, notification.Status)
+		}
+		return result
+	}
+
+	It("should be disabled without rules", func() {
+		alerts, err := NewAlerts(common.AlertsConfig{WebhookURL: receiver.server.URL})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(alerts).To(BeNil())
+	})
+
+	It("should reject invalid rules", func() {
+		higher := 0.5
+		invalid := []func(*common.AlertRuleConfig){
+			func(r *common.AlertRuleConfig) { r.Name = "" },
+			func(r *common.AlertRuleConfig) { r.FrontendRegexp = "(" },
+			func(r *common.AlertRuleConfig) { r.Metric = "requests" },
+			func(r *common.AlertRuleConfig) { r.Metric = "latency_p101" },
+			func(r *common.AlertRuleConfig) { r.Metric = "latency_pxx" },
+			func(r *common.AlertRuleConfig) { r.ResolveThreshold = &higher },
+			func(r *common.AlertRuleConfig) { r.Window = time.Second },
+			func(r *common.AlertRuleConfig) { r.For = -time.Second },
+		}
+
+		for _, change := range invalid {
+			rule := config.Rules[0]
+			change(&rule)
+			_, err := NewAlerts(common.AlertsConfig{Rules: []common.AlertRuleConfig{rule}})
+			Expect(err).To(HaveOccurred())
+		}
+
+		_, err := NewAlerts(common.AlertsConfig{Rules: []common.AlertRuleConfig{config.Rules[0], config.Rules[0]}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should notify about firing and resolved alerts once", func() {
+		alerts := newAlerts()
+
+		observe(alerts, start, "api.wikia.com", 200, 10, 80)
+		observe(alerts, start, "api.wikia.com", 503, 10, 20)
+		observe(alerts, start, "www.wikia.com", 503, 10, 20)
+		alerts.Flush(start)
+		alerts.Flush(start.Add(time.Minute))
+
+		Eventually(receiver.Received).Should(HaveLen(1))
+		firing := receiver.Received()[0]
+		Expect(firing.Alert).To(Equal("errors"))
+		Expect(firing.Status).To(Equal(AlertFiring))
+		Expect(firing.Frontend).To(Equal("api.wikia.com"))
+		Expect(firing.Metric).To(Equal(AlertErrorRatio))
+		Expect(firing.Value).To(Equal(0.2))
+		Expect(firing.Threshold).To(Equal(0.1))
+		Expect(firing.StartsAt.Equal(start)).To(BeTrue())
+		Expect(firing.EndsAt).To(BeNil())
+		Expect(firing.Replica).To(Equal(common.Replica))
+		Expect(firing.Fingerprint).To(HaveLen(16))
+
+		// error ratio of 8% is below the threshold, but not below the resolve one
+		observe(alerts, start.Add(6*time.Minute), "api.wikia.com", 200, 10, 92)
+		observe(alerts, start.Add(6*time.Minute), "api.wikia.com", 503, 10, 8)
+		alerts.Flush(start.Add(6 * time.Minute))
+
+		observe(alerts, start.Add(12*time.Minute), "api.wikia.com", 200, 10, 100)
+		alerts.Flush(start.Add(12 * time.Minute))
+
+		Eventually(statuses).Should(Equal([]string{AlertFiring, AlertResolved}))
+		resolved := receiver.Received()[1]
+		Expect(resolved.Value).To(Equal(0.0))
+		Expect(resolved.Fingerprint).To(Equal(firing.Fingerprint))
+		Expect(resolved.EndsAt.Equal(start.Add(12 * time.Minute))).To(BeTrue())
+		Consistently(statuses, "100ms").Should(HaveLen(2))
+	})
+
+	It("should fire only after the alert is pending long enough", func() {
+		config.Rules[0].For = 2 * time.Minute
+		alerts := newAlerts()
+
+		observe(alerts, start, "api.wikia.com", 503, 10, 10)
+		alerts.Flush(start)
+		alerts.Flush(start.Add(time.Minute))
+
+		// resets pending state
+		observe(alerts, start.Add(6*time.Minute), "api.wikia.com", 200, 10, 100)
+		alerts.Flush(start.Add(6 * time.Minute))
+
+		observe(alerts, start.Add(12*time.Minute), "api.wikia.com", 503, 10, 10)
+		alerts.Flush(start.Add(12 * time.Minute))
+		Consistently(receiver.Received, "100ms").Should(BeEmpty())
+
+		alerts.Flush(start.Add(14 * time.Minute))
+		Eventually(statuses).Should(Equal([]string{AlertFiring}))
+		Expect(receiver.Received()[0].StartsAt.Equal(start.Add(14 * time.Minute))).To(BeTrue())
+	})
+
+	It("should resolve firing alerts after a window without enough requests", func() {
+		config.Rules[0].MinRequests = 10
+		alerts := newAlerts()
+
+		observe(alerts, start, "api.wikia.com", 503, 10, 20)
+		alerts.Flush(start)
+		for minute := 1; minute <= 9; minute++ {
+			observe(alerts, start.Add(time.Duration(minute)*time.Minute), "api.wikia.com", 503, 10, 1)
+			alerts.Flush(start.Add(time.Duration(minute) * time.Minute))
+		}
+
+		Eventually(statuses).Should(Equal([]string{AlertFiring, AlertResolved}))
+		resolved := receiver.Received()[1]
+		Expect(resolved.NoData).To(BeTrue())
+		Expect(resolved.EndsAt.Equal(start.Add(9 * time.Minute))).To(BeTrue())
+		Expect(receiver.Received()[0].NoData).To(BeFalse())
+	})
+
+	It("should start pending over when requests stop", func() {
+		config.Rules[0].For = 2 * time.Minute
+		config.Rules[0].MinRequests = 10
+		alerts := newAlerts()
+
+		observe(alerts, start, "api.wikia.com", 503, 10, 20)
+		alerts.Flush(start)
+		alerts.Flush(start.Add(6 * time.Minute))
+
+		observe(alerts, start.Add(30*time.Minute), "api.wikia.com", 503, 10, 20)
+		alerts.Flush(start.Add(30 * time.Minute))
+		Consistently(receiver.Received, "100ms").Should(BeEmpty())
+
+		alerts.Flush(start.Add(32 * time.Minute))
+		Eventually(statuses).Should(Equal([]string{AlertFiring}))
+		Expect(receiver.Received()[0].StartsAt.Equal(start.Add(32 * time.Minute))).To(BeTrue())
+	})
+
+	It("should repeat notifications of firing alerts", func() {
+		config.RepeatInterval = 2 * time.Minute
+		alerts := newAlerts()
+
+		observe(alerts, start, "api.wikia.com", 503, 10, 10)
+		for minute := 0; minute < 5; minute++ {
+			alerts.Flush(start.Add(time.Duration(minute) * time.Minute))
+		}
+
+		Eventually(statuses).Should(Equal([]string{AlertFiring, AlertFiring, AlertFiring}))
+	})
+
+	It("should alert on latency percentiles of frontends with enough requests", func() {
+		config.Rules = []common.AlertRuleConfig{{Name: "slow", FrontendRegexp: ".*", Metric: "latency_p99", Threshold: 500, MinRequests: 100}}
+		alerts := newAlerts()
+
+		observe(alerts, start, "small.wikia.com", 200, 1000, 10)
+		observe(alerts, start, "api.wikia.com", 200, 10, 97)
+		observe(alerts, start, "api.wikia.com", 200, 1000, 3)
+		alerts.Flush(start)
+
+		Eventually(receiver.Received).Should(HaveLen(1))
+		notification := receiver.Received()[0]
+		Expect(notification.Frontend).To(Equal("api.wikia.com"))
+		Expect(notification.Value).To(BeNumerically("~", 1000, 50))
+	})
+})
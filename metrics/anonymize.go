@@ -0,0 +1,210 @@
+package metrics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+const (
+	AnonymizeNone     = "none"
+	AnonymizeTruncate = "truncate"
+	AnonymizeHMAC     = "hmac"
+	AnonymizeDrop     = "drop"
+
+	DefaultIPv4Prefix = 24
+	DefaultIPv6Prefix = 48
+
+	// invalidAddress replaces values which are not IP addresses when they can't be anonymized
+	invalidAddress = "-"
+)
+
+// DefaultIPFields lists fields holding client IP addresses
+var DefaultIPFields = []string{"client_host", "client_address", "request__x-forwarded-for"}
+
+type anonymizationKey struct {
+	id        string
+	secret    []byte
+	validFrom time.Time
+}
+
+// IPAnonymizer hides client IP addresses by truncating them to a network prefix, replacing them
+// with keyed pseudonyms or dropping them altogether
+type IPAnonymizer struct {
+	mode       string
+	fields     []string
+	ipv4Mask   net.IPMask
+	ipv6Mask   net.IPMask
+	keys       []anonymizationKey // sorted from the newest one
+	anonymized stats.Counter
+}
+
+func NewIPAnonymizer(config common.AnonymizationConfig) (*IPAnonymizer, error) {
+	a := IPAnonymizer{
+		mode:       config.Mode,
+		fields:     config.Fields,
+		anonymized: stats.GetOrRegisterCounter("anonymized_ips", stats.DefaultRegistry),
+	}
+
+	if len(a.fields) == 0 {
+		a.fields = DefaultIPFields
+	}
+
+	ipv4Prefix, ipv6Prefix := config.IPv4Prefix, config.IPv6Prefix
+	if ipv4Prefix == 0 {
+		ipv4Prefix = DefaultIPv4Prefix
+	}
+	if ipv6Prefix == 0 {
+		ipv6Prefix = DefaultIPv6Prefix
+	}
+	if ipv4Prefix < 0 || ipv4Prefix > 32 || ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid prefix length (IPv4: %d, IPv6: %d)", ipv4Prefix, ipv6Prefix)
+	}
+	a.ipv4Mask = net.CIDRMask(ipv4Prefix, 32)
+	a.ipv6Mask = net.CIDRMask(ipv6Prefix, 128)
+
+	switch a.mode {
+	case "":
+		a.mode = AnonymizeNone
+	case AnonymizeNone, AnonymizeTruncate, AnonymizeDrop:
+	case AnonymizeHMAC:
+		if len(config.Keys) == 0 {
+			return nil, fmt.Errorf("at least one key is required for hmac anonymization")
+		}
+	default:
+		return nil, fmt.Errorf("unknown anonymization mode: %s", config.Mode)
+	}
+
+	for _, keyConfig := range config.Keys {
+		key := anonymizationKey{id: keyConfig.Id, secret: []byte(keyConfig.Secret)}
+		if len(key.id) == 0 || len(key.secret) == 0 {
+			return nil, fmt.Errorf("anonymization key requires both id and secret")
+		}
+
+		if len(keyConfig.ValidFrom) > 0 {
+			validFrom, err := time.Parse(time.RFC3339, keyConfig.ValidFrom)
+			if err != nil {
+				return nil, fmt.Errorf("invalid start time of key %s: %s", key.id, err)
+			}
+			key.validFrom = validFrom
+		}
+
+		a.keys = append(a.keys, key)
+	}
+
+	sort.SliceStable(a.keys, func(i, j int) bool { return a.keys[i].validFrom.After(a.keys[j].validFrom) })
+
+	return &a, nil
+}
+
+// Originals returns values of the fields which are going to be anonymized (nil when nothing is anonymized)
+func (a *IPAnonymizer) Originals(parsedLog map[string]interface{}) map[string]interface{} {
+	if a.mode == AnonymizeNone {
+		return nil
+	}
+
+	originals := map[string]interface{}{}
+	for _, field := range a.fields {
+		if value, has := parsedLog[field]; has {
+			originals[field] = value
+		}
+	}
+
+	return originals
+}
+
+// Anonymize replaces IP addresses in the configured fields of the parsed log; ts selects the key used
+// for pseudonymization so the keys can be rotated without gaps
+func (a *IPAnonymizer) Anonymize(parsedLog map[string]interface{}, ts time.Time) {
+	if a.mode == AnonymizeNone {
+		return
+	}
+
+	for _, field := range a.fields {
+		value, has := parsedLog[field]
+		if !has {
+			continue
+		}
+
+		if a.mode == AnonymizeDrop {
+			delete(parsedLog, field)
+			a.anonymized.Inc(1)
+			continue
+		}
+
+		text, ok := value.(string)
+		if !ok {
+			delete(parsedLog, field)
+			continue
+		}
+
+		// X-Forwarded-For can hold a chain of addresses
+		hops := strings.Split(text, ",")
+		for idx, hop := range hops {
+			hops[idx] = a.anonymizeAddress(strings.TrimSpace(hop), ts)
+		}
+		a.anonymized.Inc(int64(len(hops)))
+
+		parsedLog[field] = strings.Join(hops, ", ")
+	}
+}
+
+// anonymizeAddress handles a single address with optional port (i.e. 10.0.0.1:8080 or [::1]:8080)
+func (a *IPAnonymizer) anonymizeAddress(address string, ts time.Time) string {
+	if len(address) == 0 {
+		return address
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = strings.Trim(address, "[]"), ""
+	}
+
+	ip := net.ParseIP(host)
+	var anonymized string
+
+	switch {
+	case a.mode == AnonymizeHMAC:
+		anonymized = a.pseudonym(host, ts)
+	case ip == nil:
+		return invalidAddress
+	case ip.To4() != nil:
+		anonymized = ip.Mask(a.ipv4Mask).String()
+	default:
+		anonymized = ip.Mask(a.ipv6Mask).String()
+	}
+
+	if len(port) > 0 {
+		return net.JoinHostPort(anonymized, port)
+	}
+
+	return anonymized
+}
+
+func (a *IPAnonymizer) pseudonym(value string, ts time.Time) string {
+	key := a.keys[len(a.keys)-1]
+	for _, candidate := range a.keys {
+		if !candidate.validFrom.After(ts) {
+			key = candidate
+			break
+		}
+	}
+
+	if ip := net.ParseIP(value); ip != nil {
+		// the same address can be written in many ways (especially IPv6)
+		value = ip.String()
+	}
+
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte(value))
+
+	return key.id + "-" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
@@ -0,0 +1,86 @@
+package metrics_test
+
+import (
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IPAnonymizer", func() {
+	var parsedLog map[string]interface{}
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		parsedLog = map[string]interface{}{
+			"client_host":              "10.1.2.3",
+			"client_address":           "[2001:db8:abcd:12::1]:51234",
+			"request__x-forwarded-for": "203.0.113.195, 2001:db8:85a3::8a2e:370:7334,unknown",
+			"request_path":             "/foo",
+		}
+	})
+
+	anonymize := func(config common.AnonymizationConfig, ts time.Time) {
+		anonymizer, err := NewIPAnonymizer(config)
+		Expect(err).NotTo(HaveOccurred())
+		anonymizer.Anonymize(parsedLog, ts)
+	}
+
+	It("should leave addresses intact by default", func() {
+		anonymize(common.AnonymizationConfig{}, now)
+		Expect(parsedLog).To(HaveKeyWithValue("client_host", "10.1.2.3"))
+	})
+
+	It("should truncate addresses to configured prefixes", func() {
+		anonymize(common.AnonymizationConfig{Mode: AnonymizeTruncate, IPv4Prefix: 16}, now)
+
+		Expect(parsedLog).To(HaveKeyWithValue("client_host", "10.1.0.0"))
+		Expect(parsedLog).To(HaveKeyWithValue("client_address", "[2001:db8:abcd::]:51234"))
+		Expect(parsedLog).To(HaveKeyWithValue("request__x-forwarded-for", "203.0.0.0, 2001:db8:85a3::, -"))
+		Expect(parsedLog).To(HaveKeyWithValue("request_path", "/foo"))
+	})
+
+	It("should pseudonymize addresses with the key valid at the given time", func() {
+		config := common.AnonymizationConfig{
+			Mode: AnonymizeHMAC,
+			Keys: []common.AnonymizationKeyConfig{
+				{Id: "k1", Secret: "first"},
+				{Id: "k2", Secret: "second", ValidFrom: "2017-10-01T00:00:00Z"},
+			},
+		}
+
+		anonymize(config, now.Add(-24*time.Hour))
+		Expect(parsedLog["client_host"]).To(MatchRegexp(`^k1-[0-9a-f]{16}$`))
+		old := parsedLog["client_host"]
+
+		parsedLog["client_host"] = "10.1.2.3"
+		parsedLog["request__x-forwarded-for"] = "10.1.2.3"
+		anonymize(config, now)
+		Expect(parsedLog["client_host"]).To(MatchRegexp(`^k2-[0-9a-f]{16}$`))
+		Expect(parsedLog["client_host"]).NotTo(Equal(old))
+		Expect(parsedLog["request__x-forwarded-for"]).To(Equal(parsedLog["client_host"]))
+		Expect(parsedLog["client_address"]).To(MatchRegexp(`^k2-[0-9a-f]{16}:51234$`))
+	})
+
+	It("should drop addresses", func() {
+		anonymize(common.AnonymizationConfig{Mode: AnonymizeDrop, Fields: []string{"client_host"}}, now)
+
+		Expect(parsedLog).NotTo(HaveKey("client_host"))
+		Expect(parsedLog).To(HaveKey("client_address"))
+	})
+
+	It("should reject invalid config", func() {
+		for _, config := range []common.AnonymizationConfig{
+			{Mode: "scramble"},
+			{Mode: AnonymizeHMAC},
+			{Mode: AnonymizeTruncate, IPv4Prefix: 33},
+			{Mode: AnonymizeHMAC, Keys: []common.AnonymizationKeyConfig{{Id: "k1", Secret: "s", ValidFrom: "yesterday"}}},
+		} {
+			_, err := NewIPAnonymizer(config)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+})
@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// tolerating threshold is this many times the satisfied one when not configured
+const defaultApdexToleratingFactor = 4
+
+type apdexRule struct {
+	satisfied     float64 // in ms
+	tolerating    float64 // in ms
+	durationField string
+}
+
+type apdexKey struct {
+	rule     string
+	frontend string
+	backend  string
+}
+
+type apdexScore struct {
+	satisfied  int64
+	tolerating int64
+	frustrated int64
+}
+
+// Apdex classifies requests of every frontend and backend as satisfied, tolerating or frustrated (failed
+// requests are always frustrated) and reports Apdex score - (satisfied + tolerating / 2) / total - per interval
+type Apdex struct {
+	sync.Mutex
+	measurement string
+	rules       map[string]apdexRule
+	scores      map[apdexKey]*apdexScore
+}
+
+// NewApdex validates Apdex thresholds of the rules. It returns nil when none of the rules has them set.
+func NewApdex(rules []common.RulesConfig, config common.AggregationConfig) (*Apdex, error) {
+	a := Apdex{
+		measurement: config.Measurement,
+		rules:       map[string]apdexRule{},
+		scores:      map[apdexKey]*apdexScore{},
+	}
+
+	if len(a.measurement) == 0 {
+		a.measurement = DefaultAggregateMeasurement
+	}
+
+	for _, rule := range rules {
+		if rule.Apdex.Satisfied == 0 && rule.Apdex.Tolerating == 0 {
+			continue
+		}
+
+		if len(rule.Id) == 0 {
+			return nil, fmt.Errorf("rules with Apdex thresholds need an ID")
+		}
+
+		if _, has := a.rules[rule.Id]; has {
+			return nil, fmt.Errorf("rule %q: Apdex thresholds defined more than once", rule.Id)
+		}
+
+		satisfied, tolerating := rule.Apdex.Satisfied, rule.Apdex.Tolerating
+		if tolerating == 0 {
+			tolerating = defaultApdexToleratingFactor * satisfied
+		}
+
+		if satisfied <= 0 || tolerating < satisfied {
+			return nil, fmt.Errorf("rule %q: Apdex thresholds have to be positive and satisfied one can't be higher than tolerating one", rule.Id)
+		}
+
+		field := rule.Apdex.DurationField
+		if len(field) == 0 {
+			field = "duration"
+		}
+
+		a.rules[rule.Id] = apdexRule{
+			satisfied:     float64(satisfied) / float64(time.Millisecond),
+			tolerating:    float64(tolerating) / float64(time.Millisecond),
+			durationField: field,
+		}
+	}
+
+	if len(a.rules) == 0 {
+		return nil, nil
+	}
+
+	return &a, nil
+}
+
+func (a *Apdex) Observe(o Observation) {
+	rule, has := a.rules[o.Rule]
+	if !has {
+		return
+	}
+
+	duration, has := o.Duration(rule.durationField)
+	if !has {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	key := apdexKey{rule: o.Rule, frontend: o.Frontend(), backend: o.Backend()}
+	score, has := a.scores[key]
+	if !has {
+		score = &apdexScore{}
+		a.scores[key] = score
+	}
+
+	switch {
+	case o.IsError() || duration > rule.tolerating:
+		score.frustrated++
+	case duration > rule.satisfied:
+		score.tolerating++
+	default:
+		score.satisfied++
+	}
+}
+
+func (a *Apdex) Flush(now time.Time) []*client.Point {
+	a.Lock()
+	scores := a.scores
+	a.scores = map[apdexKey]*apdexScore{}
+	a.Unlock()
+
+	points := []*client.Point{}
+	for key, score := range scores {
+		total := score.satisfied + score.tolerating + score.frustrated
+
+		tags := map[string]string{"rule_id": key.rule, "frontend_name": key.frontend, "backend_name": key.backend}
+		fields := map[string]interface{}{
+			"apdex":            (float64(score.satisfied) + float64(score.tolerating)/2) / float64(total),
+			"apdex_satisfied":  score.satisfied,
+			"apdex_tolerating": score.tolerating,
+			"apdex_frustrated": score.frustrated,
+		}
+
+		pt, err := client.NewPoint(a.measurement, tags, fields, now)
+		if err != nil {
+			common.Log.WithError(err).WithField("tags", tags).Error("Could not create Apdex point")
+			continue
+		}
+		points = append(points, pt)
+	}
+
+	return points
+}
@@ -0,0 +1,98 @@
+package metrics_test
+
+import (
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Apdex", func() {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	newApdex := func(config common.ApdexConfig) *Apdex {
+		apdex, err := NewApdex([]common.RulesConfig{{Id: "all", Apdex: config}}, common.AggregationConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(apdex).NotTo(BeNil())
+		return apdex
+	}
+
+	observe := func(apdex *Apdex, backend string, status float64, durationNs, originDurationNs float64) {
+		apdex.Observe(Observation{Rule: "all", Format: JSON, Time: now, Fields: map[string]interface{}{
+			"frontend_name":   "foo",
+			"backend_name":    backend,
+			"origin_status":   status,
+			"duration":        durationNs,
+			"origin_duration": originDurationNs,
+		}})
+	}
+
+	flush := func(apdex *Apdex) map[string]map[string]interface{} {
+		result := map[string]map[string]interface{}{}
+		for _, pt := range apdex.Flush(now) {
+			Expect(pt.Name()).To(Equal(DefaultAggregateMeasurement))
+			Expect(pt.Tags()).To(HaveKeyWithValue("frontend_name", "foo"))
+			Expect(pt.Tags()).To(HaveKeyWithValue("rule_id", "all"))
+
+			fields, err := pt.Fields()
+			Expect(err).NotTo(HaveOccurred())
+			result[pt.Tags()["backend_name"]] = fields
+		}
+		return result
+	}
+
+	It("should be disabled without thresholds", func() {
+		apdex, err := NewApdex([]common.RulesConfig{{Id: "all"}}, common.AggregationConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(apdex).To(BeNil())
+	})
+
+	It("should reject invalid thresholds", func() {
+		for _, rules := range [][]common.RulesConfig{
+			{{Apdex: common.ApdexConfig{Satisfied: time.Second}}},
+			{{Id: "all", Apdex: common.ApdexConfig{Tolerating: time.Second}}},
+			{{Id: "all", Apdex: common.ApdexConfig{Satisfied: time.Second, Tolerating: time.Millisecond}}},
+			{{Id: "all", Apdex: common.ApdexConfig{Satisfied: -time.Second}}},
+			{{Id: "all", Apdex: common.ApdexConfig{Satisfied: time.Second}}, {Id: "all", Apdex: common.ApdexConfig{Satisfied: time.Second}}},
+		} {
+			_, err := NewApdex(rules, common.AggregationConfig{})
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("should score requests per backend", func() {
+		apdex := newApdex(common.ApdexConfig{Satisfied: 100 * time.Millisecond})
+
+		observe(apdex, "a", 200, 50e6, 0)
+		observe(apdex, "a", 200, 100e6, 0)
+		observe(apdex, "a", 200, 250e6, 0)
+		observe(apdex, "a", 200, 401e6, 0)
+		observe(apdex, "a", 500, 10e6, 0)
+		observe(apdex, "b", 200, 10e6, 0)
+
+		scores := flush(apdex)
+		Expect(scores).To(HaveLen(2))
+		Expect(scores["a"]).To(Equal(map[string]interface{}{
+			"apdex":            0.5,
+			"apdex_satisfied":  int64(2),
+			"apdex_tolerating": int64(1),
+			"apdex_frustrated": int64(2),
+		}))
+		Expect(scores["b"]).To(HaveKeyWithValue("apdex", 1.0))
+
+		Expect(apdex.Flush(now)).To(BeEmpty())
+	})
+
+	It("should use the configured duration field and tolerating threshold", func() {
+		apdex := newApdex(common.ApdexConfig{Satisfied: 100 * time.Millisecond, Tolerating: 200 * time.Millisecond, DurationField: "origin_duration"})
+
+		observe(apdex, "a", 200, 1e9, 50e6)
+		observe(apdex, "a", 200, 1e9, 150e6)
+		observe(apdex, "a", 200, 1e9, 250e6)
+
+		Expect(flush(apdex)["a"]).To(HaveKeyWithValue("apdex", 0.5))
+	})
+})
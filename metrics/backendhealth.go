@@ -0,0 +1,259 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+const (
+	DefaultBackendHealthMeasurement = "k8s_traefik_backend_health"
+	DefaultBackendInstanceField     = "backend_url"
+	DefaultBackendMinRequests       = 20
+	DefaultBackendMinInstances      = 3
+	DefaultBackendErrorRatioMargin  = 0.05
+	DefaultBackendLatencyFactor     = 2.0
+
+	// latency percentile instances are compared with
+	backendLatencyQuantile = 0.95
+)
+
+// Reasons of instances being suspected
+const (
+	SuspectedErrors  = "errors"
+	SuspectedLatency = "latency"
+)
+
+// InstanceHealth describes a backend instance behaving worse than its siblings
+type InstanceHealth struct {
+	Backend           string    `json:"backend_name"`
+	Instance          string    `json:"instance"`
+	Reasons           []string  `json:"reasons"`
+	Requests          int64     `json:"requests"`
+	ErrorRatio        float64   `json:"error_ratio"`
+	LatencyP95        float64   `json:"latency_p95_ms"`
+	RetriesPerRequest float64   `json:"retries_per_request"`
+	BackendErrorRatio float64   `json:"backend_error_ratio"`
+	BackendLatencyP95 float64   `json:"backend_latency_p95_ms"`
+	Time              time.Time `json:"time"`
+}
+
+type instanceKey struct {
+	backend  string
+	instance string
+}
+
+// BackendHealth finds sick instances (PODs) of backends - every interval error ratio and latency of each instance
+// is compared with the median of all the instances of its backend
+type BackendHealth struct {
+	sync.Mutex
+	measurement      string
+	instanceField    string
+	durationField    string
+	minRequests      int64
+	minInstances     int
+	errorRatioMargin float64
+	latencyFactor    float64
+	stats            map[instanceKey]*requestStats
+	suspected        []InstanceHealth
+}
+
+// NewBackendHealth validates the config and registers `backends` stats endpoint listing suspected instances.
+// It returns nil when health inference is disabled.
+func NewBackendHealth(config common.BackendHealthConfig) (*BackendHealth, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	h := BackendHealth{
+		measurement:      config.Measurement,
+		instanceField:    config.InstanceField,
+		durationField:    config.DurationField,
+		minRequests:      config.MinRequests,
+		minInstances:     config.MinInstances,
+		errorRatioMargin: config.ErrorRatioMargin,
+		latencyFactor:    config.LatencyFactor,
+		stats:            map[instanceKey]*requestStats{},
+		suspected:        []InstanceHealth{},
+	}
+
+	if len(h.measurement) == 0 {
+		h.measurement = DefaultBackendHealthMeasurement
+	}
+
+	if len(h.instanceField) == 0 {
+		h.instanceField = DefaultBackendInstanceField
+	}
+
+	if len(h.durationField) == 0 {
+		h.durationField = "duration"
+	}
+
+	if h.minRequests == 0 {
+		h.minRequests = DefaultBackendMinRequests
+	}
+
+	if h.minInstances == 0 {
+		h.minInstances = DefaultBackendMinInstances
+	}
+
+	if h.errorRatioMargin == 0 {
+		h.errorRatioMargin = DefaultBackendErrorRatioMargin
+	}
+
+	if h.latencyFactor == 0 {
+		h.latencyFactor = DefaultBackendLatencyFactor
+	}
+
+	if h.minRequests < 0 || h.minInstances < 2 || h.errorRatioMargin < 0 || h.latencyFactor < 1 {
+		return nil, fmt.Errorf("backend health needs positive minimum of requests, at least 2 instances, " +
+			"non-negative error ratio margin and latency factor of at least 1")
+	}
+
+	common.RegisterStatsProvider("backends", func() interface{} { return h.Suspected() })
+
+	return &h, nil
+}
+
+func (h *BackendHealth) Observe(o Observation) {
+	instance, has := o.Value(h.instanceField)
+	if !has {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	key := instanceKey{backend: o.Backend(), instance: instance}
+	stats, has := h.stats[key]
+	if !has {
+		stats = &requestStats{}
+		h.stats[key] = stats
+	}
+
+	stats.Add(o, h.durationField)
+}
+
+// Suspected returns instances found to be worse than their siblings in the last interval
+func (h *BackendHealth) Suspected() []InstanceHealth {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.suspected
+}
+
+func (h *BackendHealth) Flush(now time.Time) []*client.Point {
+	h.Lock()
+	instances := h.stats
+	h.stats = map[instanceKey]*requestStats{}
+	h.Unlock()
+
+	backends := map[string][]instanceKey{}
+	for key, stats := range instances {
+		if stats.total >= h.minRequests {
+			backends[key.backend] = append(backends[key.backend], key)
+		}
+	}
+
+	suspected := []InstanceHealth{}
+	for backend, keys := range backends {
+		if len(keys) < h.minInstances {
+			continue
+		}
+
+		errorRatios := make([]float64, 0, len(keys))
+		latencies := make([]float64, 0, len(keys))
+		for _, key := range keys {
+			errorRatios = append(errorRatios, instances[key].ErrorRatio())
+			if instances[key].timed > 0 {
+				latencies = append(latencies, instances[key].latency.Quantile(backendLatencyQuantile))
+			}
+		}
+		backendErrorRatio, backendLatency := median(errorRatios), median(latencies)
+
+		for _, key := range keys {
+			stats := instances[key]
+			health := InstanceHealth{
+				Backend:           backend,
+				Instance:          key.instance,
+				Requests:          stats.total,
+				ErrorRatio:        stats.ErrorRatio(),
+				RetriesPerRequest: float64(stats.retries) / float64(stats.total),
+				BackendErrorRatio: backendErrorRatio,
+				BackendLatencyP95: backendLatency,
+				Time:              now,
+			}
+
+			if health.ErrorRatio > backendErrorRatio+h.errorRatioMargin {
+				health.Reasons = append(health.Reasons, SuspectedErrors)
+			}
+
+			if stats.timed > 0 {
+				health.LatencyP95 = stats.latency.Quantile(backendLatencyQuantile)
+				if health.LatencyP95 > backendLatency*h.latencyFactor {
+					health.Reasons = append(health.Reasons, SuspectedLatency)
+				}
+			}
+
+			if len(health.Reasons) > 0 {
+				suspected = append(suspected, health)
+			}
+		}
+	}
+
+	sort.Slice(suspected, func(i, j int) bool {
+		if suspected[i].Backend != suspected[j].Backend {
+			return suspected[i].Backend < suspected[j].Backend
+		}
+		return suspected[i].Instance < suspected[j].Instance
+	})
+
+	h.Lock()
+	h.suspected = suspected
+	h.Unlock()
+
+	points := []*client.Point{}
+	for _, health := range suspected {
+		tags := map[string]string{"backend_name": health.Backend, "instance": health.Instance}
+		fields := map[string]interface{}{
+			"reasons":                strings.Join(health.Reasons, ","),
+			"requests":               health.Requests,
+			"error_ratio":            health.ErrorRatio,
+			"latency_p95_ms":         health.LatencyP95,
+			"retries_per_request":    health.RetriesPerRequest,
+			"backend_error_ratio":    health.BackendErrorRatio,
+			"backend_latency_p95_ms": health.BackendLatencyP95,
+		}
+
+		pt, err := client.NewPoint(h.measurement, tags, fields, now)
+		if err != nil {
+			common.Log.WithError(err).WithField("tags", tags).Error("Could not create backend health point")
+			continue
+		}
+		points = append(points, pt)
+	}
+
+	return points
+}
+
+// median returns the middle value (mean of two middle ones for even number of values)
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+
+	return sorted[middle]
+}
@@ -0,0 +1,139 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BackendHealth", func() {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	newHealth := func(config common.BackendHealthConfig) *BackendHealth {
+		config.Enabled = true
+		health, err := NewBackendHealth(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(health).NotTo(BeNil())
+		return health
+	}
+
+	observe := func(health *BackendHealth, backend string, instance int, status, durationMs float64, retries, count int) {
+		for i := 0; i < count; i++ {
+			health.Observe(Observation{Rule: "all", Format: Combined, Time: now, Fields: map[string]interface{}{
+				"frontend_name":  "foo",
+				"backend_name":   backend,
+				"backend_url":    fmt.Sprintf("http://10.0.0.%d:8080", instance),
+				"origin_status":  status,
+				"duration":       durationMs,
+				"retry_attempts": float64(retries),
+			}})
+		}
+	}
+
+	// three healthy instances of backend a
+	healthy := func(health *BackendHealth) {
+		for instance := 1; instance <= 3; instance++ {
+			observe(health, "a", instance, 200, 100, 0, 98)
+			observe(health, "a", instance, 500, 100, 0, 2)
+		}
+	}
+
+	It("should be disabled by default", func() {
+		health, err := NewBackendHealth(common.BackendHealthConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(health).To(BeNil())
+	})
+
+	It("should reject invalid config", func() {
+		for _, config := range []common.BackendHealthConfig{
+			{Enabled: true, MinInstances: 1},
+			{Enabled: true, MinRequests: -1},
+			{Enabled: true, ErrorRatioMargin: -0.1},
+			{Enabled: true, LatencyFactor: 0.5},
+		} {
+			_, err := NewBackendHealth(config)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("should find instances with errors", func() {
+		health := newHealth(common.BackendHealthConfig{})
+		healthy(health)
+		observe(health, "a", 4, 200, 100, 1, 80)
+		observe(health, "a", 4, 502, 100, 1, 20)
+
+		points := health.Flush(now)
+		Expect(points).To(HaveLen(1))
+		Expect(points[0].Name()).To(Equal(DefaultBackendHealthMeasurement))
+		Expect(points[0].Tags()).To(Equal(map[string]string{"backend_name": "a", "instance": "http://10.0.0.4:8080"}))
+
+		fields, err := points[0].Fields()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fields).To(HaveKeyWithValue("reasons", SuspectedErrors))
+		Expect(fields).To(HaveKeyWithValue("requests", int64(100)))
+		Expect(fields).To(HaveKeyWithValue("error_ratio", 0.2))
+		Expect(fields).To(HaveKeyWithValue("backend_error_ratio", 0.02))
+		Expect(fields).To(HaveKeyWithValue("retries_per_request", 1.0))
+	})
+
+	It("should find slow instances", func() {
+		health := newHealth(common.BackendHealthConfig{LatencyFactor: 3})
+		healthy(health)
+		observe(health, "a", 4, 200, 250, 0, 100)
+		observe(health, "a", 5, 200, 400, 0, 100)
+
+		suspected := health.Flush(now)
+		Expect(suspected).To(HaveLen(1))
+		Expect(suspected[0].Tags()).To(HaveKeyWithValue("instance", "http://10.0.0.5:8080"))
+
+		fields, err := suspected[0].Fields()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fields).To(HaveKeyWithValue("reasons", SuspectedLatency))
+		Expect(fields["latency_p95_ms"]).To(BeNumerically("~", 400, 20))
+		Expect(fields["backend_latency_p95_ms"]).To(BeNumerically("~", 100, 5))
+	})
+
+	It("should not judge backends with too few instances or requests", func() {
+		health := newHealth(common.BackendHealthConfig{MinRequests: 50})
+		observe(health, "a", 1, 200, 100, 0, 100)
+		observe(health, "a", 2, 500, 100, 0, 100)
+		observe(health, "b", 1, 200, 100, 0, 100)
+		observe(health, "b", 2, 200, 100, 0, 100)
+		observe(health, "b", 3, 200, 100, 0, 100)
+		observe(health, "b", 4, 500, 100, 0, 10)
+
+		Expect(health.Flush(now)).To(BeEmpty())
+		Expect(health.Suspected()).To(BeEmpty())
+	})
+
+	It("should list suspected instances on the stats endpoint", func() {
+		health := newHealth(common.BackendHealthConfig{})
+		healthy(health)
+		observe(health, "a", 4, 500, 1000, 0, 100)
+		health.Flush(now)
+
+		Expect(health.Suspected()).To(HaveLen(1))
+		Expect(health.Suspected()[0].Reasons).To(Equal([]string{SuspectedErrors, SuspectedLatency}))
+
+		recorder := httptest.NewRecorder()
+		common.HandleStatsProviders(recorder, httptest.NewRequest("GET", "/stats/backends", nil))
+		Expect(recorder.Code).To(Equal(200))
+
+		listed := []InstanceHealth{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &listed)).To(Succeed())
+		Expect(listed).To(HaveLen(1))
+		Expect(listed[0].Instance).To(Equal("http://10.0.0.4:8080"))
+		Expect(listed[0].ErrorRatio).To(Equal(1.0))
+
+		// suspected instances are found again every interval
+		health.Flush(now.Add(time.Minute))
+		Expect(health.Suspected()).To(BeEmpty())
+	})
+})
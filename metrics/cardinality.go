@@ -0,0 +1,327 @@
+package metrics
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+// Actions taken for points over cardinality limits
+const (
+	CardinalityOther = "other"
+	CardinalityDrop  = "drop"
+
+	// OtherTagValue replaces tag values over the limits
+	OtherTagValue = "__other__"
+
+	// number of top contributors tracked for every measurement and tag key
+	maxContributors = 100
+	// number of top contributors reported on the stats endpoint
+	reportedContributors = 10
+)
+
+// Contributor is a value (or a tag=value pair) responsible for points over cardinality limits
+type Contributor struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// TagCardinality describes tag key of a measurement which hit its limit
+type TagCardinality struct {
+	Values          int           `json:"values"`
+	MaxValues       int           `json:"max_values"`
+	Rejected        int64         `json:"rejected"`
+	TopContributors []Contributor `json:"top_contributors"`
+}
+
+// MeasurementCardinality describes series of a measurement and its tag keys which hit their limits
+type MeasurementCardinality struct {
+	Series          int                       `json:"series"`
+	MaxSeries       int                       `json:"max_series,omitempty"`
+	Rejected        int64                     `json:"rejected"`
+	TopContributors []Contributor             `json:"top_contributors,omitempty"`
+	Tags            map[string]TagCardinality `json:"tags,omitempty"`
+}
+
+// topCounter keeps approximate counts of the most frequent values in bounded memory (space-saving algorithm)
+type topCounter map[string]int64
+
+func (c topCounter) Add(value string) {
+	if _, has := c[value]; !has && len(c) >= maxContributors {
+		minValue, minCount := "", int64(-1)
+		for v, count := range c {
+			if minCount < 0 || count < minCount {
+				minValue, minCount = v, count
+			}
+		}
+		delete(c, minValue)
+		c[value] = minCount
+	}
+
+	c[value]++
+}
+
+func (c topCounter) Top(n int) []Contributor {
+	result := make([]Contributor, 0, len(c))
+	for value, count := range c {
+		result = append(result, Contributor{Value: value, Count: count})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Value < result[j].Value
+	})
+
+	if len(result) > n {
+		result = result[:n]
+	}
+
+	return result
+}
+
+type tagValues struct {
+	values       map[uint64]struct{}
+	rejected     int64
+	contributors topCounter
+}
+
+type measurementSeries struct {
+	series       map[uint64]struct{}
+	tags         map[string]*tagValues
+	rejected     int64
+	contributors topCounter
+}
+
+// CardinalityGuard limits number of series per measurement and number of values per tag key, so a single
+// misbehaving frontend can't create thousands of series. Values over the limits are folded into
+// OtherTagValue or points having them are dropped.
+type CardinalityGuard struct {
+	sync.Mutex
+	maxSeries       int
+	maxValuesPerTag int
+	tagLimits       map[string]int
+	action          string
+	resetInterval   time.Duration
+	lastReset       time.Time
+	measurements    map[string]*measurementSeries
+	now             func() time.Time
+	folded          stats.Counter
+	dropped         stats.Counter
+}
+
+// NewCardinalityGuard validates the config and registers `cardinality` stats endpoint.
+// It returns nil when no limits are set.
+func NewCardinalityGuard(config common.CardinalityConfig) (*CardinalityGuard, error) {
+	if config.MaxSeries < 0 || config.MaxValuesPerTag < 0 || config.ResetInterval < 0 {
+		return nil, fmt.Errorf("cardinality limits can't be negative")
+	}
+
+	g := CardinalityGuard{
+		maxSeries:       config.MaxSeries,
+		maxValuesPerTag: config.MaxValuesPerTag,
+		tagLimits:       map[string]int{},
+		action:          config.Action,
+		resetInterval:   config.ResetInterval,
+		measurements:    map[string]*measurementSeries{},
+		now:             time.Now,
+		folded:          stats.GetOrRegisterCounter("cardinality_folded", stats.DefaultRegistry),
+		dropped:         stats.GetOrRegisterCounter("cardinality_dropped", stats.DefaultRegistry),
+	}
+
+	for _, limit := range config.TagLimits {
+		if len(limit.Tag) == 0 {
+			return nil, fmt.Errorf("tag of the cardinality limit can't be empty")
+		}
+		if limit.MaxValues < 0 {
+			return nil, fmt.Errorf("cardinality limit of tag %q can't be negative", limit.Tag)
+		}
+		g.tagLimits[limit.Tag] = limit.MaxValues
+	}
+
+	switch g.action {
+	case "":
+		g.action = CardinalityOther
+	case CardinalityOther, CardinalityDrop:
+	default:
+		return nil, fmt.Errorf("unknown cardinality action: %s", config.Action)
+	}
+
+	if g.maxSeries == 0 && g.maxValuesPerTag == 0 && len(g.tagLimits) == 0 {
+		return nil, nil
+	}
+
+	g.lastReset = g.now()
+	common.RegisterStatsProvider("cardinality", func() interface{} { return g.Stats() })
+
+	return &g, nil
+}
+
+// Check registers tags of a new point of the measurement. Values over the limits are replaced in tags with
+// OtherTagValue (other action); false is returned when the point should be dropped.
+func (g *CardinalityGuard) Check(measurement string, tags map[string]string) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	if now := g.now(); g.resetInterval > 0 && now.Sub(g.lastReset) >= g.resetInterval {
+		g.measurements = map[string]*measurementSeries{}
+		g.lastReset = now
+	}
+
+	m, has := g.measurements[measurement]
+	if !has {
+		m = &measurementSeries{series: map[uint64]struct{}{}, tags: map[string]*tagValues{}, contributors: topCounter{}}
+		g.measurements[measurement] = m
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// values not seen before - they are responsible for a new series and get registered only when
+	// the point is accepted
+	var fresh []string
+	var pending []func()
+	folded := false
+
+	for _, k := range keys {
+		limit := g.tagLimit(k)
+		if limit == 0 {
+			continue
+		}
+
+		t, has := m.tags[k]
+		if !has {
+			t = &tagValues{values: map[uint64]struct{}{}, contributors: topCounter{}}
+			m.tags[k] = t
+		}
+
+		value := hashString(tags[k])
+		if _, seen := t.values[value]; seen {
+			continue
+		}
+
+		if len(t.values) < limit {
+			pending = append(pending, func() { t.values[value] = struct{}{} })
+			fresh = append(fresh, k)
+			continue
+		}
+
+		if g.isLimited(k) {
+			t.rejected++
+			t.contributors.Add(tags[k])
+			if g.action == CardinalityDrop {
+				g.dropped.Inc(1)
+				return false
+			}
+			tags[k] = OtherTagValue
+			folded = true
+			continue
+		}
+
+		fresh = append(fresh, k)
+	}
+
+	if g.maxSeries > 0 {
+		series := hashString(common.SeriesKey(measurement, tags))
+		if _, seen := m.series[series]; !seen && len(m.series) >= g.maxSeries {
+			m.rejected++
+			for _, k := range fresh {
+				m.contributors.Add(k + "=" + tags[k])
+			}
+
+			if g.action == CardinalityOther && len(fresh) > 0 {
+				for _, k := range fresh {
+					tags[k] = OtherTagValue
+				}
+				pending = nil
+				folded = true
+				series = hashString(common.SeriesKey(measurement, tags))
+			}
+
+			if _, seen := m.series[series]; !seen {
+				g.dropped.Inc(1)
+				return false
+			}
+		}
+		m.series[series] = struct{}{}
+	}
+
+	for _, register := range pending {
+		register()
+	}
+
+	if folded {
+		g.folded.Inc(1)
+	}
+
+	return true
+}
+
+// Stats returns number of series of all the measurements and tag keys which hit their limits
+func (g *CardinalityGuard) Stats() map[string]MeasurementCardinality {
+	g.Lock()
+	defer g.Unlock()
+
+	result := map[string]MeasurementCardinality{}
+	for name, m := range g.measurements {
+		mc := MeasurementCardinality{
+			Series:          len(m.series),
+			MaxSeries:       g.maxSeries,
+			Rejected:        m.rejected,
+			TopContributors: m.contributors.Top(reportedContributors),
+			Tags:            map[string]TagCardinality{},
+		}
+
+		for k, t := range m.tags {
+			if t.rejected == 0 {
+				continue
+			}
+			mc.Tags[k] = TagCardinality{
+				Values:          len(t.values),
+				MaxValues:       g.tagLimit(k),
+				Rejected:        t.rejected,
+				TopContributors: t.contributors.Top(reportedContributors),
+			}
+		}
+
+		result[name] = mc
+	}
+
+	return result
+}
+
+// tagLimit returns number of values tracked for the tag key - values of keys without limits
+// are tracked (up to series limit) only to find contributors of new series
+func (g *CardinalityGuard) tagLimit(key string) int {
+	if g.isLimited(key) {
+		if limit, has := g.tagLimits[key]; has {
+			return limit
+		}
+		return g.maxValuesPerTag
+	}
+
+	return g.maxSeries
+}
+
+func (g *CardinalityGuard) isLimited(key string) bool {
+	if limit, has := g.tagLimits[key]; has {
+		return limit > 0
+	}
+
+	return g.maxValuesPerTag > 0
+}
+
+func hashString(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return h.Sum64()
+}
@@ -0,0 +1,129 @@
+package metrics_test
+
+import (
+	"fmt"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CardinalityGuard", func() {
+	newGuard := func(config common.CardinalityConfig) *CardinalityGuard {
+		guard, err := NewCardinalityGuard(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(guard).NotTo(BeNil())
+		return guard
+	}
+
+	check := func(guard *CardinalityGuard, frontend, cluster string) (map[string]string, bool) {
+		tags := map[string]string{"frontend_name": frontend, "cluster_name": cluster}
+		return tags, guard.Check("k8s_traefik", tags)
+	}
+
+	It("should be disabled without limits", func() {
+		guard, err := NewCardinalityGuard(common.CardinalityConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(guard).To(BeNil())
+	})
+
+	It("should reject invalid config", func() {
+		for _, config := range []common.CardinalityConfig{
+			{MaxSeries: -1},
+			{MaxSeries: 10, Action: "ignore"},
+			{TagLimits: []common.TagLimitConfig{{Tag: "", MaxValues: 10}}},
+			{TagLimits: []common.TagLimitConfig{{Tag: "frontend_name", MaxValues: -1}}},
+		} {
+			_, err := NewCardinalityGuard(config)
+			Expect(err).To(HaveOccurred(), fmt.Sprintf("%+v", config))
+		}
+	})
+
+	It("should fold tag values over the limit into other value", func() {
+		guard := newGuard(common.CardinalityConfig{TagLimits: []common.TagLimitConfig{{Tag: "frontend_name", MaxValues: 2}}})
+
+		for _, frontend := range []string{"a", "b", "a"} {
+			tags, ok := check(guard, frontend, "sjc")
+			Expect(ok).To(BeTrue())
+			Expect(tags["frontend_name"]).To(Equal(frontend))
+		}
+
+		tags, ok := check(guard, "pr-1", "sjc")
+		Expect(ok).To(BeTrue())
+		Expect(tags).To(Equal(map[string]string{"frontend_name": OtherTagValue, "cluster_name": "sjc"}))
+
+		check(guard, "pr-1", "sjc")
+		check(guard, "pr-2", "sjc")
+
+		tag := guard.Stats()["k8s_traefik"].Tags["frontend_name"]
+		Expect(tag.Values).To(Equal(2))
+		Expect(tag.MaxValues).To(Equal(2))
+		Expect(tag.Rejected).To(Equal(int64(3)))
+		Expect(tag.TopContributors).To(Equal([]Contributor{{Value: "pr-1", Count: 2}, {Value: "pr-2", Count: 1}}))
+	})
+
+	It("should drop points with tag values over the limit", func() {
+		guard := newGuard(common.CardinalityConfig{MaxValuesPerTag: 1, Action: CardinalityDrop})
+
+		_, ok := check(guard, "a", "sjc")
+		Expect(ok).To(BeTrue())
+
+		_, ok = check(guard, "b", "sjc")
+		Expect(ok).To(BeFalse())
+
+		_, ok = check(guard, "a", "res")
+		Expect(ok).To(BeFalse())
+
+		Expect(guard.Stats()["k8s_traefik"].Tags).To(HaveLen(2))
+	})
+
+	It("should drop new series over the limit", func() {
+		guard := newGuard(common.CardinalityConfig{MaxSeries: 2})
+
+		check(guard, "a", "sjc")
+		check(guard, "b", "sjc")
+
+		tags, ok := check(guard, "a", "sjc")
+		Expect(ok).To(BeTrue())
+		Expect(tags["frontend_name"]).To(Equal("a"))
+
+		// series with other value would be a new one as well
+		_, ok = check(guard, "pr-1", "sjc")
+		Expect(ok).To(BeFalse())
+
+		measurement := guard.Stats()["k8s_traefik"]
+		Expect(measurement.Series).To(Equal(2))
+		Expect(measurement.Rejected).To(Equal(int64(1)))
+		Expect(measurement.TopContributors).To(Equal([]Contributor{{Value: "frontend_name=pr-1", Count: 1}}))
+		Expect(measurement.Tags).To(BeEmpty())
+	})
+
+	It("should keep points folded into existing series", func() {
+		guard := newGuard(common.CardinalityConfig{MaxSeries: 2})
+
+		check(guard, "a", "sjc")
+		check(guard, OtherTagValue, "sjc")
+
+		tags, ok := check(guard, "pr-1", "sjc")
+		Expect(ok).To(BeTrue())
+		Expect(tags["frontend_name"]).To(Equal(OtherTagValue))
+
+		_, ok = check(guard, "pr-2", "res")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should not limit tags with explicit zero limit", func() {
+		guard := newGuard(common.CardinalityConfig{
+			MaxValuesPerTag: 1,
+			TagLimits:       []common.TagLimitConfig{{Tag: "frontend_name", MaxValues: 0}},
+		})
+
+		for _, frontend := range []string{"a", "b", "c"} {
+			tags, ok := check(guard, frontend, "sjc")
+			Expect(ok).To(BeTrue())
+			Expect(tags["frontend_name"]).To(Equal(frontend))
+		}
+	})
+})
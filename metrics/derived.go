@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"fmt"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/expression"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+// DerivedField is computed out of other fields of the parsed log and sent as a field or a tag
+type DerivedField struct {
+	Name       string
+	Expression *expression.Expression
+	Tag        bool
+}
+
+// DerivedFields are evaluated in order, so every one of them can use the ones defined before
+type DerivedFields struct {
+	fields []DerivedField
+	errors stats.Counter
+}
+
+// NewDerivedFields parses expressions of all the fields
+func NewDerivedFields(configs []common.DerivedFieldConfig) (*DerivedFields, error) {
+	d := DerivedFields{errors: stats.GetOrRegisterCounter("derived_field_errors", stats.DefaultRegistry)}
+	names := map[string]bool{}
+
+	for _, cfg := range configs {
+		if len(cfg.Name) == 0 {
+			return nil, fmt.Errorf("derived field without a name (expression: %q)", cfg.Expression)
+		}
+
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("derived field %q defined more than once", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		expr, err := expression.Parse(cfg.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression of derived field %q: %s", cfg.Name, err)
+		}
+
+		d.fields = append(d.fields, DerivedField{Name: cfg.Name, Expression: expr, Tag: cfg.Tag})
+	}
+
+	return &d, nil
+}
+
+// Fields returns definitions of all the derived fields
+func (d *DerivedFields) Fields() []DerivedField {
+	return d.fields
+}
+
+// Derive adds computed values to the parsed log; fields which can't be computed are removed, so values
+// coming with the log itself are never sent instead
+func (d *DerivedFields) Derive(parsedLog map[string]interface{}) {
+	for _, field := range d.fields {
+		value, err := field.Expression.Evaluate(parsedLog)
+		if err != nil {
+			d.errors.Inc(1)
+			common.Log.WithError(err).WithField("field", field.Name).Debug("Could not compute derived field")
+			delete(parsedLog, field.Name)
+			continue
+		}
+
+		if value == nil {
+			delete(parsedLog, field.Name)
+			continue
+		}
+
+		parsedLog[field.Name] = value
+	}
+}
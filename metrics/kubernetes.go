@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/model"
+)
+
+const DefaultLabelPrefix = "label_"
+
+// KubernetesTagger promotes Kubernetes metadata of the Traefik POD to tags
+type KubernetesTagger struct {
+	namespace bool
+	container bool
+	labels    map[string]string // label name -> tag name
+}
+
+func NewKubernetesTagger(config common.KubernetesTagsConfig) (*KubernetesTagger, error) {
+	kt := KubernetesTagger{
+		namespace: config.Namespace,
+		container: config.Container,
+		labels:    map[string]string{},
+	}
+
+	prefix := DefaultLabelPrefix
+	if config.LabelPrefix != nil {
+		prefix = *config.LabelPrefix
+	}
+
+	used := map[string]string{}
+	for _, label := range config.Labels {
+		tag := prefix + SanitizeTagKey(label)
+		if isAllowed(ReservedTags, tag) {
+			return nil, fmt.Errorf("label %q would overwrite reserved tag %q", label, tag)
+		}
+
+		if other, has := used[tag]; has {
+			return nil, fmt.Errorf("labels %q and %q map to the same tag %q", other, label, tag)
+		}
+
+		used[tag] = label
+		kt.labels[label] = tag
+	}
+
+	return &kt, nil
+}
+
+// AddTags sets tags based on Kubernetes metadata (empty values are skipped)
+func (kt *KubernetesTagger) AddTags(meta model.KubernetesMeta, tags map[string]string) {
+	if kt.namespace && len(meta.NamespaceName) > 0 {
+		tags["namespace"] = meta.NamespaceName
+	}
+
+	if kt.container && len(meta.ContainerName) > 0 {
+		tags["container_name"] = meta.ContainerName
+	}
+
+	for label, tag := range kt.labels {
+		if value := meta.Labels[label]; len(value) > 0 {
+			tags[tag] = value
+		}
+	}
+}
+
+// SanitizeTagKey turns Kubernetes label name (i.e. app.kubernetes.io/name) into a tag name
+// friendly for InfluxDB and its tooling (i.e. app_kubernetes_io_name)
+func SanitizeTagKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '_'
+		}
+	}, key)
+}
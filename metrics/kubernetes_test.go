@@ -0,0 +1,61 @@
+package metrics_test
+
+import (
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+	"github.com/Wikia/nsq-traefik-consumer/model"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KubernetesTagger", func() {
+	meta := model.KubernetesMeta{
+		NamespaceName: "prod",
+		ContainerName: "traefik",
+		Labels:        map[string]string{"app": "traefik", "app.kubernetes.io/Version": "1.4", "secret": "x"},
+	}
+
+	It("should promote namespace, container and allowed labels", func() {
+		tagger, err := NewKubernetesTagger(common.KubernetesTagsConfig{
+			Namespace: true,
+			Container: true,
+			Labels:    []string{"app", "app.kubernetes.io/Version", "team"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		tags := map[string]string{}
+		tagger.AddTags(meta, tags)
+
+		Expect(tags).To(Equal(map[string]string{
+			"namespace":                       "prod",
+			"container_name":                  "traefik",
+			"label_app":                       "traefik",
+			"label_app_kubernetes_io_version": "1.4",
+		}))
+	})
+
+	It("should use configured label prefix", func() {
+		prefix := ""
+		tagger, err := NewKubernetesTagger(common.KubernetesTagsConfig{Labels: []string{"app"}, LabelPrefix: &prefix})
+		Expect(err).NotTo(HaveOccurred())
+
+		tags := map[string]string{}
+		tagger.AddTags(meta, tags)
+		Expect(tags).To(Equal(map[string]string{"app": "traefik"}))
+	})
+
+	It("should reject labels clashing with other tags", func() {
+		prefix := ""
+		_, err := NewKubernetesTagger(common.KubernetesTagsConfig{Labels: []string{"rule_id"}, LabelPrefix: &prefix})
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewKubernetesTagger(common.KubernetesTagsConfig{Labels: []string{"team.name", "team/name"}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should sanitize label names", func() {
+		Expect(SanitizeTagKey("app.kubernetes.io/Name")).To(Equal("app_kubernetes_io_name"))
+		Expect(SanitizeTagKey("team-name")).To(Equal("team_name"))
+	})
+})
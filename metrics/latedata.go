@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+// Actions taken for points with timestamps out of the allowed range
+const (
+	LateDataDrop  = "drop"
+	LateDataClamp = "clamp"
+	LateDataRoute = "route"
+)
+
+// LateDataPolicy decides what happens with points too old (i.e. outside of the retention policy) or too far
+// in the future. It also keeps track of event time lag (time of processing minus timestamp of the point).
+type LateDataPolicy struct {
+	maxAge          time.Duration
+	maxFutureSkew   time.Duration
+	action          string
+	futureAction    string
+	retentionPolicy string
+	lag             stats.Histogram
+	late            stats.Counter
+	future          stats.Counter
+}
+
+// NewLateDataPolicy validates the config; without limits all the points are accepted
+func NewLateDataPolicy(config common.LateDataConfig) (*LateDataPolicy, error) {
+	p := LateDataPolicy{
+		maxAge:          config.MaxAge,
+		maxFutureSkew:   config.MaxFutureSkew,
+		action:          config.Action,
+		futureAction:    config.FutureAction,
+		retentionPolicy: config.RetentionPolicy,
+		lag:             stats.GetOrRegisterHistogram("event_lag_ms", stats.DefaultRegistry, stats.NewExpDecaySample(1028, 0.015)),
+		late:            stats.GetOrRegisterCounter("late_points", stats.DefaultRegistry),
+		future:          stats.GetOrRegisterCounter("future_points", stats.DefaultRegistry),
+	}
+
+	switch p.action {
+	case "":
+		p.action = LateDataDrop
+	case LateDataDrop, LateDataClamp:
+	case LateDataRoute:
+		if len(p.retentionPolicy) == 0 {
+			return nil, fmt.Errorf("retention policy is required for late data to be routed")
+		}
+	default:
+		return nil, fmt.Errorf("unknown late data action: %s", config.Action)
+	}
+
+	// routing is meant for late points only - points from the future (clock skew) are dropped or clamped
+	switch p.futureAction {
+	case "":
+		p.futureAction = p.action
+		if p.futureAction == LateDataRoute {
+			p.futureAction = LateDataDrop
+		}
+	case LateDataDrop, LateDataClamp:
+	default:
+		return nil, fmt.Errorf("unknown action for points from the future: %s", config.FutureAction)
+	}
+
+	if p.maxAge < 0 || p.maxFutureSkew < 0 {
+		return nil, fmt.Errorf("late data limits can't be negative")
+	}
+
+	return &p, nil
+}
+
+// RecordLag records event lag of the point. It should be used only for timestamps coming from the logs -
+// lag of points timestamped with the time of processing says nothing about delays.
+func (p *LateDataPolicy) RecordLag(timestamp, now time.Time) {
+	p.lag.Update(int64(now.Sub(timestamp) / time.Millisecond))
+}
+
+// Apply checks timestamp of the point. It returns timestamp the point should be written with, retention policy
+// it should be written to (empty for the default one) and false when the point should be dropped.
+func (p *LateDataPolicy) Apply(timestamp, now time.Time) (time.Time, string, bool) {
+	lag := now.Sub(timestamp)
+
+	action := p.action
+	switch {
+	case p.maxAge > 0 && lag > p.maxAge:
+		p.late.Inc(1)
+	case p.maxFutureSkew > 0 && -lag > p.maxFutureSkew:
+		p.future.Inc(1)
+		action = p.futureAction
+	default:
+		return timestamp, "", true
+	}
+
+	switch action {
+	case LateDataClamp:
+		return now, "", true
+	case LateDataRoute:
+		return timestamp, p.retentionPolicy, true
+	default:
+		return timestamp, "", false
+	}
+}
@@ -0,0 +1,87 @@
+package metrics_test
+
+import (
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LateDataPolicy", func() {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	config := common.LateDataConfig{MaxAge: time.Hour, MaxFutureSkew: time.Minute}
+
+	apply := func(config common.LateDataConfig, ts time.Time) (time.Time, string, bool) {
+		policy, err := NewLateDataPolicy(config)
+		Expect(err).NotTo(HaveOccurred())
+		return policy.Apply(ts, now)
+	}
+
+	It("should accept points within limits", func() {
+		for _, ts := range []time.Time{now, now.Add(-59 * time.Minute), now.Add(59 * time.Second)} {
+			accepted, rp, ok := apply(config, ts)
+			Expect(ok).To(BeTrue())
+			Expect(rp).To(BeEmpty())
+			Expect(accepted).To(Equal(ts))
+		}
+	})
+
+	It("should drop late and future points by default", func() {
+		_, _, ok := apply(config, now.Add(-2*time.Hour))
+		Expect(ok).To(BeFalse())
+
+		_, _, ok = apply(config, now.Add(2*time.Minute))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should clamp timestamps to now", func() {
+		config := config
+		config.Action = LateDataClamp
+
+		ts, rp, ok := apply(config, now.Add(-2*time.Hour))
+		Expect(ok).To(BeTrue())
+		Expect(rp).To(BeEmpty())
+		Expect(ts).To(Equal(now))
+	})
+
+	It("should route late points to a separate retention policy", func() {
+		config := config
+		config.Action = LateDataRoute
+		config.RetentionPolicy = "long_term"
+
+		ts, rp, ok := apply(config, now.Add(-2*time.Hour))
+		Expect(ok).To(BeTrue())
+		Expect(rp).To(Equal("long_term"))
+		Expect(ts).To(Equal(now.Add(-2 * time.Hour)))
+
+		// points from the future are not late
+		_, _, ok = apply(config, now.Add(2*time.Minute))
+		Expect(ok).To(BeFalse())
+
+		config.FutureAction = LateDataClamp
+		ts, rp, ok = apply(config, now.Add(2*time.Minute))
+		Expect(ok).To(BeTrue())
+		Expect(rp).To(BeEmpty())
+		Expect(ts).To(Equal(now))
+	})
+
+	It("should accept everything without limits", func() {
+		_, _, ok := apply(common.LateDataConfig{}, now.Add(-24*365*time.Hour))
+		Expect(ok).To(BeTrue())
+	})
+
+	It("should reject invalid config", func() {
+		for _, config := range []common.LateDataConfig{
+			{Action: "ignore"},
+			{Action: LateDataRoute},
+			{FutureAction: LateDataRoute},
+			{MaxAge: -time.Hour},
+		} {
+			_, err := NewLateDataPolicy(config)
+			Expect(err).To(HaveOccurred(), "%v", config)
+		}
+	})
+})
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+const (
+	RedactMask = "mask"
+	RedactHash = "hash"
+	RedactDrop = "drop"
+
+	DefaultRedactionMask = "[REDACTED]"
+)
+
+// HeaderPrefixes are prefixes of parsed log keys holding HTTP headers
+var HeaderPrefixes = []string{"request__", "origin__", "downstream__"}
+
+// DefaultSensitiveHeaders are redacted unless explicitly disabled
+var DefaultSensitiveHeaders = []string{
+	`^(proxy-)?authorization$`,
+	`^(set-)?cookie$`,
+	`^x-(api|auth|access|csrf|xsrf)-(key|token)$`,
+	`^x-amz-security-token$`,
+	`(secret|password|passwd|session)`,
+}
+
+// Redactor removes sensitive HTTP headers from parsed logs before they leave the consumer
+type Redactor struct {
+	enabled      bool
+	allowHeaders map[string]bool
+	deny         []*regexp.Regexp
+	mode         string
+	mask         string
+	hashKey      []byte
+	redacted     stats.Counter
+	dropped      stats.Counter
+}
+
+func NewRedactor(config common.RedactionConfig) (*Redactor, error) {
+	r := Redactor{
+		enabled:      config.Enabled == nil || *config.Enabled,
+		allowHeaders: map[string]bool{},
+		mode:         config.Mode,
+		mask:         config.Mask,
+		hashKey:      []byte(config.HashKey),
+		redacted:     stats.GetOrRegisterCounter("redacted_values", stats.DefaultRegistry),
+		dropped:      stats.GetOrRegisterCounter("headers_dropped", stats.DefaultRegistry),
+	}
+
+	switch r.mode {
+	case "":
+		r.mode = RedactMask
+	case RedactMask, RedactDrop:
+	case RedactHash:
+		if len(r.hashKey) == 0 {
+			return nil, fmt.Errorf("hash key is required for hash redaction")
+		}
+	default:
+		return nil, fmt.Errorf("unknown redaction mode: %s", config.Mode)
+	}
+
+	if len(r.mask) == 0 {
+		r.mask = DefaultRedactionMask
+	}
+
+	for _, header := range config.AllowHeaders {
+		r.allowHeaders[strings.ToLower(header)] = true
+	}
+
+	patterns := config.DenyPatterns
+	if !config.DisableDefaults {
+		patterns = append(append([]string{}, DefaultSensitiveHeaders...), patterns...)
+	}
+
+	for _, pattern := range patterns {
+		rxp, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.deny = append(r.deny, rxp)
+	}
+
+	return &r, nil
+}
+
+// Redact modifies parsed log in place and returns number of values redacted
+func (r *Redactor) Redact(parsedLog map[string]interface{}) int {
+	if !r.enabled {
+		return 0
+	}
+
+	redacted := 0
+	for key, value := range parsedLog {
+		header, isHeader := headerName(key)
+		if !isHeader {
+			continue
+		}
+
+		if len(r.allowHeaders) > 0 && !r.allowHeaders[header] {
+			delete(parsedLog, key)
+			r.dropped.Inc(1)
+			continue
+		}
+
+		if !r.isDenied(header) {
+			continue
+		}
+
+		redacted++
+		switch r.mode {
+		case RedactDrop:
+			delete(parsedLog, key)
+		case RedactHash:
+			parsedLog[key] = r.hash(fmt.Sprint(value))
+		default:
+			parsedLog[key] = r.mask
+		}
+	}
+
+	r.redacted.Inc(int64(redacted))
+
+	return redacted
+}
+
+func (r *Redactor) isDenied(header string) bool {
+	for _, rxp := range r.deny {
+		if rxp.MatchString(header) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(value))
+
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// headerName returns lower-case name of the HTTP header if the key holds one (i.e. request__user-agent)
+func headerName(key string) (string, bool) {
+	for _, prefix := range HeaderPrefixes {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return strings.ToLower(key[len(prefix):]), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,79 @@
+package metrics_test
+
+import (
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redactor", func() {
+	var parsedLog map[string]interface{}
+
+	BeforeEach(func() {
+		parsedLog = map[string]interface{}{
+			"request_path":           "/foo",
+			"request__authorization": "Bearer abc",
+			"request__cookie":        "session=xyz",
+			"request__user-agent":    "curl/7.54",
+			"request__x-api-key":     "key",
+			"origin__set-cookie":     "session=xyz",
+			"origin__content-type":   "text/html",
+		}
+	})
+
+	redact := func(config common.RedactionConfig) int {
+		redactor, err := NewRedactor(config)
+		Expect(err).NotTo(HaveOccurred())
+		return redactor.Redact(parsedLog)
+	}
+
+	It("should mask known sensitive headers by default", func() {
+		Expect(redact(common.RedactionConfig{})).To(Equal(4))
+
+		Expect(parsedLog).To(HaveKeyWithValue("request__authorization", DefaultRedactionMask))
+		Expect(parsedLog).To(HaveKeyWithValue("request__cookie", DefaultRedactionMask))
+		Expect(parsedLog).To(HaveKeyWithValue("request__x-api-key", DefaultRedactionMask))
+		Expect(parsedLog).To(HaveKeyWithValue("origin__set-cookie", DefaultRedactionMask))
+		Expect(parsedLog).To(HaveKeyWithValue("request__user-agent", "curl/7.54"))
+		Expect(parsedLog).To(HaveKeyWithValue("request_path", "/foo"))
+	})
+
+	It("should hash values consistently", func() {
+		redact(common.RedactionConfig{Mode: RedactHash, HashKey: "secret"})
+
+		Expect(parsedLog["request__cookie"]).To(HavePrefix("sha256:"))
+		Expect(parsedLog["request__cookie"]).To(Equal(parsedLog["origin__set-cookie"]))
+		Expect(parsedLog["request__cookie"]).NotTo(Equal(parsedLog["request__authorization"]))
+	})
+
+	It("should drop values and apply custom patterns", func() {
+		Expect(redact(common.RedactionConfig{Mode: RedactDrop, DisableDefaults: true, DenyPatterns: []string{"^user-agent$"}})).To(Equal(1))
+
+		Expect(parsedLog).NotTo(HaveKey("request__user-agent"))
+		Expect(parsedLog).To(HaveKey("request__authorization"))
+	})
+
+	It("should keep only allowed headers", func() {
+		redact(common.RedactionConfig{AllowHeaders: []string{"User-Agent", "Authorization"}})
+
+		Expect(parsedLog).To(HaveLen(3))
+		Expect(parsedLog).To(HaveKeyWithValue("request__authorization", DefaultRedactionMask))
+		Expect(parsedLog).To(HaveKey("request__user-agent"))
+	})
+
+	It("should do nothing when disabled", func() {
+		disabled := false
+		Expect(redact(common.RedactionConfig{Enabled: &disabled})).To(BeZero())
+		Expect(parsedLog).To(HaveKeyWithValue("request__cookie", "session=xyz"))
+	})
+
+	It("should reject invalid config", func() {
+		_, err := NewRedactor(common.RedactionConfig{Mode: "encrypt"})
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewRedactor(common.RedactionConfig{Mode: RedactHash})
+		Expect(err).To(HaveOccurred())
+	})
+})
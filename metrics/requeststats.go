@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// latencies are counted in bins growing by 10% (so quantiles are off by 5% at most)
+	latencyGrowth = 1.1
+	// the last bin holds latencies over 1.1^latencyBins ms (about 27 minutes)
+	latencyBins = 150
+
+	// width of buckets of statsWindow
+	windowResolution = time.Minute
+)
+
+var logLatencyGrowth = math.Log(latencyGrowth)
+
+// latencyHistogram counts latencies (in ms) in exponentially growing bins
+type latencyHistogram [latencyBins + 1]int64
+
+func (h *latencyHistogram) Add(ms float64) {
+	bin := 0
+	if ms > 1 {
+		bin = int(math.Ceil(math.Log(ms) / logLatencyGrowth))
+		if bin > latencyBins {
+			bin = latencyBins
+		}
+	}
+
+	h[bin]++
+}
+
+func (h *latencyHistogram) Merge(other *latencyHistogram) {
+	for i, count := range other {
+		h[i] += count
+	}
+}
+
+// Quantile returns approximate latency (in ms) below which q of the latencies fall
+func (h *latencyHistogram) Quantile(q float64) float64 {
+	total := int64(0)
+	for _, count := range h {
+		total += count
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(q * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	seen := int64(0)
+	bin := 0
+	for ; bin < latencyBins; bin++ {
+		seen += h[bin]
+		if seen >= rank {
+			break
+		}
+	}
+
+	if bin == 0 {
+		return 1
+	}
+
+	// geometric middle of the bin
+	return math.Pow(latencyGrowth, float64(bin)-0.5)
+}
+
+// requestStats summarises requests - their number, failures, retries and latency distribution
+type requestStats struct {
+	total   int64
+	errors  int64
+	retries int64
+	timed   int64
+	latency latencyHistogram
+}
+
+func (s *requestStats) Add(o Observation, durationField string) {
+	s.total++
+	if o.IsError() {
+		s.errors++
+	}
+
+	if retries, ok := toFloat(o.Fields["retry_attempts"]); ok {
+		s.retries += int64(retries)
+	}
+
+	if duration, ok := o.Duration(durationField); ok {
+		s.timed++
+		s.latency.Add(duration)
+	}
+}
+
+func (s *requestStats) Merge(other *requestStats) {
+	s.total += other.total
+	s.errors += other.errors
+	s.retries += other.retries
+	s.timed += other.timed
+	s.latency.Merge(&other.latency)
+}
+
+// ErrorRatio returns ratio of failed (5xx) requests
+func (s *requestStats) ErrorRatio() float64 {
+	if s.total == 0 {
+		return 0
+	}
+
+	return float64(s.errors) / float64(s.total)
+}
+
+type windowBucket struct {
+	slot  int64
+	stats *requestStats
+}
+
+// statsWindow keeps request stats of the recent window in one minute buckets
+type statsWindow struct {
+	buckets []windowBucket
+}
+
+func newStatsWindow(window time.Duration) *statsWindow {
+	size := int((window + windowResolution - 1) / windowResolution)
+	return &statsWindow{buckets: make([]windowBucket, size)}
+}
+
+// Bucket returns stats of requests from the same minute as the given time
+func (w *statsWindow) Bucket(at time.Time) *requestStats {
+	slot := at.UnixNano() / int64(windowResolution)
+	bucket := &w.buckets[slot%int64(len(w.buckets))]
+	if bucket.stats != nil && bucket.slot > slot {
+		// older than the whole window
+		return &requestStats{}
+	}
+
+	if bucket.stats == nil || bucket.slot != slot {
+		bucket.slot = slot
+		bucket.stats = &requestStats{}
+	}
+
+	return bucket.stats
+}
+
+// Sum returns stats of requests within the window ending at the given time
+func (w *statsWindow) Sum(now time.Time) *requestStats {
+	slot := now.UnixNano() / int64(windowResolution)
+	sum := &requestStats{}
+	for _, bucket := range w.buckets {
+		if bucket.stats != nil && bucket.slot <= slot && bucket.slot > slot-int64(len(w.buckets)) {
+			sum.Merge(bucket.stats)
+		}
+	}
+
+	return sum
+}
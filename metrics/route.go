@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+)
+
+const (
+	// RouteField holds request path turned into a route (i.e. /wiki/:title)
+	RouteField = "route"
+	// QueryParamPrefix is prepended to names of query parameters extracted as fields
+	QueryParamPrefix = "query_"
+
+	idPlaceholder   = ":id"
+	uuidPlaceholder = ":uuid"
+	hashPlaceholder = ":hash"
+)
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hashSegment    = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	// parts of segments separated by '.', '-' or '_' (i.e. of fingerprinted assets like app.3f2a9c1d4e5b6a7f.css)
+	segmentParts = regexp.MustCompile(`[^._-]+`)
+)
+
+// RouteTemplate is a path pattern (i.e. /api/v1/users/:id) - segments starting with ':' match
+// any single segment and '*' as the last segment matches the rest of the path
+type RouteTemplate struct {
+	template string
+	segments []string
+	wildcard bool
+}
+
+// ParseRouteTemplate validates and splits template into segments
+func ParseRouteTemplate(template string) (RouteTemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return RouteTemplate{}, fmt.Errorf("route template has to start with '/': %q", template)
+	}
+
+	t := RouteTemplate{template: template, segments: splitPath(template)}
+	for idx, segment := range t.segments {
+		switch {
+		case segment == "*" && idx == len(t.segments)-1:
+			t.wildcard = true
+			t.segments = t.segments[:idx]
+		case strings.Contains(segment, "*"):
+			return RouteTemplate{}, fmt.Errorf("wildcard can be used only as the last segment: %q", template)
+		case segment == ":":
+			return RouteTemplate{}, fmt.Errorf("parameter without a name: %q", template)
+		}
+	}
+
+	return t, nil
+}
+
+// Matches checks if path segments match the template
+func (t RouteTemplate) Matches(segments []string) bool {
+	if len(segments) < len(t.segments) || !t.wildcard && len(segments) != len(t.segments) {
+		return false
+	}
+
+	for idx, segment := range t.segments {
+		if !strings.HasPrefix(segment, ":") && segment != segments[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t RouteTemplate) String() string {
+	return t.template
+}
+
+// splitPath returns segments of the path ignoring leading and trailing slashes
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return []string{}
+	}
+
+	return strings.Split(path, "/")
+}
+
+type frontendRoutes struct {
+	frontend  *regexp.Regexp
+	templates []RouteTemplate
+}
+
+// RouteNormalizer turns request paths into routes with low cardinality which can be safely used as tags
+type RouteNormalizer struct {
+	frontends   []frontendRoutes
+	normalize   bool
+	queryParams map[string]string
+}
+
+// NewRouteNormalizer compiles route templates; it returns nil when routes are disabled
+func NewRouteNormalizer(config common.RoutesConfig) (*RouteNormalizer, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	n := RouteNormalizer{
+		normalize:   !config.DisableNormalization,
+		queryParams: map[string]string{},
+	}
+
+	for _, cfg := range config.Frontends {
+		rxp, err := regexp.Compile(cfg.FrontendRegexp)
+		if err != nil {
+			return nil, err
+		}
+
+		routes := frontendRoutes{frontend: rxp}
+		for _, template := range cfg.Templates {
+			t, err := ParseRouteTemplate(template)
+			if err != nil {
+				return nil, err
+			}
+			routes.templates = append(routes.templates, t)
+		}
+
+		n.frontends = append(n.frontends, routes)
+	}
+
+	for _, param := range config.QueryParams {
+		n.queryParams[param] = QueryParamPrefix + SanitizeTagKey(param)
+	}
+
+	return &n, nil
+}
+
+// Route returns the first template of the frontend matching the path (without a query string).
+// Paths not matching any template have IDs, UUIDs and hashes replaced with placeholders
+// unless normalization is disabled.
+func (n *RouteNormalizer) Route(frontend, path string) string {
+	segments := splitPath(path)
+
+	for _, routes := range n.frontends {
+		if !routes.frontend.MatchString(frontend) {
+			continue
+		}
+
+		for _, t := range routes.templates {
+			if t.Matches(segments) {
+				return t.template
+			}
+		}
+	}
+
+	if !n.normalize {
+		return path
+	}
+
+	for idx, segment := range segments {
+		switch {
+		case numericSegment.MatchString(segment):
+			segments[idx] = idPlaceholder
+		case uuidSegment.MatchString(segment):
+			segments[idx] = uuidPlaceholder
+		default:
+			segments[idx] = segmentParts.ReplaceAllStringFunc(segment, func(part string) string {
+				if hashSegment.MatchString(part) {
+					return hashPlaceholder
+				}
+				return part
+			})
+		}
+	}
+
+	return "/" + strings.Join(segments, "/")
+}
+
+// Enrich adds route and whitelisted query parameters (as query_<name> fields) to the parsed log
+func (n *RouteNormalizer) Enrich(parsedLog map[string]interface{}) {
+	requestPath, ok := parsedLog["request_path"].(string)
+	if !ok {
+		return
+	}
+
+	path, query := requestPath, ""
+	if idx := strings.IndexByte(requestPath, '?'); idx >= 0 {
+		path, query = requestPath[:idx], requestPath[idx+1:]
+	}
+
+	frontend, _ := parsedLog["frontend_name"].(string)
+	parsedLog[RouteField] = n.Route(frontend, path)
+
+	if len(query) == 0 || len(n.queryParams) == 0 {
+		return
+	}
+
+	// malformed pairs are skipped, the rest is still usable
+	values, _ := url.ParseQuery(query)
+	for param, field := range n.queryParams {
+		if value, has := values[param]; has && len(value) > 0 {
+			parsedLog[field] = value[0]
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package metrics_test
+
+import (
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RouteNormalizer", func() {
+	var config common.RoutesConfig
+
+	BeforeEach(func() {
+		config = common.RoutesConfig{
+			Enabled: true,
+			Frontends: []common.RouteTemplatesConfig{
+				{FrontendRegexp: `\.wikia\.com/wiki$`, Templates: []string{"/wiki/Special:Search", "/wiki/:title"}},
+				{FrontendRegexp: `^api\.`, Templates: []string{"/api/v1/users/:id", "/api/v1/static/*"}},
+			},
+			QueryParams: []string{"action", "use-skin"},
+		}
+	})
+
+	normalizer := func() *RouteNormalizer {
+		n, err := NewRouteNormalizer(config)
+		Expect(err).NotTo(HaveOccurred())
+		return n
+	}
+
+	routes := map[string][2]string{
+		"numeric ids":             {"foo.wikia.com/bar", "/bar/123/comments/45"},
+		"uuids":                   {"foo.wikia.com/bar", "/bar/0f8fad5b-d9cb-469f-a165-70867728950e"},
+		"hashes":                  {"foo.wikia.com/bar", "/assets/5d41402abc4b2a76b9719d911017c592.js/app"},
+		"templates":               {"foo.wikia.com/wiki", "/wiki/Main_Page"},
+		"templates in order":      {"foo.wikia.com/wiki", "/wiki/Special:Search/"},
+		"wildcards":               {"api.wikia.com", "/api/v1/static/css/main.css"},
+		"other frontends":         {"foo.wikia.com/bar", "/wiki/Main_Page"},
+		"paths not matching":      {"api.wikia.com", "/api/v1/users/1/posts"},
+		"root path":               {"api.wikia.com", ""},
+		"short numeric-like text": {"api.wikia.com", "/v1/abc123"},
+	}
+
+	expected := map[string]string{
+		"numeric ids":             "/bar/:id/comments/:id",
+		"uuids":                   "/bar/:uuid",
+		"hashes":                  "/assets/:hash.js/app",
+		"templates":               "/wiki/:title",
+		"templates in order":      "/wiki/Special:Search",
+		"wildcards":               "/api/v1/static/*",
+		"other frontends":         "/wiki/Main_Page",
+		"paths not matching":      "/api/v1/users/:id/posts",
+		"root path":               "/",
+		"short numeric-like text": "/v1/abc123",
+	}
+
+	for name, input := range routes {
+		name, input := name, input
+		It("should handle "+name, func() {
+			Expect(normalizer().Route(input[0], input[1])).To(Equal(expected[name]))
+		})
+	}
+
+	It("should replace hashes in path segments", func() {
+		Expect(normalizer().Route("foo.wikia.com/bar", "/commit/da39a3ee5e6b4b0d3255bfef95601890afd80709")).To(Equal("/commit/:hash"))
+		Expect(normalizer().Route("foo.wikia.com/bar", "/static/app.3f2a9c1d4e5b6a7f.css")).To(Equal("/static/app.:hash.css"))
+		Expect(normalizer().Route("foo.wikia.com/bar", "/static/main-3f2a9c1d4e5b6a7f_min.js")).To(Equal("/static/main-:hash_min.js"))
+		// hex digits have to be separated from the rest of the segment
+		Expect(normalizer().Route("foo.wikia.com/bar", "/static/app3f2a9c1d4e5b6a7f.css")).To(Equal("/static/app3f2a9c1d4e5b6a7f.css"))
+	})
+
+	It("should keep paths not matching templates intact when normalization is disabled", func() {
+		config.DisableNormalization = true
+
+		Expect(normalizer().Route("api.wikia.com", "/api/v1/users/1")).To(Equal("/api/v1/users/:id"))
+		Expect(normalizer().Route("api.wikia.com", "/api/v2/users/1")).To(Equal("/api/v2/users/1"))
+	})
+
+	It("should strip query string and extract whitelisted parameters", func() {
+		parsedLog := map[string]interface{}{
+			"frontend_name": "foo.wikia.com/wiki",
+			"request_path":  "/wiki/Main_Page?action=edit&use-skin=oasis&session=secret&bad=%zz",
+		}
+
+		normalizer().Enrich(parsedLog)
+
+		Expect(parsedLog).To(HaveKeyWithValue(RouteField, "/wiki/:title"))
+		Expect(parsedLog).To(HaveKeyWithValue("query_action", "edit"))
+		Expect(parsedLog).To(HaveKeyWithValue("query_use_skin", "oasis"))
+		Expect(parsedLog).NotTo(HaveKey("query_session"))
+		Expect(parsedLog).To(HaveKeyWithValue("request_path", "/wiki/Main_Page?action=edit&use-skin=oasis&session=secret&bad=%zz"))
+	})
+
+	It("should be disabled by default", func() {
+		n, err := NewRouteNormalizer(common.RoutesConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(BeNil())
+	})
+
+	It("should reject invalid templates", func() {
+		for _, template := range []string{"wiki/:title", "/static/*/foo", "/users/:", "/files/*.css"} {
+			_, err := NewRouteNormalizer(common.RoutesConfig{
+				Enabled:   true,
+				Frontends: []common.RouteTemplatesConfig{{FrontendRegexp: ".*", Templates: []string{template}}},
+			})
+			Expect(err).To(HaveOccurred(), template)
+		}
+	})
+})
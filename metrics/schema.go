@@ -0,0 +1,209 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+// FieldType is a type of the value sent to InfluxDB
+type FieldType string
+
+const (
+	FieldInt    FieldType = "int"
+	FieldFloat  FieldType = "float"
+	FieldString FieldType = "string"
+	FieldBool   FieldType = "bool"
+)
+
+type unit struct {
+	dimension string
+	factor    float64 // size of the unit in base units of the dimension
+}
+
+// units which values can be converted between
+var units = map[string]unit{
+	"ns": {"time", 1},
+	"us": {"time", 1e3},
+	"ms": {"time", 1e6},
+	"s":  {"time", 1e9},
+	"b":  {"size", 1},
+	"kb": {"size", 1 << 10},
+	"mb": {"size", 1 << 20},
+	"gb": {"size", 1 << 30},
+}
+
+// DefaultSourceUnits lists units of the values produced by parsers of the given log formats
+var DefaultSourceUnits = map[string]map[string]string{
+	Combined: {"duration": "ms", "origin_content_size": "b"},
+	JSON:     {"duration": "ns", "origin_duration": "ns", "overhead": "ns", "origin_content_size": "b", "downstream_content_size": "b", "request_content_size": "b"},
+}
+
+type fieldSchema struct {
+	fieldType  FieldType
+	unit       string
+	sourceUnit string // overrides DefaultSourceUnits when set
+}
+
+// Schema declares types (and units) of the fields sent to InfluxDB, so values coming from
+// different log formats never cause field type conflicts
+type Schema struct {
+	fields   map[string]fieldSchema
+	rejected stats.Counter
+}
+
+// NewSchema validates declared types and units
+func NewSchema(configs []common.FieldSchemaConfig) (*Schema, error) {
+	s := Schema{
+		fields:   map[string]fieldSchema{},
+		rejected: stats.GetOrRegisterCounter("points_rejected", stats.DefaultRegistry),
+	}
+
+	for _, cfg := range configs {
+		if _, has := s.fields[cfg.Field]; has {
+			return nil, fmt.Errorf("schema of field %q defined more than once", cfg.Field)
+		}
+
+		field := fieldSchema{
+			fieldType:  FieldType(strings.ToLower(cfg.Type)),
+			unit:       strings.ToLower(cfg.Unit),
+			sourceUnit: strings.ToLower(cfg.SourceUnit),
+		}
+
+		switch field.fieldType {
+		case FieldInt, FieldFloat:
+		case FieldString, FieldBool:
+			if len(field.unit) > 0 {
+				return nil, fmt.Errorf("field %q: units can be used only with numbers", cfg.Field)
+			}
+		default:
+			return nil, fmt.Errorf("field %q: unknown type %q", cfg.Field, cfg.Type)
+		}
+
+		for _, u := range []string{field.unit, field.sourceUnit} {
+			if _, known := units[u]; len(u) > 0 && !known {
+				return nil, fmt.Errorf("field %q: unknown unit %q", cfg.Field, u)
+			}
+		}
+
+		if len(field.unit) > 0 && len(field.sourceUnit) > 0 && units[field.unit].dimension != units[field.sourceUnit].dimension {
+			return nil, fmt.Errorf("field %q: %s can't be converted to %s", cfg.Field, field.sourceUnit, field.unit)
+		}
+
+		s.fields[cfg.Field] = field
+	}
+
+	return &s, nil
+}
+
+// Coerce converts values of the fields (parsed from logs of the given format) to declared types and units.
+// Fields without schema are left intact. Error is returned for the first value which can't be converted.
+func (s *Schema) Coerce(values map[string]interface{}, format string) error {
+	for name, value := range values {
+		field, has := s.fields[name]
+		if !has {
+			continue
+		}
+
+		sourceUnit := field.sourceUnit
+		if len(sourceUnit) == 0 {
+			sourceUnit = DefaultSourceUnits[format][name]
+		}
+
+		coerced, err := field.coerce(value, sourceUnit)
+		if err != nil {
+			return fmt.Errorf("field %q: %s", name, err)
+		}
+		values[name] = coerced
+	}
+
+	return nil
+}
+
+// Reject counts point which could not be sent because of its values
+func (s *Schema) Reject() {
+	s.rejected.Inc(1)
+}
+
+func (f fieldSchema) coerce(value interface{}, sourceUnit string) (interface{}, error) {
+	switch f.fieldType {
+	case FieldString:
+		if number, ok := toFloat(value); ok {
+			if _, isString := value.(string); !isString {
+				return strconv.FormatFloat(number, 'f', -1, 64), nil
+			}
+		}
+		return fmt.Sprint(value), nil
+	case FieldBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(v))
+		}
+		if number, ok := toFloat(value); ok {
+			return number != 0, nil
+		}
+		return nil, fmt.Errorf("%v (%T) can't be converted to bool", value, value)
+	}
+
+	number, ok := toFloat(value)
+	if !ok {
+		return nil, fmt.Errorf("%v (%T) is not a number", value, value)
+	}
+
+	if len(f.unit) > 0 && len(sourceUnit) > 0 {
+		from, to := units[sourceUnit], units[f.unit]
+		if from.dimension != to.dimension {
+			return nil, fmt.Errorf("%s can't be converted to %s", sourceUnit, f.unit)
+		}
+		number = number * from.factor / to.factor
+	}
+
+	if math.IsNaN(number) || math.IsInf(number, 0) {
+		return nil, fmt.Errorf("%v is not a finite number", number)
+	}
+
+	if f.fieldType == FieldInt {
+		rounded := math.Round(number)
+		// float64(math.MaxInt64) is 2^63, which doesn't fit int64 already
+		if rounded >= math.MaxInt64 || rounded < math.MinInt64 {
+			return nil, fmt.Errorf("%v overflows int", number)
+		}
+		return int64(rounded), nil
+	}
+
+	return number, nil
+}
+
+// toFloat converts numbers (and numeric strings) to float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return number, err == nil
+	}
+
+	return 0, false
+}
@@ -0,0 +1,94 @@
+package metrics_test
+
+import (
+	"math"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema", func() {
+	var schema *Schema
+
+	BeforeEach(func() {
+		var err error
+		schema, err = NewSchema([]common.FieldSchemaConfig{
+			{Field: "duration", Type: "float", Unit: "ms"},
+			{Field: "origin_status", Type: "int"},
+			{Field: "origin_content_size", Type: "int", Unit: "kb"},
+			{Field: "request_count", Type: "string"},
+			{Field: "is_error", Type: "bool"},
+			{Field: "timeout", Type: "int", Unit: "ms", SourceUnit: "s"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should coerce values of both log formats to the same types and units", func() {
+		combined := map[string]interface{}{"duration": 15.0, "origin_status": 200.0, "origin_content_size": 2048.0, "request_count": 7.0}
+		Expect(schema.Coerce(combined, Combined)).To(Succeed())
+
+		json := map[string]interface{}{"duration": int64(15000000), "origin_status": "200", "origin_content_size": 1536.0, "request_count": int64(7)}
+		Expect(schema.Coerce(json, JSON)).To(Succeed())
+
+		for _, values := range []map[string]interface{}{combined, json} {
+			Expect(values).To(HaveKeyWithValue("duration", 15.0))
+			Expect(values).To(HaveKeyWithValue("origin_status", int64(200)))
+			Expect(values).To(HaveKeyWithValue("origin_content_size", int64(2)))
+			Expect(values).To(HaveKeyWithValue("request_count", "7"))
+		}
+	})
+
+	It("should convert configured source units and booleans", func() {
+		values := map[string]interface{}{"timeout": 1.5, "is_error": "true", "other": "intact"}
+		Expect(schema.Coerce(values, JSON)).To(Succeed())
+
+		Expect(values).To(HaveKeyWithValue("timeout", int64(1500)))
+		Expect(values).To(HaveKeyWithValue("is_error", true))
+		Expect(values).To(HaveKeyWithValue("other", "intact"))
+
+		values = map[string]interface{}{"is_error": 0.0}
+		Expect(schema.Coerce(values, JSON)).To(Succeed())
+		Expect(values).To(HaveKeyWithValue("is_error", false))
+	})
+
+	It("should accept integers up to the int64 limits", func() {
+		values := map[string]interface{}{"origin_status": 9223372036854774784.0}
+		Expect(schema.Coerce(values, JSON)).To(Succeed())
+		Expect(values).To(HaveKeyWithValue("origin_status", int64(9223372036854774784)))
+
+		values = map[string]interface{}{"origin_status": -9223372036854775808.0}
+		Expect(schema.Coerce(values, JSON)).To(Succeed())
+		Expect(values).To(HaveKeyWithValue("origin_status", int64(math.MinInt64)))
+	})
+
+	It("should fail on values which can't be converted", func() {
+		for _, values := range []map[string]interface{}{
+			{"origin_status": "OK"},
+			{"duration": []interface{}{1}},
+			{"is_error": "maybe"},
+			{"origin_status": 1e300},
+			{"origin_status": 9223372036854775808.0},
+			{"origin_status": "9223372036854775808"},
+		} {
+			Expect(schema.Coerce(values, JSON)).NotTo(Succeed(), "%v", values)
+		}
+	})
+
+	It("should reject invalid schema", func() {
+		for _, cfg := range []common.FieldSchemaConfig{
+			{Field: "a", Type: "integer"},
+			{Field: "a", Type: "int", Unit: "parsecs"},
+			{Field: "a", Type: "string", Unit: "ms"},
+			{Field: "a", Type: "int", Unit: "ms", SourceUnit: "kb"},
+		} {
+			_, err := NewSchema([]common.FieldSchemaConfig{cfg})
+			Expect(err).To(HaveOccurred(), "%v", cfg)
+		}
+
+		_, err := NewSchema([]common.FieldSchemaConfig{{Field: "a", Type: "int"}, {Field: "a", Type: "float"}})
+		Expect(err).To(HaveOccurred())
+	})
+})
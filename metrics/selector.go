@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+)
+
+type selectorOperator int
+
+const (
+	opEquals selectorOperator = iota
+	opNotEquals
+	opIn
+	opNotIn
+	opExists
+	opDoesNotExist
+)
+
+type selectorRequirement struct {
+	key      string
+	operator selectorOperator
+	values   []string
+}
+
+// LabelSelector matches label sets using the Kubernetes label selector syntax, i.e.:
+//
+//	app=traefik,tier!=internal,env in (prod,staging),!canary
+type LabelSelector struct {
+	requirements []selectorRequirement
+}
+
+// ParseLabelSelector parses selector in the Kubernetes syntax. Empty selector matches everything.
+func ParseLabelSelector(selector string) (*LabelSelector, error) {
+	ls := LabelSelector{}
+
+	for _, part := range splitSelector(selector) {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			return nil, fmt.Errorf("invalid label selector %q: empty requirement", selector)
+		}
+
+		req, err := parseRequirement(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label selector %q: %s", selector, err)
+		}
+
+		ls.requirements = append(ls.requirements, req)
+	}
+
+	return &ls, nil
+}
+
+// Matches checks if all the requirements of the selector are met by given labels
+func (ls *LabelSelector) Matches(labels map[string]string) bool {
+	for _, req := range ls.requirements {
+		value, has := labels[req.key]
+
+		switch req.operator {
+		case opEquals:
+			if !has || value != req.values[0] {
+				return false
+			}
+		case opNotEquals:
+			if has && value == req.values[0] {
+				return false
+			}
+		case opIn:
+			if !has || !isAllowed(req.values, value) {
+				return false
+			}
+		case opNotIn:
+			if has && isAllowed(req.values, value) {
+				return false
+			}
+		case opExists:
+			if !has {
+				return false
+			}
+		case opDoesNotExist:
+			if has {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// splitSelector splits selector by commas which are not within parentheses
+func splitSelector(selector string) []string {
+	if len(strings.TrimSpace(selector)) == 0 {
+		return nil
+	}
+
+	parts := []string{}
+	depth := 0
+	start := 0
+	for idx, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:idx])
+				start = idx + 1
+			}
+		}
+	}
+
+	return append(parts, selector[start:])
+}
+
+func parseRequirement(part string) (selectorRequirement, error) {
+	if strings.HasPrefix(part, "!") {
+		key := strings.TrimSpace(part[1:])
+		if err := validateLabelKey(key); err != nil {
+			return selectorRequirement{}, err
+		}
+		return selectorRequirement{key: key, operator: opDoesNotExist}, nil
+	}
+
+	// set-based requirements go first - their values can hold operators of the equality-based ones
+	if open := strings.Index(part, "("); open >= 0 {
+		head := strings.Fields(part[:open])
+		if len(head) == 2 && (head[1] == "in" || head[1] == "notin") {
+			return parseSetRequirement(head[0], head[1], strings.TrimSpace(part[open:]))
+		}
+	}
+
+	for _, op := range []struct {
+		token    string
+		operator selectorOperator
+	}{{"!=", opNotEquals}, {"==", opEquals}, {"=", opEquals}} {
+		if idx := strings.Index(part, op.token); idx >= 0 {
+			key := strings.TrimSpace(part[:idx])
+			value := strings.TrimSpace(part[idx+len(op.token):])
+			if err := validateLabelKey(key); err != nil {
+				return selectorRequirement{}, err
+			}
+			return selectorRequirement{key: key, operator: op.operator, values: []string{value}}, nil
+		}
+	}
+
+	fields := strings.Fields(part)
+	if len(fields) == 1 {
+		if err := validateLabelKey(fields[0]); err != nil {
+			return selectorRequirement{}, err
+		}
+		return selectorRequirement{key: fields[0], operator: opExists}, nil
+	}
+
+	if len(fields) < 3 {
+		return selectorRequirement{}, fmt.Errorf("could not parse requirement %q", part)
+	}
+
+	return parseSetRequirement(fields[0], fields[1], strings.Join(fields[2:], " "))
+}
+
+func parseSetRequirement(key, operator, set string) (selectorRequirement, error) {
+	req := selectorRequirement{key: key}
+	if err := validateLabelKey(req.key); err != nil {
+		return req, err
+	}
+
+	switch operator {
+	case "in":
+		req.operator = opIn
+	case "notin":
+		req.operator = opNotIn
+	default:
+		return req, fmt.Errorf("unknown operator %q", operator)
+	}
+
+	if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+		return req, fmt.Errorf("values of %q must be enclosed in parentheses", req.key)
+	}
+
+	for _, value := range strings.Split(set[1:len(set)-1], ",") {
+		req.values = append(req.values, strings.TrimSpace(value))
+	}
+
+	return req, nil
+}
+
+func validateLabelKey(key string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("label name is empty")
+	}
+
+	if strings.ContainsAny(key, " \t!=(),") {
+		return fmt.Errorf("invalid label name %q", key)
+	}
+
+	return nil
+}
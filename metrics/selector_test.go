@@ -0,0 +1,57 @@
+package metrics_test
+
+import (
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LabelSelector", func() {
+	labels := map[string]string{"app": "traefik", "env": "prod", "ingress-class": "public"}
+
+	matches := func(selector string) bool {
+		ls, err := ParseLabelSelector(selector)
+		Expect(err).NotTo(HaveOccurred(), selector)
+		return ls.Matches(labels)
+	}
+
+	It("should match everything with empty selector", func() {
+		Expect(matches("")).To(BeTrue())
+	})
+
+	It("should support equality based requirements", func() {
+		Expect(matches("app=traefik")).To(BeTrue())
+		Expect(matches("app==traefik, env = prod")).To(BeTrue())
+		Expect(matches("app=nginx")).To(BeFalse())
+		Expect(matches("env!=dev")).To(BeTrue())
+		Expect(matches("env!=prod")).To(BeFalse())
+		Expect(matches("team!=platform")).To(BeTrue())
+	})
+
+	It("should support set based requirements", func() {
+		Expect(matches("env in (prod, staging)")).To(BeTrue())
+		Expect(matches("env in (dev,staging)")).To(BeFalse())
+		Expect(matches("env notin (dev,staging),app in (traefik)")).To(BeTrue())
+		Expect(matches("ingress-class notin (public)")).To(BeFalse())
+		Expect(matches("env in(prod)")).To(BeTrue())
+		Expect(matches("env notin(prod)")).To(BeFalse())
+		// values are not parsed as equality requirements
+		Expect(matches("env in (a=b)")).To(BeFalse())
+		Expect(matches("env notin (a=b)")).To(BeTrue())
+	})
+
+	It("should support existence requirements", func() {
+		Expect(matches("app")).To(BeTrue())
+		Expect(matches("canary")).To(BeFalse())
+		Expect(matches("!canary")).To(BeTrue())
+		Expect(matches("!app")).To(BeFalse())
+	})
+
+	It("should reject invalid selectors", func() {
+		for _, selector := range []string{"app=traefik,", "=traefik", "env in prod", "env within (prod)", "a b"} {
+			_, err := ParseLabelSelector(selector)
+			Expect(err).To(HaveOccurred(), selector)
+		}
+	})
+})
@@ -0,0 +1,330 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+const (
+	DefaultSLOMeasurement      = "k8s_traefik_slo"
+	DefaultSLOGoodStatusRegexp = `^[1-4]`
+	DefaultSLOBudgetWindow     = 30 * 24 * time.Hour
+
+	// width of buckets events are counted in (for burn rate windows)
+	sloResolution = time.Minute
+	// number of buckets error budget window is divided into
+	sloBudgetBuckets = 720
+)
+
+// DefaultSLOWindows are burn rate windows used when none are configured
+var DefaultSLOWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+type eventCount struct {
+	good  int64
+	total int64
+}
+
+// rollingCounter counts events in fixed-width time buckets of a ring, so sums over
+// the recent windows can be computed in constant memory
+type rollingCounter struct {
+	width   time.Duration
+	buckets []eventCount
+	last    int64 // number of the newest bucket (time since epoch divided by width)
+}
+
+func newRollingCounter(window, width time.Duration) *rollingCounter {
+	size := int((window + width - 1) / width)
+	return &rollingCounter{width: width, buckets: make([]eventCount, size)}
+}
+
+// advance moves the ring to the bucket of the given time, clearing the expired ones
+func (c *rollingCounter) advance(now time.Time) int64 {
+	slot := now.UnixNano() / int64(c.width)
+	if slot <= c.last {
+		return c.last
+	}
+
+	size := int64(len(c.buckets))
+	from := c.last + 1
+	if slot-from >= size {
+		from = slot - size + 1
+	}
+	for i := from; i <= slot; i++ {
+		c.buckets[i%size] = eventCount{}
+	}
+	c.last = slot
+
+	return slot
+}
+
+func (c *rollingCounter) Add(now time.Time, good bool) {
+	c.advance(now)
+
+	slot := now.UnixNano() / int64(c.width)
+	if c.last-slot >= int64(len(c.buckets)) {
+		// older than the whole ring
+		return
+	}
+
+	bucket := &c.buckets[slot%int64(len(c.buckets))]
+	bucket.total++
+	if good {
+		bucket.good++
+	}
+}
+
+// Sum returns events counted within the window ending at the given time
+func (c *rollingCounter) Sum(now time.Time, window time.Duration) eventCount {
+	slot := c.advance(now)
+	size := int64(len(c.buckets))
+
+	count := int64((window + c.width - 1) / c.width)
+	if count > size {
+		count = size
+	}
+
+	sum := eventCount{}
+	for i := slot - count + 1; i <= slot; i++ {
+		sum.good += c.buckets[i%size].good
+		sum.total += c.buckets[i%size].total
+	}
+
+	return sum
+}
+
+type slo struct {
+	name          string
+	frontend      *regexp.Regexp
+	goodStatus    *regexp.Regexp
+	maxDuration   float64 // in ms, 0 when latency is not a part of the objective
+	durationField string
+	target        float64
+	windows       []time.Duration
+	budgetWindow  time.Duration
+}
+
+// good tells whether the request met the objective - requests without duration are judged by status only
+func (s *slo) good(o Observation) bool {
+	status, _ := o.Value("origin_status")
+	if !s.goodStatus.MatchString(status) {
+		return false
+	}
+
+	if duration, has := o.Duration(s.durationField); has && s.maxDuration > 0 {
+		return duration <= s.maxDuration
+	}
+
+	return true
+}
+
+type sloKey struct {
+	slo      string
+	frontend string
+}
+
+type sloTracker struct {
+	recent *rollingCounter // burn rate windows
+	budget *rollingCounter // error budget window
+}
+
+// SLOs tracks good and total events of frontends matching service level objectives and reports
+// remaining error budget and burn rates over multiple windows
+type SLOs struct {
+	sync.Mutex
+	measurement string
+	objectives  []*slo
+	trackers    map[sloKey]*sloTracker
+}
+
+// NewSLOs validates objectives. It returns nil when there are none.
+func NewSLOs(configs []common.SLOConfig, aggregation common.AggregationConfig) (*SLOs, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	s := SLOs{
+		measurement: aggregation.SLOMeasurement,
+		trackers:    map[sloKey]*sloTracker{},
+	}
+
+	if len(s.measurement) == 0 {
+		s.measurement = DefaultSLOMeasurement
+	}
+
+	names := map[string]bool{}
+	for _, cfg := range configs {
+		if len(cfg.Name) == 0 {
+			return nil, fmt.Errorf("SLO name can't be empty")
+		}
+
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("SLO %q defined more than once", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		if cfg.Target <= 0 || cfg.Target >= 1 {
+			return nil, fmt.Errorf("SLO %q: target has to be between 0 and 1", cfg.Name)
+		}
+
+		objective := slo{
+			name:          cfg.Name,
+			maxDuration:   float64(cfg.MaxDuration) / float64(time.Millisecond),
+			durationField: cfg.DurationField,
+			target:        cfg.Target,
+			windows:       cfg.Windows,
+			budgetWindow:  cfg.BudgetWindow,
+		}
+
+		var err error
+		if objective.frontend, err = regexp.Compile(cfg.FrontendRegexp); err != nil {
+			return nil, fmt.Errorf("SLO %q: %s", cfg.Name, err)
+		}
+
+		goodStatus := cfg.GoodStatusRegexp
+		if len(goodStatus) == 0 {
+			goodStatus = DefaultSLOGoodStatusRegexp
+		}
+		if objective.goodStatus, err = regexp.Compile(goodStatus); err != nil {
+			return nil, fmt.Errorf("SLO %q: %s", cfg.Name, err)
+		}
+
+		if len(objective.durationField) == 0 {
+			objective.durationField = "duration"
+		}
+
+		if len(objective.windows) == 0 {
+			objective.windows = DefaultSLOWindows
+		}
+
+		if objective.budgetWindow == 0 {
+			objective.budgetWindow = DefaultSLOBudgetWindow
+		}
+
+		for _, window := range append([]time.Duration{objective.budgetWindow}, objective.windows...) {
+			if window < sloResolution {
+				return nil, fmt.Errorf("SLO %q: windows can't be shorter than %s", cfg.Name, sloResolution)
+			}
+		}
+
+		s.objectives = append(s.objectives, &objective)
+	}
+
+	return &s, nil
+}
+
+func (s *SLOs) Observe(o Observation) {
+	frontend := o.Frontend()
+
+	// a single request from the future (i.e. clock skew) would move the rings forward, expiring all the events
+	// counted so far - it's counted as a current one instead
+	at := o.Time
+	if now := time.Now(); at.After(now) {
+		at = now
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, objective := range s.objectives {
+		if !objective.frontend.MatchString(frontend) {
+			continue
+		}
+
+		key := sloKey{slo: objective.name, frontend: frontend}
+		tracker, has := s.trackers[key]
+		if !has {
+			tracker = newSLOTracker(objective)
+			s.trackers[key] = tracker
+		}
+
+		good := objective.good(o)
+		tracker.recent.Add(at, good)
+		tracker.budget.Add(at, good)
+	}
+}
+
+func newSLOTracker(objective *slo) *sloTracker {
+	longest := time.Duration(0)
+	for _, window := range objective.windows {
+		if window > longest {
+			longest = window
+		}
+	}
+
+	width := objective.budgetWindow / sloBudgetBuckets
+	if width < sloResolution {
+		width = sloResolution
+	}
+
+	return &sloTracker{
+		recent: newRollingCounter(longest, sloResolution),
+		budget: newRollingCounter(objective.budgetWindow, width),
+	}
+}
+
+func (s *SLOs) Flush(now time.Time) []*client.Point {
+	s.Lock()
+	defer s.Unlock()
+
+	points := []*client.Point{}
+	for _, objective := range s.objectives {
+		allowed := 1 - objective.target
+
+		for key, tracker := range s.trackers {
+			if key.slo != objective.name {
+				continue
+			}
+
+			budget := tracker.budget.Sum(now, objective.budgetWindow)
+			if budget.total == 0 {
+				// no traffic within the whole budget window
+				delete(s.trackers, key)
+				continue
+			}
+
+			errorRate := float64(budget.total-budget.good) / float64(budget.total)
+			fields := map[string]interface{}{
+				"target":                 objective.target,
+				"good":                   budget.good,
+				"total":                  budget.total,
+				"sli":                    float64(budget.good) / float64(budget.total),
+				"error_budget_remaining": 1 - errorRate/allowed,
+			}
+
+			for _, window := range objective.windows {
+				if recent := tracker.recent.Sum(now, window); recent.total > 0 {
+					fields["burn_rate_"+WindowName(window)] = float64(recent.total-recent.good) / float64(recent.total) / allowed
+				}
+			}
+
+			tags := map[string]string{"slo": key.slo, "frontend_name": key.frontend}
+			pt, err := client.NewPoint(s.measurement, tags, fields, now)
+			if err != nil {
+				common.Log.WithError(err).WithField("tags", tags).Error("Could not create SLO point")
+				continue
+			}
+			points = append(points, pt)
+		}
+	}
+
+	return points
+}
+
+// WindowName formats window duration using its largest whole unit (i.e. 5m, 6h or 30d)
+func WindowName(window time.Duration) string {
+	switch {
+	case window%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", window/(24*time.Hour))
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	}
+
+	return fmt.Sprintf("%ds", window/time.Second)
+}
@@ -0,0 +1,155 @@
+package metrics_test
+
+import (
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SLOs", func() {
+	start := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	objective := common.SLOConfig{
+		Name:           "availability",
+		FrontendRegexp: `^api\.`,
+		MaxDuration:    500 * time.Millisecond,
+		Target:         0.99,
+		Windows:        []time.Duration{5 * time.Minute, time.Hour},
+		BudgetWindow:   24 * time.Hour,
+	}
+
+	newSLOs := func(configs ...common.SLOConfig) *SLOs {
+		slos, err := NewSLOs(configs, common.AggregationConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(slos).NotTo(BeNil())
+		return slos
+	}
+
+	observe := func(slos *SLOs, at time.Time, frontend string, status, durationMs float64, count int) {
+		for i := 0; i < count; i++ {
+			slos.Observe(Observation{Rule: "all", Format: Combined, Time: at, Fields: map[string]interface{}{
+				"frontend_name": frontend,
+				"origin_status": status,
+				"duration":      durationMs,
+			}})
+		}
+	}
+
+	flush := func(slos *SLOs, now time.Time) map[string]map[string]interface{} {
+		result := map[string]map[string]interface{}{}
+		for _, pt := range slos.Flush(now) {
+			Expect(pt.Name()).To(Equal(DefaultSLOMeasurement))
+			Expect(pt.Tags()).To(HaveKeyWithValue("slo", "availability"))
+
+			fields, err := pt.Fields()
+			Expect(err).NotTo(HaveOccurred())
+			result[pt.Tags()["frontend_name"]] = fields
+		}
+		return result
+	}
+
+	It("should be disabled without objectives", func() {
+		slos, err := NewSLOs(nil, common.AggregationConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(slos).To(BeNil())
+	})
+
+	It("should reject invalid objectives", func() {
+		invalid := []func(*common.SLOConfig){
+			func(c *common.SLOConfig) { c.Name = "" },
+			func(c *common.SLOConfig) { c.Target = 1 },
+			func(c *common.SLOConfig) { c.Target = 0 },
+			func(c *common.SLOConfig) { c.FrontendRegexp = "(" },
+			func(c *common.SLOConfig) { c.GoodStatusRegexp = "[" },
+			func(c *common.SLOConfig) { c.Windows = []time.Duration{time.Second} },
+		}
+
+		for _, change := range invalid {
+			config := objective
+			change(&config)
+			_, err := NewSLOs([]common.SLOConfig{config}, common.AggregationConfig{})
+			Expect(err).To(HaveOccurred())
+		}
+
+		_, err := NewSLOs([]common.SLOConfig{objective, objective}, common.AggregationConfig{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should compute error budget and burn rates", func() {
+		slos := newSLOs(objective)
+
+		// an hour ago: 1000 good requests, 10 failed and 10 slow ones
+		observe(slos, start, "api.wikia.com", 200, 100, 1000)
+		observe(slos, start, "api.wikia.com", 503, 100, 10)
+		observe(slos, start, "api.wikia.com", 200, 900, 10)
+		// recently: 95 good requests and 5 failed ones
+		now := start.Add(55 * time.Minute)
+		observe(slos, now, "api.wikia.com", 200, 100, 95)
+		observe(slos, now, "api.wikia.com", 500, 100, 5)
+		observe(slos, now, "www.wikia.com", 500, 100, 5)
+
+		points := flush(slos, now)
+		Expect(points).To(HaveLen(1))
+
+		fields := points["api.wikia.com"]
+		Expect(fields).To(HaveKeyWithValue("target", 0.99))
+		Expect(fields).To(HaveKeyWithValue("good", int64(1095)))
+		Expect(fields).To(HaveKeyWithValue("total", int64(1120)))
+		Expect(fields["sli"]).To(BeNumerically("~", 1095.0/1120, 1e-9))
+		// 25 bad out of 11.2 allowed
+		Expect(fields["error_budget_remaining"]).To(BeNumerically("~", 1-25/11.2, 1e-9))
+		Expect(fields["burn_rate_5m"]).To(BeNumerically("~", 5.0, 1e-9))
+		Expect(fields["burn_rate_1h"]).To(BeNumerically("~", 25/1120.0/0.01, 1e-9))
+	})
+
+	It("should forget events out of the windows", func() {
+		slos := newSLOs(objective)
+
+		observe(slos, start, "api.wikia.com", 503, 100, 10)
+		observe(slos, start.Add(2*time.Hour), "api.wikia.com", 200, 100, 10)
+
+		fields := flush(slos, start.Add(2*time.Hour))["api.wikia.com"]
+		Expect(fields).To(HaveKeyWithValue("burn_rate_5m", 0.0))
+		Expect(fields).To(HaveKeyWithValue("burn_rate_1h", 0.0))
+		Expect(fields).To(HaveKeyWithValue("total", int64(20)))
+
+		Expect(flush(slos, start.Add(30*time.Hour))).To(BeEmpty())
+	})
+
+	It("should count requests from the future as current ones", func() {
+		slos := newSLOs(objective)
+		now := time.Now()
+
+		observe(slos, now.Add(-10*time.Minute), "api.wikia.com", 503, 100, 10)
+		observe(slos, now, "api.wikia.com", 200, 100, 89)
+		observe(slos, now.Add(365*24*time.Hour), "api.wikia.com", 200, 100, 1)
+
+		fields := flush(slos, now.Add(time.Second))["api.wikia.com"]
+		Expect(fields).To(HaveKeyWithValue("total", int64(100)))
+		Expect(fields).To(HaveKeyWithValue("good", int64(90)))
+		Expect(fields).To(HaveKeyWithValue("burn_rate_5m", 0.0))
+		Expect(fields["burn_rate_1h"]).To(BeNumerically("~", 10.0, 1e-9))
+	})
+
+	It("should omit burn rates of windows without events", func() {
+		slos := newSLOs(objective)
+
+		observe(slos, start, "api.wikia.com", 200, 100, 10)
+
+		fields := flush(slos, start.Add(10*time.Minute))["api.wikia.com"]
+		Expect(fields).NotTo(HaveKey("burn_rate_5m"))
+		Expect(fields).To(HaveKeyWithValue("burn_rate_1h", 0.0))
+		Expect(fields).To(HaveKeyWithValue("error_budget_remaining", 1.0))
+	})
+
+	It("should name windows with their largest unit", func() {
+		Expect(WindowName(5 * time.Minute)).To(Equal("5m"))
+		Expect(WindowName(90 * time.Minute)).To(Equal("90m"))
+		Expect(WindowName(6 * time.Hour)).To(Equal("6h"))
+		Expect(WindowName(30 * 24 * time.Hour)).To(Equal("30d"))
+		Expect(WindowName(90 * time.Second)).To(Equal("90s"))
+	})
+})
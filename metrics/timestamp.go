@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/model"
+)
+
+// Sources of point timestamps
+const (
+	TimestampStartUTC          = "start_utc"          // StartUTC field of JSON logs
+	TimestampOriginalTimestamp = "original_timestamp" // timestamp of combined logs (1 second precision)
+	TimestampLogTime           = "log_time"           // time Docker received the log line
+	TimestampMessage           = "message"            // time NSQ received the message
+	TimestampNow               = "now"                // time of processing
+)
+
+// DefaultTimestampSources are used when no sources are configured
+var DefaultTimestampSources = []string{TimestampStartUTC, TimestampNow}
+
+var timestampSources = []string{TimestampStartUTC, TimestampOriginalTimestamp, TimestampLogTime, TimestampMessage, TimestampNow}
+
+// timestampChain picks timestamp of a point from the first source which has it
+type timestampChain []string
+
+func newTimestampChain(sources []string) (timestampChain, error) {
+	if len(sources) == 0 {
+		return DefaultTimestampSources, nil
+	}
+
+	for _, source := range sources {
+		if !isAllowed(timestampSources, source) {
+			return nil, fmt.Errorf("unknown timestamp source: %s", source)
+		}
+	}
+
+	return sources, nil
+}
+
+// Timestamp returns time from the first available source; time of processing is used when none is available.
+// It reports false when the time of processing is returned.
+func (chain timestampChain) Timestamp(parsedLog map[string]interface{}, entry model.LogEntry, messageTimestamp int64) (time.Time, bool) {
+	for _, source := range chain {
+		switch source {
+		case TimestampStartUTC:
+			if value, ok := parsedLog["start_utc"].(string); ok {
+				ts, err := time.Parse(time.RFC3339Nano, value)
+				if err == nil {
+					return ts, true
+				}
+				common.Log.WithError(err).WithField("start_utc", value).Debug("Could not parse timestamp")
+			}
+		case TimestampOriginalTimestamp:
+			if ts, ok := parsedLog["original_timestamp"].(time.Time); ok {
+				return ts, true
+			}
+		case TimestampLogTime:
+			if !entry.Time.IsZero() {
+				return entry.Time, true
+			}
+		case TimestampMessage:
+			if messageTimestamp > 0 {
+				return time.Unix(0, messageTimestamp), true
+			}
+		case TimestampNow:
+			return time.Now(), false
+		}
+	}
+
+	return time.Now(), false
+}
@@ -0,0 +1,223 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+const (
+	DefaultTopKMeasurement = "k8s_traefik_top"
+	DefaultTopK            = 10
+
+	// more keys than reported are tracked to make counts of the top ones more accurate
+	topKCapacityFactor = 10
+)
+
+// heavyHitter holds statistics of a key tracked by spaceSaving
+type heavyHitter struct {
+	key          string
+	count        int64 // upper bound of the number of occurrences
+	overestimate int64 // count inherited from the evicted key
+	errors       int64
+	durations    float64 // sum of durations (in ms) of requests observed since the key is tracked
+	timed        int64
+}
+
+// spaceSaving finds the most frequent keys of a stream in bounded memory - a new key replaces
+// the least frequent one when all the slots are taken (and inherits its count)
+type spaceSaving struct {
+	capacity int
+	entries  map[string]*heavyHitter
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, entries: map[string]*heavyHitter{}}
+}
+
+// Add counts occurrence of the key and returns its entry
+func (s *spaceSaving) Add(key string) *heavyHitter {
+	entry, has := s.entries[key]
+	if !has {
+		entry = &heavyHitter{key: key}
+		if len(s.entries) >= s.capacity {
+			var min *heavyHitter
+			for _, candidate := range s.entries {
+				if min == nil || candidate.count < min.count {
+					min = candidate
+				}
+			}
+			delete(s.entries, min.key)
+			entry.count = min.count
+			entry.overestimate = min.count
+		}
+		s.entries[key] = entry
+	}
+
+	entry.count++
+	return entry
+}
+
+// Top returns up to k most frequent keys
+func (s *spaceSaving) Top(k int) []*heavyHitter {
+	result := make([]*heavyHitter, 0, len(s.entries))
+	for _, entry := range s.entries {
+		result = append(result, entry)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].count != result[j].count {
+			return result[i].count > result[j].count
+		}
+		return result[i].key < result[j].key
+	})
+
+	if len(result) > k {
+		result = result[:k]
+	}
+
+	return result
+}
+
+type topKRule struct {
+	dimensions []string
+	k          int
+}
+
+type topKKey struct {
+	rule      string
+	frontend  string
+	dimension string
+}
+
+// TopK reports keys (values of the configured dimensions, i.e. request paths or client IPs) dominating
+// traffic of every frontend per interval. Keys are sent as fields, so number of series stays bounded.
+type TopK struct {
+	sync.Mutex
+	measurement string
+	rules       map[string]topKRule
+	counters    map[topKKey]*spaceSaving
+}
+
+// NewTopK validates top-K settings of the rules. It returns nil when none of the rules has dimensions set.
+func NewTopK(rules []common.RulesConfig, config common.AggregationConfig) (*TopK, error) {
+	t := TopK{
+		measurement: config.TopKMeasurement,
+		rules:       map[string]topKRule{},
+		counters:    map[topKKey]*spaceSaving{},
+	}
+
+	if len(t.measurement) == 0 {
+		t.measurement = DefaultTopKMeasurement
+	}
+
+	for _, rule := range rules {
+		if len(rule.TopK.Dimensions) == 0 {
+			continue
+		}
+
+		if len(rule.Id) == 0 {
+			return nil, fmt.Errorf("rules with top-K dimensions need an ID")
+		}
+
+		if _, has := t.rules[rule.Id]; has {
+			return nil, fmt.Errorf("rule %q: top-K dimensions defined more than once", rule.Id)
+		}
+
+		if rule.TopK.K < 0 {
+			return nil, fmt.Errorf("rule %q: K can't be negative", rule.Id)
+		}
+
+		k := rule.TopK.K
+		if k == 0 {
+			k = DefaultTopK
+		}
+
+		t.rules[rule.Id] = topKRule{dimensions: rule.TopK.Dimensions, k: k}
+	}
+
+	if len(t.rules) == 0 {
+		return nil, nil
+	}
+
+	return &t, nil
+}
+
+func (t *TopK) Observe(o Observation) {
+	rule, has := t.rules[o.Rule]
+	if !has {
+		return
+	}
+
+	duration, timed := o.Duration("duration")
+	failed := o.IsError()
+
+	t.Lock()
+	defer t.Unlock()
+
+	for _, dimension := range rule.dimensions {
+		value, has := o.Value(dimension)
+		if !has {
+			continue
+		}
+
+		key := topKKey{rule: o.Rule, frontend: o.Frontend(), dimension: dimension}
+		counter, has := t.counters[key]
+		if !has {
+			counter = newSpaceSaving(rule.k * topKCapacityFactor)
+			t.counters[key] = counter
+		}
+
+		entry := counter.Add(value)
+		if failed {
+			entry.errors++
+		}
+		if timed {
+			entry.durations += duration
+			entry.timed++
+		}
+	}
+}
+
+func (t *TopK) Flush(now time.Time) []*client.Point {
+	t.Lock()
+	counters := t.counters
+	t.counters = map[topKKey]*spaceSaving{}
+	t.Unlock()
+
+	points := []*client.Point{}
+	for key, counter := range counters {
+		for rank, entry := range counter.Top(t.rules[key.rule].k) {
+			tags := map[string]string{
+				"rule_id":       key.rule,
+				"frontend_name": key.frontend,
+				"dimension":     key.dimension,
+				"rank":          strconv.Itoa(rank + 1),
+			}
+
+			fields := map[string]interface{}{
+				"key":         entry.key,
+				"count":       entry.count,
+				"count_error": entry.overestimate,
+				"errors":      entry.errors,
+			}
+			if entry.timed > 0 {
+				fields["mean_duration_ms"] = entry.durations / float64(entry.timed)
+			}
+
+			pt, err := client.NewPoint(t.measurement, tags, fields, now)
+			if err != nil {
+				common.Log.WithError(err).WithField("tags", tags).Error("Could not create top-K point")
+				continue
+			}
+			points = append(points, pt)
+		}
+	}
+
+	return points
+}
@@ -0,0 +1,132 @@
+package metrics_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+	"github.com/influxdata/influxdb/client/v2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TopK", func() {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	rules := []common.RulesConfig{{Id: "all", TopK: common.TopKConfig{Dimensions: []string{"request_path", "client_host"}, K: 2}}}
+
+	observe := func(topK *TopK, frontend, path string, status, duration float64) {
+		topK.Observe(Observation{Rule: "all", Format: JSON, Fields: map[string]interface{}{
+			"frontend_name": frontend,
+			"request_path":  path,
+			"origin_status": status,
+			"duration":      duration,
+		}})
+	}
+
+	byRank := func(points []*client.Point) map[string]map[string]interface{} {
+		result := map[string]map[string]interface{}{}
+		for _, pt := range points {
+			Expect(pt.Name()).To(Equal(DefaultTopKMeasurement))
+			Expect(pt.Time()).To(Equal(now))
+
+			fields, err := pt.Fields()
+			Expect(err).NotTo(HaveOccurred())
+			tags := pt.Tags()
+			result[fmt.Sprintf("%s %s %s", tags["frontend_name"], tags["dimension"], tags["rank"])] = fields
+		}
+		return result
+	}
+
+	It("should be disabled without dimensions", func() {
+		topK, err := NewTopK([]common.RulesConfig{{Id: "all"}}, common.AggregationConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(topK).To(BeNil())
+	})
+
+	It("should reject invalid settings", func() {
+		for _, rules := range [][]common.RulesConfig{
+			{{TopK: common.TopKConfig{Dimensions: []string{"request_path"}}}},
+			{{Id: "all", TopK: common.TopKConfig{Dimensions: []string{"request_path"}, K: -1}}},
+			{rules[0], rules[0]},
+		} {
+			_, err := NewTopK(rules, common.AggregationConfig{})
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("should report the most frequent keys per frontend", func() {
+		topK, err := NewTopK(rules, common.AggregationConfig{})
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 3; i++ {
+			observe(topK, "a", "/popular", 200, 2e6)
+		}
+		observe(topK, "a", "/popular", 503, 5e6)
+		observe(topK, "a", "/second", 200, 1e6)
+		observe(topK, "a", "/second", 200, 1e6)
+		observe(topK, "a", "/rare", 200, 1e6)
+		observe(topK, "b", "/other", 200, 1e6)
+
+		points := byRank(topK.Flush(now))
+		Expect(points).To(HaveLen(3))
+		Expect(points["a request_path 1"]).To(Equal(map[string]interface{}{
+			"key":              "/popular",
+			"count":            int64(4),
+			"count_error":      int64(0),
+			"errors":           int64(1),
+			"mean_duration_ms": 2.75,
+		}))
+		Expect(points["a request_path 2"]).To(HaveKeyWithValue("key", "/second"))
+		Expect(points["b request_path 1"]).To(HaveKeyWithValue("key", "/other"))
+
+		Expect(topK.Flush(now)).To(BeEmpty())
+	})
+
+	It("should find heavy hitters among many rare keys", func() {
+		topK, err := NewTopK(rules, common.AggregationConfig{TopKMeasurement: DefaultTopKMeasurement})
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 1000; i++ {
+			observe(topK, "a", fmt.Sprintf("/rare/%d", i), 200, 1e6)
+			if i%4 == 0 {
+				observe(topK, "a", "/heavy", 200, 1e6)
+			}
+			if i%5 == 0 {
+				observe(topK, "a", "/medium", 200, 1e6)
+			}
+		}
+
+		points := byRank(topK.Flush(now))
+		Expect(points["a request_path 1"]).To(HaveKeyWithValue("key", "/heavy"))
+		Expect(points["a request_path 2"]).To(HaveKeyWithValue("key", "/medium"))
+
+		count := points["a request_path 1"]["count"].(int64)
+		overestimate := points["a request_path 1"]["count_error"].(int64)
+		Expect(count - overestimate).To(BeNumerically("<=", 250))
+		Expect(count).To(BeNumerically(">=", 250))
+	})
+
+	It("should observe entries matched by rules regardless of sampling", func() {
+		config := common.NewConfig()
+		config.Fields = []string{"duration"}
+		config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 0, TopK: common.TopKConfig{Dimensions: []string{"request_path"}}}}
+
+		processor, err := NewTraefikMetricProcessor(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		points, err := processor.Process(jsonLogEntry(sampleLog()), PodConfig{Format: JSON}, 0, "test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(points.Points()).To(BeEmpty())
+
+		aggregates := processor.Flush(now)
+		Expect(aggregates).To(HaveLen(1))
+		Expect(aggregates[0].Tags()).To(HaveKeyWithValue("frontend_name", "foo.wikia.com/bar"))
+
+		fields, err := aggregates[0].Fields()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fields).To(HaveKeyWithValue("key", "/bar/123?x=1"))
+		Expect(fields).To(HaveKeyWithValue("mean_duration_ms", 1.5))
+	})
+})
@@ -19,7 +19,9 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/geoip"
 	"github.com/Wikia/nsq-traefik-consumer/model"
+	"github.com/Wikia/nsq-traefik-consumer/useragent"
 	"github.com/influxdata/influxdb/client/v2"
 )
 
@@ -28,29 +30,251 @@ const (
 	JSON     = "access_log_as_json"
 )
 
+// ReplicaTag is added to points of aggregates
+const ReplicaTag = "replica"
+
+var (
+	// SupportedFormats lists all log formats processor can handle
+	SupportedFormats = []string{Combined, JSON}
+	// ReservedTags lists tags set by the processor which can't be overwritten by PODs
+	ReservedTags = []string{"frontend_name", "backend_name", "host_name", "cluster_name", "data_center", "rule_id", "namespace", "container_name"}
+)
+
+// PodConfig holds per POD settings (coming from its annotation) which are merged with the global rules
+type PodConfig struct {
+	Format   string            // log format of the container
+	Sampling *float64          // overrides sampling of the matched rule when set
+	Tags     map[string]string // extra tags added to every point
+	Fields   []string          // when not empty only these fields (out of globally configured ones) are sent
+	Versions map[string]string // backend URL substrings mapped to versions of the backends
+}
+
+// Reasons of processing errors
+const (
+	ReasonUnknownFormat  = "unknown_format"
+	ReasonInvalidLog     = "invalid_log"
+	ReasonSchemaMismatch = "schema_mismatch"
+	ReasonInvalidPoint   = "invalid_point"
+)
+
+// ProcessingError tells why log entry could not be turned into a point
+type ProcessingError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ProcessingError) Error() string {
+	return e.Err.Error()
+}
+
 type RuleFilter func(model.LogEntry) bool
 
 type ProcessRule struct {
-	Id             string
-	PathRegexp     *regexp.Regexp
-	MethodRegexp   *regexp.Regexp
-	FrontEndRegexp *regexp.Regexp
-	Filter         RuleFilter
+	Id               string
+	PathRegexp       *regexp.Regexp
+	MethodRegexp     *regexp.Regexp
+	FrontEndRegexp   *regexp.Regexp
+	NamespaceRegexp  *regexp.Regexp
+	LabelSelector    *LabelSelector
+	ClusterRegexp    *regexp.Regexp
+	DatacenterRegexp *regexp.Regexp
+	HostRegexp       *regexp.Regexp
+	Conditions       map[string]*regexp.Regexp
+	Filter           RuleFilter
+}
+
+// MatchesMetadata checks rule conditions on the log envelope (Kubernetes metadata of the Traefik POD)
+func (rule ProcessRule) MatchesMetadata(entry model.LogEntry) bool {
+	return matchOptional(rule.NamespaceRegexp, entry.Kubernetes.NamespaceName) &&
+		matchOptional(rule.ClusterRegexp, entry.KubernetesClusterName) &&
+		matchOptional(rule.DatacenterRegexp, entry.Datacenter) &&
+		matchOptional(rule.HostRegexp, entry.Kubernetes.Host) &&
+		(rule.LabelSelector == nil || rule.LabelSelector.Matches(entry.Kubernetes.Labels))
+}
+
+// MatchesConditions checks if parsed log fields match all the conditions of the rule (missing fields never match)
+func (rule ProcessRule) MatchesConditions(parsedLog map[string]interface{}) bool {
+	for field, rxp := range rule.Conditions {
+		value, has := parsedLog[field]
+		if !has || value == nil || !rxp.MatchString(fmt.Sprint(value)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchOptional(rxp *regexp.Regexp, value string) bool {
+	return rxp == nil || rxp.MatchString(value)
+}
+
+func compileOptional(expr string) (*regexp.Regexp, error) {
+	if len(expr) == 0 {
+		return nil, nil
+	}
+
+	return regexp.Compile(expr)
 }
 
 type TraefikMetricProcessor struct {
 	Rules           []ProcessRule
 	randomGenerator *rand.Rand
 	fields          []string
+	k8sTagger       *KubernetesTagger
+	flattenOptions  common.FlattenOptions
+	redactor        *Redactor
+	anonymizer      *IPAnonymizer
+	geoIP           *geoip.Enricher
+	userAgents      *useragent.Classifier
+	routes          *RouteNormalizer
+	derived         *DerivedFields
+	schema          *Schema
+	timestamps      timestampChain
+	lateData        *LateDataPolicy
+	cardinality     *CardinalityGuard
+	aggregators     []Aggregator
+	tagFields       []string
 }
 
-func NewTraefikMetricProcessor(config []common.RulesConfig, fields []string) (*TraefikMetricProcessor, error) {
+func NewTraefikMetricProcessor(config common.Config) (*TraefikMetricProcessor, error) {
 	mp := TraefikMetricProcessor{Rules: []ProcessRule{}}
 	s1 := rand.NewSource(time.Now().UnixNano())
 	mp.randomGenerator = rand.New(s1)
-	mp.fields = fields
+	mp.fields = append([]string{}, config.Fields...)
+
+	k8sTagger, err := NewKubernetesTagger(config.Kubernetes.Tags)
+	if err != nil {
+		return nil, err
+	}
+	mp.k8sTagger = k8sTagger
+
+	mp.flattenOptions, err = common.NewFlattenOptions(config.Flatten)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.redactor, err = NewRedactor(config.Redaction)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.anonymizer, err = NewIPAnonymizer(config.Anonymization)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.geoIP, err = geoip.NewEnricher(config.GeoIP)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.userAgents, err = useragent.NewClassifier(config.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.routes, err = NewRouteNormalizer(config.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.derived, err = NewDerivedFields(config.DerivedFields)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.schema, err = NewSchema(config.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.timestamps, err = newTimestampChain(config.TimestampSources)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.lateData, err = NewLateDataPolicy(config.LateData)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.cardinality, err = NewCardinalityGuard(config.Cardinality)
+	if err != nil {
+		return nil, err
+	}
+
+	topK, err := NewTopK(config.Rules, config.Aggregation)
+	if err != nil {
+		return nil, err
+	}
+	if topK != nil {
+		mp.aggregators = append(mp.aggregators, topK)
+	}
+
+	apdex, err := NewApdex(config.Rules, config.Aggregation)
+	if err != nil {
+		return nil, err
+	}
+	if apdex != nil {
+		mp.aggregators = append(mp.aggregators, apdex)
+	}
+
+	uniqueClients, err := NewUniqueClients(config.Aggregation)
+	if err != nil {
+		return nil, err
+	}
+	if uniqueClients != nil {
+		mp.aggregators = append(mp.aggregators, uniqueClients)
+	}
+
+	slos, err := NewSLOs(config.SLOs, config.Aggregation)
+	if err != nil {
+		return nil, err
+	}
+	if slos != nil {
+		mp.aggregators = append(mp.aggregators, slos)
+	}
+
+	backendHealth, err := NewBackendHealth(config.BackendHealth)
+	if err != nil {
+		return nil, err
+	}
+	if backendHealth != nil {
+		mp.aggregators = append(mp.aggregators, backendHealth)
+	}
+
+	versions, err := NewVersions(config.Versions)
+	if err != nil {
+		return nil, err
+	}
+	if versions != nil {
+		mp.aggregators = append(mp.aggregators, versions)
+	}
 
-	for _, cfg := range config {
+	alerts, err := NewAlerts(config.Alerts)
+	if err != nil {
+		return nil, err
+	}
+	if alerts != nil {
+		mp.aggregators = append(mp.aggregators, alerts)
+	}
+
+	mp.tagFields = append([]string{}, config.Tags...)
+	for _, field := range mp.derived.Fields() {
+		if field.Tag {
+			mp.tagFields = append(mp.tagFields, field.Name)
+		} else if !isAllowed(mp.fields, field.Name) {
+			mp.fields = append(mp.fields, field.Name)
+		}
+	}
+
+	for _, tag := range mp.tagFields {
+		if isAllowed(ReservedTags, tag) {
+			return nil, fmt.Errorf("field %q can't be used as a tag - it is reserved", tag)
+		}
+	}
+
+	for _, cfg := range config.Rules {
 		rule := ProcessRule{}
 		rule.Id = cfg.Id
 
@@ -70,6 +294,39 @@ func NewTraefikMetricProcessor(config []common.RulesConfig, fields []string) (*T
 			rule.MethodRegexp = rxp
 		}
 
+		for _, optional := range []struct {
+			expr   string
+			target **regexp.Regexp
+		}{
+			{cfg.NamespaceRegexp, &rule.NamespaceRegexp},
+			{cfg.ClusterRegexp, &rule.ClusterRegexp},
+			{cfg.DatacenterRegexp, &rule.DatacenterRegexp},
+			{cfg.HostRegexp, &rule.HostRegexp},
+		} {
+			rxp, err := compileOptional(optional.expr)
+			if err != nil {
+				return nil, err
+			}
+			*optional.target = rxp
+		}
+
+		rule.Conditions = map[string]*regexp.Regexp{}
+		for field, expr := range cfg.Conditions {
+			rxp, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			rule.Conditions[field] = rxp
+		}
+
+		if len(cfg.LabelSelector) > 0 {
+			selector, err := ParseLabelSelector(cfg.LabelSelector)
+			if err != nil {
+				return nil, err
+			}
+			rule.LabelSelector = selector
+		}
+
 		rxp, err := regexp.Compile(cfg.FrontendRegexp)
 		if err != nil {
 			return nil, err
@@ -140,7 +397,7 @@ func toSnake(in string) string {
 	return string(out)
 }
 
-func parseJsonLog(entry model.LogEntry) (map[string]interface{}, error) {
+func parseJsonLog(entry model.LogEntry, flattenOptions common.FlattenOptions) (map[string]interface{}, error) {
 	logEntries := map[string]interface{}{}
 
 	err := json.Unmarshal([]byte(entry.Log), &logEntries)
@@ -156,10 +413,10 @@ func parseJsonLog(entry model.LogEntry) (map[string]interface{}, error) {
 		ret[key] = v
 	}
 
-	return common.Flatten(ret), nil
+	return common.FlattenWithOptions(ret, flattenOptions)
 }
 
-func (mp TraefikMetricProcessor) Process(entry model.LogEntry, logFormat string, timestamp int64, measurement string) (client.BatchPoints, error) {
+func (mp TraefikMetricProcessor) Process(entry model.LogEntry, pod PodConfig, messageTimestamp int64, measurement string) (client.BatchPoints, error) {
 	result, err := client.NewBatchPoints(client.BatchPointsConfig{})
 	if err != nil {
 		return nil, err
@@ -167,24 +424,51 @@ func (mp TraefikMetricProcessor) Process(entry model.LogEntry, logFormat string,
 
 	var parsedLog map[string]interface{}
 
-	switch logFormat {
+	switch pod.Format {
 	case Combined:
 		parsedLog, err = parseCommonLog(entry)
 	case JSON:
-		parsedLog, err = parseJsonLog(entry)
+		parsedLog, err = parseJsonLog(entry, mp.flattenOptions)
 	default:
-		return nil, fmt.Errorf("unknown log format: %s", logFormat)
+		return nil, &ProcessingError{Reason: ReasonUnknownFormat, Err: fmt.Errorf("unknown log format: %s", pod.Format)}
 	}
 
 	if err != nil {
-		common.Log.WithFields(log.Fields{
-			"entry": entry.Log,
-		}).WithError(err).Error("could not parse Traefik log")
-		return nil, fmt.Errorf("could not parse Traefik log")
+		return nil, &ProcessingError{Reason: ReasonInvalidLog, Err: fmt.Errorf("could not parse Traefik log: %s", err)}
+	}
+
+	// enrichment has to happen before client data is anonymized
+	if mp.geoIP != nil {
+		mp.geoIP.Enrich(parsedLog)
+	}
+
+	if mp.userAgents != nil {
+		mp.userAgents.Enrich(parsedLog)
+	}
+
+	if mp.routes != nil {
+		mp.routes.Enrich(parsedLog)
+	}
+
+	mp.redactor.Redact(parsedLog)
+
+	// aggregators count clients by their real addresses, so anonymization doesn't merge or split them
+	var clients map[string]interface{}
+	if len(mp.aggregators) > 0 {
+		clients = mp.anonymizer.Originals(parsedLog)
 	}
+	mp.anonymizer.Anonymize(parsedLog, time.Now())
+	mp.derived.Derive(parsedLog)
 
 	// filtering and rule processing
 	for _, rule := range mp.Rules {
+		if !rule.MatchesMetadata(entry) {
+			common.Log.WithFields(log.Fields{
+				"rule_id": rule.Id,
+			}).Debug("Kubernetes metadata doesn't match rule - skipping")
+			continue
+		}
+
 		if parsedLog["frontend_name"] == nil || !rule.FrontEndRegexp.MatchString(parsedLog["frontend_name"].(string)) {
 			common.Log.WithFields(log.Fields{
 				"entry":   parsedLog,
@@ -209,7 +493,29 @@ func (mp TraefikMetricProcessor) Process(entry model.LogEntry, logFormat string,
 			continue
 		}
 
-		if !rule.Filter(entry) {
+		if !rule.MatchesConditions(parsedLog) {
+			common.Log.WithFields(log.Fields{
+				"entry":   parsedLog,
+				"rule_id": rule.Id,
+			}).Debug("Field conditions don't match - skipping")
+			continue
+		}
+
+		if len(mp.aggregators) > 0 {
+			observation := Observation{Rule: rule.Id, Format: pod.Format, Fields: parsedLog, Time: time.Now(), Pod: pod, Clients: clients}
+			for _, aggregator := range mp.aggregators {
+				aggregator.Observe(observation)
+			}
+		}
+
+		var sampled bool
+		if pod.Sampling != nil {
+			sampled = mp.randomGenerator.Float64() < *pod.Sampling
+		} else {
+			sampled = rule.Filter(entry)
+		}
+
+		if !sampled {
 			common.Log.WithFields(log.Fields{
 				"entry":   parsedLog,
 				"rule_id": rule.Id,
@@ -231,18 +537,37 @@ func (mp TraefikMetricProcessor) Process(entry model.LogEntry, logFormat string,
 			"rule_id":       rule.Id,
 		}
 
-		values := map[string]interface{}{}
+		mp.k8sTagger.AddTags(entry.Kubernetes, tags)
 
-		var timestamp time.Time
-		original_timestamp, has := parsedLog["start_utc"]
-		if has {
-			timestamp, err = time.Parse(time.RFC3339Nano, original_timestamp.(string))
-			if err != nil {
-				common.Log.WithError(err).WithField("original_timestamp", original_timestamp).Error("error parsing timestamp")
-				continue
+		for _, k := range mp.tagFields {
+			if value, has := parsedLog[k]; has && value != nil {
+				if text := fmt.Sprint(value); len(text) > 0 {
+					tags[k] = text
+				}
+			}
+		}
+
+		for k, v := range pod.Tags {
+			if _, has := tags[k]; !has {
+				tags[k] = v
 			}
-		} else {
-			timestamp = time.Now()
+		}
+
+		values := map[string]interface{}{}
+
+		now := time.Now()
+		timestamp, fromLog := mp.timestamps.Timestamp(parsedLog, entry, messageTimestamp)
+		if fromLog {
+			mp.lateData.RecordLag(timestamp, now)
+		}
+
+		timestamp, retentionPolicy, accepted := mp.lateData.Apply(timestamp, now)
+		if !accepted {
+			common.Log.WithFields(log.Fields{
+				"timestamp": timestamp,
+				"rule_id":   rule.Id,
+			}).Debug("Timestamp out of allowed range - skipping")
+			return result, nil
 		}
 
 		for _, k := range mp.fields {
@@ -251,22 +576,79 @@ func (mp TraefikMetricProcessor) Process(entry model.LogEntry, logFormat string,
 				continue
 			}
 
+			if len(pod.Fields) > 0 && !isAllowed(pod.Fields, k) {
+				continue
+			}
+
 			values[k] = parsedLog[k]
 		}
 
+		// a single bad point should not fail the whole batch in InfluxDB - it's rejected here instead
+		if err := mp.schema.Coerce(values, pod.Format); err != nil {
+			mp.schema.Reject()
+			return nil, &ProcessingError{Reason: ReasonSchemaMismatch, Err: err}
+		}
+
+		if mp.cardinality != nil && !mp.cardinality.Check(measurement, tags) {
+			common.Log.WithFields(log.Fields{
+				"tags":    tags,
+				"rule_id": rule.Id,
+			}).Debug("Tags over cardinality limits - skipping")
+			return result, nil
+		}
+
 		pt, err := client.NewPoint(measurement, tags, values, timestamp)
 		if err != nil {
-			common.Log.WithFields(log.Fields{
-				"values":      values,
-				"tags":        tags,
-				"measurement": measurement,
-			}).WithError(err).Error("Error creating time point from log entry")
-			return nil, err
+			mp.schema.Reject()
+			return nil, &ProcessingError{Reason: ReasonInvalidPoint, Err: err}
 		}
 
 		result.AddPoint(pt)
+		result.SetRetentionPolicy(retentionPolicy)
 		return result, nil
 	}
 
 	return result, nil
 }
+
+// Close stops background work of the processor (i.e. reloading GeoIP databases)
+func (mp TraefikMetricProcessor) Close() {
+	if mp.geoIP != nil {
+		mp.geoIP.Close()
+	}
+}
+
+// Flush returns points emitted by all the aggregators. Every replica aggregates only its part of the traffic,
+// so points are tagged with the replica to keep their series apart.
+func (mp TraefikMetricProcessor) Flush(now time.Time) []*client.Point {
+	points := []*client.Point{}
+	for _, aggregator := range mp.aggregators {
+		for _, pt := range aggregator.Flush(now) {
+			tags := pt.Tags()
+			tags[ReplicaTag] = common.Replica
+
+			fields, err := pt.Fields()
+			if err == nil {
+				pt, err = client.NewPoint(pt.Name(), tags, fields, pt.Time())
+			}
+			if err != nil {
+				common.Log.WithError(err).WithField("tags", tags).Error("Could not tag aggregate point")
+				continue
+			}
+
+			points = append(points, pt)
+		}
+	}
+
+	return points
+}
+
+func isAllowed(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
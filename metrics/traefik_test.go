@@ -0,0 +1,432 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+	"github.com/Wikia/nsq-traefik-consumer/model"
+	stats "github.com/rcrowley/go-metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func jsonLogEntry(log map[string]interface{}) model.LogEntry {
+	raw, err := json.Marshal(log)
+	Expect(err).NotTo(HaveOccurred())
+
+	return model.LogEntry{
+		Log:                   string(raw),
+		Datacenter:            "sjc",
+		KubernetesClusterName: "prod",
+		Kubernetes: model.KubernetesMeta{
+			NamespaceName: "prod",
+			PodName:       "traefik-1",
+			PodId:         "1234",
+			Host:          "k8s-node-1",
+			ContainerName: "traefik",
+			Labels:        map[string]string{"app": "traefik", "ingress-class": "public"},
+		},
+	}
+}
+
+func sampleLog() map[string]interface{} {
+	return map[string]interface{}{
+		"FrontendName":  "foo.wikia.com/bar",
+		"BackendName":   "bar",
+		"RequestPath":   "/bar/123?x=1",
+		"RequestMethod": "GET",
+		"OriginStatus":  200,
+		"Duration":      1500000,
+		"ClientHost":    "10.1.2.3",
+	}
+}
+
+var _ = Describe("TraefikMetricProcessor", func() {
+	var config common.Config
+
+	BeforeEach(func() {
+		config = common.NewConfig()
+		config.Fields = []string{"duration", "origin_status", "request_path"}
+	})
+
+	process := func(entry model.LogEntry) []map[string]string {
+		processor, err := NewTraefikMetricProcessor(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		points, err := processor.Process(entry, PodConfig{Format: JSON}, 0, "test")
+		Expect(err).NotTo(HaveOccurred())
+
+		tags := []map[string]string{}
+		for _, pt := range points.Points() {
+			tags = append(tags, pt.Tags())
+		}
+
+		return tags
+	}
+
+	It("should create point for matching rule", func() {
+		config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+
+		tags := process(jsonLogEntry(sampleLog()))
+		Expect(tags).To(HaveLen(1))
+		Expect(tags[0]).To(HaveKeyWithValue("frontend_name", "foo.wikia.com/bar"))
+		Expect(tags[0]).To(HaveKeyWithValue("rule_id", "all"))
+	})
+
+	It("should send configured fields as tags", func() {
+		config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+		config.Tags = []string{"request_method", "origin_status", "missing"}
+
+		tags := process(jsonLogEntry(sampleLog()))
+		Expect(tags).To(HaveLen(1))
+		Expect(tags[0]).To(HaveKeyWithValue("request_method", "GET"))
+		Expect(tags[0]).To(HaveKeyWithValue("origin_status", "200"))
+		Expect(tags[0]).NotTo(HaveKey("missing"))
+
+		config.Tags = []string{"frontend_name"}
+		_, err := NewTraefikMetricProcessor(config)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should send route instead of raw path as a tag", func() {
+		config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+		config.Routes = common.RoutesConfig{Enabled: true}
+		config.Tags = []string{RouteField}
+
+		tags := process(jsonLogEntry(sampleLog()))
+		Expect(tags).To(HaveLen(1))
+		Expect(tags[0]).To(HaveKeyWithValue(RouteField, "/bar/:id"))
+	})
+
+	It("should send the same field types for both log formats", func() {
+		config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+		config.Fields = []string{"duration", "origin_status"}
+		config.Schema = []common.FieldSchemaConfig{
+			{Field: "duration", Type: "float", Unit: "ms"},
+			{Field: "origin_status", Type: "int"},
+		}
+
+		processor, err := NewTraefikMetricProcessor(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		combined := jsonLogEntry(nil)
+		combined.Log = `10.1.2.3 - - [01/Oct/2017:12:00:00 +0000] "GET /bar/123 HTTP/1.1" 200 512 "-" "curl/7.54.0" 1 "foo.wikia.com/bar" "http://10.0.0.1:80" 2ms`
+
+		for format, entry := range map[string]model.LogEntry{Combined: combined, JSON: jsonLogEntry(sampleLog())} {
+			points, err := processor.Process(entry, PodConfig{Format: format}, 0, "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(points.Points()).To(HaveLen(1), format)
+
+			fields, err := points.Points()[0].Fields()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fields).To(HaveKeyWithValue("origin_status", int64(200)), format)
+			Expect(fields["duration"]).To(BeAssignableToTypeOf(0.0), format)
+			Expect(fields["duration"]).To(BeNumerically("~", 1.5, 0.5), format)
+		}
+	})
+
+	It("should reject points which don't match the schema", func() {
+		config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+		config.Schema = []common.FieldSchemaConfig{{Field: "request_path", Type: "int"}}
+
+		processor, err := NewTraefikMetricProcessor(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = processor.Process(jsonLogEntry(sampleLog()), PodConfig{Format: JSON}, 0, "test")
+		Expect(err).To(BeAssignableToTypeOf(&ProcessingError{}))
+		Expect(err.(*ProcessingError).Reason).To(Equal(ReasonSchemaMismatch))
+	})
+
+	It("should report logs which can't be parsed", func() {
+		processor, err := NewTraefikMetricProcessor(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		entry := jsonLogEntry(nil)
+		entry.Log = "{broken"
+
+		for format, reason := range map[string]string{JSON: ReasonInvalidLog, Combined: ReasonInvalidLog, "other": ReasonUnknownFormat} {
+			_, err = processor.Process(entry, PodConfig{Format: format}, 0, "test")
+			Expect(err).To(BeAssignableToTypeOf(&ProcessingError{}))
+			Expect(err.(*ProcessingError).Reason).To(Equal(reason))
+		}
+	})
+
+	Describe("timestamps", func() {
+		logTime := time.Date(2017, 10, 1, 12, 0, 1, 0, time.UTC)
+		startTime := time.Date(2017, 10, 1, 12, 0, 0, 123456789, time.UTC)
+		messageTime := time.Date(2017, 10, 1, 12, 0, 2, 0, time.UTC)
+
+		pointTime := func(sources []string, withStart bool) time.Time {
+			config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+			config.TimestampSources = sources
+
+			processor, err := NewTraefikMetricProcessor(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			log := sampleLog()
+			if withStart {
+				log["StartUTC"] = startTime.Format(time.RFC3339Nano)
+			}
+			entry := jsonLogEntry(log)
+			entry.Time = logTime
+
+			points, err := processor.Process(entry, PodConfig{Format: JSON}, messageTime.UnixNano(), "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(points.Points()).To(HaveLen(1))
+
+			return points.Points()[0].Time()
+		}
+
+		It("should use the first available source", func() {
+			Expect(pointTime(nil, true)).To(Equal(startTime))
+			Expect(pointTime([]string{TimestampStartUTC, TimestampLogTime}, false)).To(Equal(logTime))
+			Expect(pointTime([]string{TimestampOriginalTimestamp, TimestampMessage}, true).Equal(messageTime)).To(BeTrue())
+			Expect(pointTime([]string{TimestampStartUTC}, false)).To(BeTemporally("~", time.Now(), time.Second))
+		})
+
+		It("should record event lag only for timestamps taken from logs", func() {
+			lagCount := func() int64 {
+				return stats.DefaultRegistry.Get("event_lag_ms").(stats.Histogram).Count()
+			}
+
+			pointTime(nil, false)
+			before := lagCount()
+			pointTime(nil, false)
+			Expect(lagCount()).To(Equal(before))
+
+			pointTime(nil, true)
+			Expect(lagCount()).To(Equal(before + 1))
+		})
+
+		It("should route late points to a separate retention policy", func() {
+			config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+			config.LateData = common.LateDataConfig{MaxAge: time.Hour, Action: LateDataRoute, RetentionPolicy: "long_term"}
+
+			processor, err := NewTraefikMetricProcessor(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			log := sampleLog()
+			log["StartUTC"] = startTime.Format(time.RFC3339Nano)
+			points, err := processor.Process(jsonLogEntry(log), PodConfig{Format: JSON}, 0, "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(points.Points()).To(HaveLen(1))
+			Expect(points.RetentionPolicy()).To(Equal("long_term"))
+
+			log["StartUTC"] = time.Now().Format(time.RFC3339Nano)
+			points, err = processor.Process(jsonLogEntry(log), PodConfig{Format: JSON}, 0, "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(points.RetentionPolicy()).To(BeEmpty())
+		})
+
+		It("should reject unknown sources", func() {
+			config.TimestampSources = []string{"yesterday"}
+
+			_, err := NewTraefikMetricProcessor(config)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("should fold frontends over the cardinality limit", func() {
+		config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+		config.Cardinality = common.CardinalityConfig{TagLimits: []common.TagLimitConfig{{Tag: "frontend_name", MaxValues: 1}}}
+
+		processor, err := NewTraefikMetricProcessor(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		frontends := []string{}
+		for _, frontend := range []string{"main", "pr-1", "main"} {
+			log := sampleLog()
+			log["FrontendName"] = frontend
+			points, err := processor.Process(jsonLogEntry(log), PodConfig{Format: JSON}, 0, "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(points.Points()).To(HaveLen(1))
+			frontends = append(frontends, points.Points()[0].Tags()["frontend_name"])
+		}
+
+		Expect(frontends).To(Equal([]string{"main", OtherTagValue, "main"}))
+	})
+
+	Describe("aggregates of anonymized clients", func() {
+		aggregate := func(mode string) map[string][]map[string]interface{} {
+			config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1, TopK: common.TopKConfig{Dimensions: []string{"client_host"}}}}
+			config.Aggregation.UniqueClients.Enabled = true
+			config.Anonymization = common.AnonymizationConfig{Mode: mode}
+
+			processor, err := NewTraefikMetricProcessor(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, client := range []string{"10.1.2.3", "10.1.2.4", "10.1.2.5", "10.1.2.3"} {
+				log := sampleLog()
+				log["ClientHost"] = client
+				_, err := processor.Process(jsonLogEntry(log), PodConfig{Format: JSON}, 0, "test")
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			fields := map[string][]map[string]interface{}{}
+			for _, pt := range processor.Flush(time.Now()) {
+				values, err := pt.Fields()
+				Expect(err).NotTo(HaveOccurred())
+				fields[pt.Name()] = append(fields[pt.Name()], values)
+			}
+
+			return fields
+		}
+
+		It("should count unique clients by their real addresses", func() {
+			fields := aggregate(AnonymizeTruncate)
+			Expect(fields[DefaultAggregateMeasurement]).To(HaveLen(1))
+			Expect(fields[DefaultAggregateMeasurement][0]).To(HaveKeyWithValue("unique_clients", int64(3)))
+
+			// top-K keys are values being sent - anonymized ones
+			Expect(fields[DefaultTopKMeasurement]).To(HaveLen(1))
+			Expect(fields[DefaultTopKMeasurement][0]).To(HaveKeyWithValue("key", "10.1.2.0"))
+			Expect(fields[DefaultTopKMeasurement][0]).To(HaveKeyWithValue("count", int64(4)))
+		})
+
+		It("should count clients even when their addresses are dropped", func() {
+			fields := aggregate(AnonymizeDrop)
+			Expect(fields[DefaultAggregateMeasurement]).To(HaveLen(1))
+			Expect(fields[DefaultAggregateMeasurement][0]).To(HaveKeyWithValue("unique_clients", int64(3)))
+			Expect(fields[DefaultTopKMeasurement]).To(BeEmpty())
+		})
+	})
+
+	Describe("derived fields", func() {
+		BeforeEach(func() {
+			config.DerivedFields = []common.DerivedFieldConfig{
+				{Name: "status_class", Expression: `floor(origin_status / 100) + "xx"`, Tag: true},
+				{Name: "is_error", Expression: `origin_status >= 500`},
+				{Name: "duration_ms", Expression: `duration / 1e6`},
+				{Name: "slow", Expression: `duration_ms > 1000`, Tag: true},
+			}
+		})
+
+		It("should compute fields and tags", func() {
+			config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+
+			processor, err := NewTraefikMetricProcessor(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			points, err := processor.Process(jsonLogEntry(sampleLog()), PodConfig{Format: JSON}, 0, "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(points.Points()).To(HaveLen(1))
+
+			pt := points.Points()[0]
+			Expect(pt.Tags()).To(HaveKeyWithValue("status_class", "2xx"))
+			Expect(pt.Tags()).To(HaveKeyWithValue("slow", "false"))
+
+			fields, err := pt.Fields()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fields).To(HaveKeyWithValue("is_error", false))
+			Expect(fields).To(HaveKeyWithValue("duration_ms", 1.5))
+			Expect(fields).NotTo(HaveKey("slow"))
+		})
+
+		It("should not send values of fields which can't be computed", func() {
+			config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+			config.DerivedFields = append(config.DerivedFields, common.DerivedFieldConfig{Name: "weight", Expression: `request_method * 2`})
+
+			processor, err := NewTraefikMetricProcessor(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			spoofed := sampleLog()
+			spoofed["Weight"] = 1000
+			points, err := processor.Process(jsonLogEntry(spoofed), PodConfig{Format: JSON}, 0, "test")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(points.Points()).To(HaveLen(1))
+
+			fields, err := points.Points()[0].Fields()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fields).NotTo(HaveKey("weight"))
+			Expect(fields).To(HaveKeyWithValue("duration_ms", 1.5))
+		})
+
+		It("should be usable in rules", func() {
+			config.Rules = []common.RulesConfig{
+				{Id: "errors", FrontendRegexp: ".*", Conditions: map[string]string{"status_class": "^5"}, Sampling: 1},
+				{Id: "all", FrontendRegexp: ".*", Sampling: 1},
+			}
+
+			failed := sampleLog()
+			failed["OriginStatus"] = 503
+			Expect(process(jsonLogEntry(failed))[0]).To(HaveKeyWithValue("rule_id", "errors"))
+			Expect(process(jsonLogEntry(sampleLog()))[0]).To(HaveKeyWithValue("rule_id", "all"))
+		})
+
+		It("should reject invalid definitions", func() {
+			for _, derived := range []common.DerivedFieldConfig{
+				{Name: "broken", Expression: "1 +"},
+				{Expression: "1"},
+				{Name: "rule_id", Expression: `"x"`, Tag: true},
+				{Name: "is_error", Expression: "1"},
+			} {
+				config.DerivedFields = append(config.DerivedFields[:4:4], derived)
+				_, err := NewTraefikMetricProcessor(config)
+				Expect(err).To(HaveOccurred(), derived.Name)
+			}
+		})
+	})
+
+	Describe("rule conditions on Kubernetes metadata", func() {
+		It("should pick first rule matching the metadata", func() {
+			config.Rules = []common.RulesConfig{
+				{Id: "dev", FrontendRegexp: ".*", NamespaceRegexp: "^dev$", Sampling: 1},
+				{Id: "internal", FrontendRegexp: ".*", LabelSelector: "ingress-class=internal", Sampling: 1},
+				{Id: "other-dc", FrontendRegexp: ".*", DatacenterRegexp: "^res$", Sampling: 1},
+				{Id: "prod", FrontendRegexp: ".*", ClusterRegexp: "^prod$", HostRegexp: "^k8s-node-", LabelSelector: "app in (traefik)", Sampling: 1},
+			}
+
+			tags := process(jsonLogEntry(sampleLog()))
+			Expect(tags).To(HaveLen(1))
+			Expect(tags[0]).To(HaveKeyWithValue("rule_id", "prod"))
+		})
+
+		It("should skip entry when no rule matches", func() {
+			config.Rules = []common.RulesConfig{{Id: "dev", FrontendRegexp: ".*", ClusterRegexp: "^dev$", Sampling: 1}}
+
+			Expect(process(jsonLogEntry(sampleLog()))).To(BeEmpty())
+		})
+
+		It("should reject invalid conditions", func() {
+			config.Rules = []common.RulesConfig{{Id: "broken", FrontendRegexp: ".*", LabelSelector: "app in traefik"}}
+
+			_, err := NewTraefikMetricProcessor(config)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("rule conditions on log fields", func() {
+		It("should route bots to a separate rule", func() {
+			config.UserAgent = common.UserAgentConfig{Enabled: true}
+			config.Rules = []common.RulesConfig{
+				{Id: "bots", FrontendRegexp: ".*", Conditions: map[string]string{"ua_bot": "^true$"}, Sampling: 1},
+				{Id: "humans", FrontendRegexp: ".*", Sampling: 1},
+			}
+			config.Tags = []string{"ua_device"}
+
+			bot := sampleLog()
+			bot["request_User-Agent"] = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+			tags := process(jsonLogEntry(bot))
+			Expect(tags).To(HaveLen(1))
+			Expect(tags[0]).To(HaveKeyWithValue("rule_id", "bots"))
+			Expect(tags[0]).To(HaveKeyWithValue("ua_device", "bot"))
+
+			human := sampleLog()
+			human["request_User-Agent"] = "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:56.0) Gecko/20100101 Firefox/56.0"
+			tags = process(jsonLogEntry(human))
+			Expect(tags).To(HaveLen(1))
+			Expect(tags[0]).To(HaveKeyWithValue("rule_id", "humans"))
+			Expect(tags[0]).To(HaveKeyWithValue("ua_device", "desktop"))
+		})
+
+		It("should reject invalid conditions", func() {
+			config.Rules = []common.RulesConfig{{Id: "broken", FrontendRegexp: ".*", Conditions: map[string]string{"ua_bot": "("}}}
+
+			_, err := NewTraefikMetricProcessor(config)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
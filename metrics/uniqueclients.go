@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/hll"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+const (
+	DefaultAggregateMeasurement = "k8s_traefik_aggregates"
+	DefaultUniqueClientsField   = "client_host"
+)
+
+type frontendKey struct {
+	rule     string
+	frontend string
+}
+
+// UniqueClients estimates number of distinct clients (values of a field - client IP by default) of every
+// frontend per interval with HyperLogLog sketches, so no client data has to be stored. Estimates cover
+// only traffic of a single replica and can't be summed up - sketches are emitted to be merged instead.
+type UniqueClients struct {
+	sync.Mutex
+	measurement string
+	field       string
+	precision   uint8
+	emitSketch  bool
+	sketches    map[frontendKey]*hll.Sketch
+}
+
+// NewUniqueClients validates the config. It returns nil when counting is disabled.
+func NewUniqueClients(config common.AggregationConfig) (*UniqueClients, error) {
+	if !config.UniqueClients.Enabled {
+		return nil, nil
+	}
+
+	u := UniqueClients{
+		measurement: config.Measurement,
+		field:       config.UniqueClients.Field,
+		precision:   config.UniqueClients.Precision,
+		emitSketch:  config.UniqueClients.EmitSketch == nil || *config.UniqueClients.EmitSketch,
+		sketches:    map[frontendKey]*hll.Sketch{},
+	}
+
+	if len(u.measurement) == 0 {
+		u.measurement = DefaultAggregateMeasurement
+	}
+
+	if len(u.field) == 0 {
+		u.field = DefaultUniqueClientsField
+	}
+
+	if u.precision == 0 {
+		u.precision = hll.DefaultPrecision
+	}
+
+	// fail early on invalid precision
+	if _, err := hll.New(u.precision); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func (u *UniqueClients) Observe(o Observation) {
+	value, has := o.ClientValue(u.field)
+	if !has {
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	key := frontendKey{rule: o.Rule, frontend: o.Frontend()}
+	sketch, has := u.sketches[key]
+	if !has {
+		sketch, _ = hll.New(u.precision)
+		u.sketches[key] = sketch
+	}
+
+	sketch.AddString(value)
+}
+
+func (u *UniqueClients) Flush(now time.Time) []*client.Point {
+	u.Lock()
+	sketches := u.sketches
+	u.sketches = map[frontendKey]*hll.Sketch{}
+	u.Unlock()
+
+	points := []*client.Point{}
+	for key, sketch := range sketches {
+		tags := map[string]string{"rule_id": key.rule, "frontend_name": key.frontend}
+		fields := map[string]interface{}{"unique_clients": int64(sketch.Estimate())}
+
+		if u.emitSketch {
+			// sketches of many replicas (or intervals) can be merged later on, unlike the estimates
+			data, _ := sketch.MarshalBinary()
+			fields["unique_clients_sketch"] = base64.StdEncoding.EncodeToString(data)
+		}
+
+		pt, err := client.NewPoint(u.measurement, tags, fields, now)
+		if err != nil {
+			common.Log.WithError(err).WithField("tags", tags).Error("Could not create unique clients point")
+			continue
+		}
+		points = append(points, pt)
+	}
+
+	return points
+}
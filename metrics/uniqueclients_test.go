@@ -0,0 +1,110 @@
+package metrics_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/hll"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UniqueClients", func() {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	observe := func(u *UniqueClients, frontend string, clients int) {
+		for i := 0; i < clients; i++ {
+			u.Observe(Observation{Rule: "all", Format: JSON, Fields: map[string]interface{}{
+				"frontend_name":            frontend,
+				"client_host":              fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+				"request__x-forwarded-for": "10.1.1.1",
+			}})
+		}
+	}
+
+	It("should be disabled by default", func() {
+		u, err := NewUniqueClients(common.AggregationConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u).To(BeNil())
+	})
+
+	It("should reject invalid precision", func() {
+		_, err := NewUniqueClients(common.AggregationConfig{UniqueClients: common.UniqueClientsConfig{Enabled: true, Precision: 30}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should estimate unique clients per frontend", func() {
+		u, err := NewUniqueClients(common.AggregationConfig{UniqueClients: common.UniqueClientsConfig{Enabled: true}})
+		Expect(err).NotTo(HaveOccurred())
+
+		observe(u, "a", 1000)
+		observe(u, "a", 1000)
+		observe(u, "b", 10)
+
+		estimates := map[string]int64{}
+		for _, pt := range u.Flush(now) {
+			Expect(pt.Name()).To(Equal(DefaultAggregateMeasurement))
+			Expect(pt.Time()).To(Equal(now))
+
+			fields, err := pt.Fields()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fields).To(HaveKey("unique_clients_sketch"))
+			estimates[pt.Tags()["frontend_name"]] = fields["unique_clients"].(int64)
+		}
+
+		Expect(estimates).To(HaveLen(2))
+		Expect(estimates["a"]).To(BeNumerically("~", 1000, 50))
+		Expect(estimates["b"]).To(Equal(int64(10)))
+		Expect(u.Flush(now)).To(BeEmpty())
+	})
+
+	It("should count values of the configured field and emit mergeable sketches", func() {
+		u, err := NewUniqueClients(common.AggregationConfig{
+			Measurement:   "aggregates",
+			UniqueClients: common.UniqueClientsConfig{Enabled: true, Field: "request__x-forwarded-for", Precision: 10},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		observe(u, "a", 100)
+
+		points := u.Flush(now)
+		Expect(points).To(HaveLen(1))
+		Expect(points[0].Name()).To(Equal("aggregates"))
+
+		fields, err := points[0].Fields()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fields).To(HaveKeyWithValue("unique_clients", int64(1)))
+
+		data, err := base64.StdEncoding.DecodeString(fields["unique_clients_sketch"].(string))
+		Expect(err).NotTo(HaveOccurred())
+
+		sketch := &hll.Sketch{}
+		Expect(sketch.UnmarshalBinary(data)).To(Succeed())
+		Expect(sketch.Precision()).To(Equal(uint8(10)))
+
+		other, err := hll.New(10)
+		Expect(err).NotTo(HaveOccurred())
+		other.AddString("10.2.2.2")
+		Expect(sketch.Merge(other)).To(Succeed())
+		Expect(sketch.Estimate()).To(Equal(uint64(2)))
+	})
+
+	It("should send only estimates when sketches are disabled", func() {
+		disabled := false
+		u, err := NewUniqueClients(common.AggregationConfig{UniqueClients: common.UniqueClientsConfig{Enabled: true, EmitSketch: &disabled}})
+		Expect(err).NotTo(HaveOccurred())
+
+		observe(u, "a", 10)
+
+		points := u.Flush(now)
+		Expect(points).To(HaveLen(1))
+		fields, err := points[0].Fields()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fields).To(HaveKeyWithValue("unique_clients", int64(10)))
+		Expect(fields).NotTo(HaveKey("unique_clients_sketch"))
+	})
+})
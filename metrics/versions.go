@@ -0,0 +1,296 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+const (
+	DefaultVersionsMeasurement = "k8s_traefik_versions"
+	DefaultVersionsMinRequests = 20
+)
+
+// VersionStats describes traffic of one version of a backend in the last interval. Deltas against the baseline
+// version are set only when both versions had enough requests.
+type VersionStats struct {
+	Backend           string    `json:"backend_name"`
+	Version           string    `json:"version"`
+	Baseline          bool      `json:"baseline"`
+	BaselineVersion   string    `json:"baseline_version"`
+	Requests          int64     `json:"requests"`
+	ErrorRatio        float64   `json:"error_ratio"`
+	RetriesPerRequest float64   `json:"retries_per_request"`
+	LatencyP50        float64   `json:"latency_p50_ms"`
+	LatencyP95        float64   `json:"latency_p95_ms"`
+	LatencyP99        float64   `json:"latency_p99_ms"`
+	Compared          bool      `json:"compared"`
+	ErrorRatioDelta   float64   `json:"error_ratio_delta"`
+	LatencyP95Delta   float64   `json:"latency_p95_delta_ms"`
+	LatencyP99Delta   float64   `json:"latency_p99_delta_ms"`
+	Time              time.Time `json:"time"`
+}
+
+type versionKey struct {
+	backend string
+	version string
+}
+
+// Versions groups traffic of backends by their versions (i.e. old and new PODs during rollouts) and compares
+// every version with the baseline one
+type Versions struct {
+	sync.Mutex
+	measurement   string
+	field         string
+	backendURL    *regexp.Regexp
+	mapping       map[string]string
+	baseline      string
+	durationField string
+	minRequests   int64
+	stats         map[versionKey]*requestStats
+	last          []VersionStats
+}
+
+// NewVersions validates the config and registers `versions` stats endpoint with the last comparison.
+// It returns nil when version comparison is disabled.
+func NewVersions(config common.VersionsConfig) (*Versions, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	v := Versions{
+		measurement:   config.Measurement,
+		field:         config.Field,
+		mapping:       lowercaseKeys(config.Mapping),
+		baseline:      config.Baseline,
+		durationField: config.DurationField,
+		minRequests:   config.MinRequests,
+		stats:         map[versionKey]*requestStats{},
+		last:          []VersionStats{},
+	}
+
+	if len(config.BackendURLRegexp) > 0 {
+		var err error
+		if v.backendURL, err = regexp.Compile(config.BackendURLRegexp); err != nil {
+			return nil, fmt.Errorf("invalid backend URL regexp of versions: %s", err)
+		}
+
+		if v.backendURL.NumSubexp() < 1 {
+			return nil, fmt.Errorf("backend URL regexp of versions needs a group capturing the version")
+		}
+	}
+
+	if len(v.measurement) == 0 {
+		v.measurement = DefaultVersionsMeasurement
+	}
+
+	if len(v.durationField) == 0 {
+		v.durationField = "duration"
+	}
+
+	if v.minRequests == 0 {
+		v.minRequests = DefaultVersionsMinRequests
+	}
+
+	if v.minRequests < 0 {
+		return nil, fmt.Errorf("minimum of requests of versions can't be negative")
+	}
+
+	common.RegisterStatsProvider("versions", func() interface{} { return v.Last() })
+
+	return &v, nil
+}
+
+func lowercaseKeys(mapping map[string]string) map[string]string {
+	result := make(map[string]string, len(mapping))
+	for key, value := range mapping {
+		result[strings.ToLower(key)] = value
+	}
+
+	return result
+}
+
+// mappedVersion returns version of the longest pattern being a substring of the backend URL
+func mappedVersion(mapping map[string]string, backendURL string) (string, bool) {
+	version, longest := "", -1
+	for pattern, mapped := range mapping {
+		if len(pattern) > longest && strings.Contains(backendURL, strings.ToLower(pattern)) {
+			version, longest = mapped, len(pattern)
+		}
+	}
+
+	return version, longest >= 0
+}
+
+// version resolves version of the backend serving the request - from the configured field (i.e. a header),
+// mapping of backend URLs from POD annotation or the config and finally from the backend URL regexp
+func (v *Versions) version(o Observation) (string, bool) {
+	if len(v.field) > 0 {
+		if version, has := o.Value(v.field); has && len(version) > 0 {
+			return version, true
+		}
+	}
+
+	backendURL, has := o.Value("backend_url")
+	if !has {
+		return "", false
+	}
+	backendURL = strings.ToLower(backendURL)
+
+	if version, has := mappedVersion(o.Pod.Versions, backendURL); has {
+		return version, true
+	}
+
+	if version, has := mappedVersion(v.mapping, backendURL); has {
+		return version, true
+	}
+
+	if v.backendURL != nil {
+		if match := v.backendURL.FindStringSubmatch(backendURL); len(match) > 1 && len(match[1]) > 0 {
+			return match[1], true
+		}
+	}
+
+	return "", false
+}
+
+func (v *Versions) Observe(o Observation) {
+	version, has := v.version(o)
+	if !has {
+		return
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	key := versionKey{backend: o.Backend(), version: version}
+	stats, has := v.stats[key]
+	if !has {
+		stats = &requestStats{}
+		v.stats[key] = stats
+	}
+
+	stats.Add(o, v.durationField)
+}
+
+// Last returns comparison of versions from the last interval
+func (v *Versions) Last() []VersionStats {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.last
+}
+
+// baselineOf returns the configured baseline version when it has traffic, otherwise the busiest version
+func (v *Versions) baselineOf(versions map[string]*requestStats) string {
+	if _, has := versions[v.baseline]; has {
+		return v.baseline
+	}
+
+	baseline := ""
+	for version, stats := range versions {
+		if len(baseline) == 0 || stats.total > versions[baseline].total ||
+			(stats.total == versions[baseline].total && version < baseline) {
+			baseline = version
+		}
+	}
+
+	return baseline
+}
+
+func (v *Versions) Flush(now time.Time) []*client.Point {
+	v.Lock()
+	collected := v.stats
+	v.stats = map[versionKey]*requestStats{}
+	v.Unlock()
+
+	backends := map[string]map[string]*requestStats{}
+	for key, stats := range collected {
+		if _, has := backends[key.backend]; !has {
+			backends[key.backend] = map[string]*requestStats{}
+		}
+		backends[key.backend][key.version] = stats
+	}
+
+	comparison := []VersionStats{}
+	for backend, versions := range backends {
+		baseline := v.baselineOf(versions)
+		base := versions[baseline]
+
+		for version, stats := range versions {
+			current := VersionStats{
+				Backend:           backend,
+				Version:           version,
+				Baseline:          version == baseline,
+				BaselineVersion:   baseline,
+				Requests:          stats.total,
+				ErrorRatio:        stats.ErrorRatio(),
+				RetriesPerRequest: float64(stats.retries) / float64(stats.total),
+				LatencyP50:        stats.latency.Quantile(0.5),
+				LatencyP95:        stats.latency.Quantile(0.95),
+				LatencyP99:        stats.latency.Quantile(0.99),
+				Time:              now,
+			}
+
+			if !current.Baseline && stats.total >= v.minRequests && base.total >= v.minRequests {
+				current.Compared = true
+				current.ErrorRatioDelta = current.ErrorRatio - base.ErrorRatio()
+				current.LatencyP95Delta = current.LatencyP95 - base.latency.Quantile(0.95)
+				current.LatencyP99Delta = current.LatencyP99 - base.latency.Quantile(0.99)
+			}
+
+			comparison = append(comparison, current)
+		}
+	}
+
+	sort.Slice(comparison, func(i, j int) bool {
+		if comparison[i].Backend != comparison[j].Backend {
+			return comparison[i].Backend < comparison[j].Backend
+		}
+		return comparison[i].Version < comparison[j].Version
+	})
+
+	v.Lock()
+	v.last = comparison
+	v.Unlock()
+
+	points := []*client.Point{}
+	for _, current := range comparison {
+		tags := map[string]string{
+			"backend_name": current.Backend,
+			"version":      current.Version,
+			"baseline":     strconv.FormatBool(current.Baseline),
+		}
+		fields := map[string]interface{}{
+			"baseline_version":    current.BaselineVersion,
+			"requests":            current.Requests,
+			"error_ratio":         current.ErrorRatio,
+			"retries_per_request": current.RetriesPerRequest,
+			"latency_p50_ms":      current.LatencyP50,
+			"latency_p95_ms":      current.LatencyP95,
+			"latency_p99_ms":      current.LatencyP99,
+		}
+
+		if current.Compared {
+			fields["error_ratio_delta"] = current.ErrorRatioDelta
+			fields["latency_p95_delta_ms"] = current.LatencyP95Delta
+			fields["latency_p99_delta_ms"] = current.LatencyP99Delta
+		}
+
+		pt, err := client.NewPoint(v.measurement, tags, fields, now)
+		if err != nil {
+			common.Log.WithError(err).WithField("tags", tags).Error("Could not create versions point")
+			continue
+		}
+		points = append(points, pt)
+	}
+
+	return points
+}
@@ -0,0 +1,142 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Versions", func() {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	newVersions := func(config common.VersionsConfig) *Versions {
+		config.Enabled = true
+		versions, err := NewVersions(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(versions).NotTo(BeNil())
+		return versions
+	}
+
+	observe := func(versions *Versions, pod PodConfig, fields map[string]interface{}, count int) {
+		for i := 0; i < count; i++ {
+			versions.Observe(Observation{Rule: "all", Format: Combined, Time: now, Pod: pod, Fields: fields})
+		}
+	}
+
+	request := func(backendURL string, status, durationMs float64) map[string]interface{} {
+		return map[string]interface{}{
+			"backend_name":  "a",
+			"backend_url":   backendURL,
+			"origin_status": status,
+			"duration":      durationMs,
+		}
+	}
+
+	byVersion := func(versions *Versions) map[string]VersionStats {
+		result := map[string]VersionStats{}
+		for _, stats := range versions.Last() {
+			result[stats.Version] = stats
+		}
+		return result
+	}
+
+	It("should be disabled by default", func() {
+		versions, err := NewVersions(common.VersionsConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(versions).To(BeNil())
+	})
+
+	It("should reject invalid config", func() {
+		for _, config := range []common.VersionsConfig{
+			{Enabled: true, BackendURLRegexp: "("},
+			{Enabled: true, BackendURLRegexp: "canary"},
+			{Enabled: true, MinRequests: -1},
+		} {
+			_, err := NewVersions(config)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("should compare versions from backend URLs with the baseline", func() {
+		versions := newVersions(common.VersionsConfig{BackendURLRegexp: `^http://app-(v\d+)-`, Baseline: "v1"})
+		observe(versions, PodConfig{}, request("http://app-v1-abc:8080", 200, 100), 99)
+		observe(versions, PodConfig{}, request("http://app-v1-abc:8080", 500, 100), 1)
+		observe(versions, PodConfig{}, request("http://app-v2-def:8080", 200, 300), 45)
+		observe(versions, PodConfig{}, request("http://app-v2-def:8080", 502, 300), 5)
+		observe(versions, PodConfig{}, request("http://10.0.0.1:8080", 200, 100), 10)
+
+		points := versions.Flush(now)
+		Expect(points).To(HaveLen(2))
+		Expect(points[0].Name()).To(Equal(DefaultVersionsMeasurement))
+		Expect(points[0].Tags()).To(Equal(map[string]string{"backend_name": "a", "version": "v1", "baseline": "true"}))
+		Expect(points[1].Tags()).To(Equal(map[string]string{"backend_name": "a", "version": "v2", "baseline": "false"}))
+
+		fields, err := points[0].Fields()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fields).To(HaveKeyWithValue("requests", int64(100)))
+		Expect(fields).To(HaveKeyWithValue("error_ratio", 0.01))
+		Expect(fields).NotTo(HaveKey("error_ratio_delta"))
+
+		fields, err = points[1].Fields()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fields).To(HaveKeyWithValue("baseline_version", "v1"))
+		Expect(fields).To(HaveKeyWithValue("error_ratio", 0.1))
+		Expect(fields["error_ratio_delta"]).To(BeNumerically("~", 0.09, 1e-9))
+		Expect(fields["latency_p95_delta_ms"]).To(BeNumerically("~", 200, 20))
+	})
+
+	It("should prefer the field and the POD annotation over the config mapping", func() {
+		versions := newVersions(common.VersionsConfig{
+			Field:   "downstream__x-app-version",
+			Mapping: map[string]string{"10.0.0.": "stable", "10.0.0.9": "canary"},
+		})
+		withHeader := request("http://10.0.0.1:8080", 200, 100)
+		withHeader["downstream__x-app-version"] = "1.2.3"
+
+		observe(versions, PodConfig{}, request("http://10.0.0.1:8080", 200, 100), 30)
+		observe(versions, PodConfig{}, request("http://10.0.0.9:8080", 200, 100), 20)
+		observe(versions, PodConfig{}, withHeader, 5)
+		observe(versions, PodConfig{Versions: map[string]string{"10.0.0.9": "annotated"}}, request("http://10.0.0.9:8080", 500, 100), 20)
+		versions.Flush(now)
+
+		found := byVersion(versions)
+		Expect(found).To(HaveLen(4))
+		Expect(found["stable"].Requests).To(Equal(int64(30)))
+		Expect(found["canary"].Requests).To(Equal(int64(20)))
+		Expect(found["1.2.3"].Requests).To(Equal(int64(5)))
+		Expect(found["annotated"].ErrorRatio).To(Equal(1.0))
+
+		// the busiest version is the baseline when none is configured
+		Expect(found["stable"].Baseline).To(BeTrue())
+		Expect(found["canary"].BaselineVersion).To(Equal("stable"))
+		Expect(found["canary"].Compared).To(BeTrue())
+		Expect(found["1.2.3"].Compared).To(BeFalse())
+	})
+
+	It("should expose the comparison on the stats endpoint", func() {
+		versions := newVersions(common.VersionsConfig{Mapping: map[string]string{"canary": "new", "stable": "old"}})
+		observe(versions, PodConfig{}, request("http://stable-1:8080", 200, 100), 50)
+		observe(versions, PodConfig{}, request("http://canary-1:8080", 503, 100), 25)
+		versions.Flush(now)
+
+		recorder := httptest.NewRecorder()
+		common.HandleStatsProviders(recorder, httptest.NewRequest("GET", "/stats/versions", nil))
+		Expect(recorder.Code).To(Equal(200))
+
+		listed := []VersionStats{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &listed)).To(Succeed())
+		Expect(listed).To(HaveLen(2))
+		Expect(listed[0].Version).To(Equal("new"))
+		Expect(listed[0].ErrorRatioDelta).To(Equal(1.0))
+
+		// comparison is done again every interval
+		versions.Flush(now.Add(time.Minute))
+		Expect(versions.Last()).To(BeEmpty())
+	})
+})
@@ -1,14 +1,127 @@
 package model
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
 
 type DockerMeta struct {
 	ContainerId string `json:"container_id"`
 }
 
+const (
+	// AnnotationV1 is the legacy annotation format with single container
+	AnnotationV1 = 1
+	// AnnotationV2 supports multiple containers and per pod overrides
+	AnnotationV2 = 2
+)
+
+// ContainerMetricsConfig describes a single container producing Traefik logs
+type ContainerMetricsConfig struct {
+	Name        string `mapstructure:"name"`
+	MetricsType string `mapstructure:"type"`
+}
+
+// GenericInfluxAnnotation is the metrics config POD provides in its annotation.
+//
+// Version 1 (default when version is omitted) supports only a single container described by
+// container_name and type. Version 2 uses a list of containers and allows overriding sampling,
+// adding extra tags, limiting fields sent for a POD and mapping backend URLs to versions.
 type GenericInfluxAnnotation struct {
-	ContainerName string `mapstructure:"container_name"`
-	MetricsType   string `mapstructure:"type"`
+	Version       int                      `mapstructure:"version"`
+	ContainerName string                   `mapstructure:"container_name"`
+	MetricsType   string                   `mapstructure:"type"`
+	Containers    []ContainerMetricsConfig `mapstructure:"containers"`
+	Sampling      *float64                 `mapstructure:"sampling"`
+	Tags          map[string]string        `mapstructure:"tags"`
+	Fields        []string                 `mapstructure:"fields"`
+	Versions      map[string]string        `mapstructure:"versions"`
+}
+
+// Normalize converts legacy annotation into the current format and validates it. All problems found
+// are reported in a single error. Container types are checked against the given list of formats and
+// extra tags must not overwrite any of the reserved ones.
+func (a *GenericInfluxAnnotation) Normalize(formats []string, reservedTags []string) error {
+	problems := []string{}
+
+	switch a.Version {
+	case 0, AnnotationV1:
+		a.Version = AnnotationV1
+		if len(a.Containers) > 0 || a.Sampling != nil || len(a.Tags) > 0 || len(a.Fields) > 0 || len(a.Versions) > 0 {
+			problems = append(problems, "containers, sampling, tags, fields and versions require version 2")
+		}
+		a.Containers = []ContainerMetricsConfig{{Name: a.ContainerName, MetricsType: a.MetricsType}}
+	case AnnotationV2:
+		if len(a.ContainerName) > 0 || len(a.MetricsType) > 0 {
+			problems = append(problems, "container_name and type are not supported in version 2 - use containers")
+		}
+		if len(a.Containers) == 0 {
+			problems = append(problems, "no containers defined")
+		}
+	default:
+		return fmt.Errorf("unsupported annotation version: %d", a.Version)
+	}
+
+	names := map[string]bool{}
+	for idx, container := range a.Containers {
+		if len(container.Name) == 0 {
+			problems = append(problems, fmt.Sprintf("containers[%d]: name is empty", idx))
+		} else if names[container.Name] {
+			problems = append(problems, fmt.Sprintf("containers[%d]: duplicated container %q", idx, container.Name))
+		}
+		names[container.Name] = true
+
+		if !contains(formats, container.MetricsType) {
+			problems = append(problems, fmt.Sprintf("containers[%d]: unknown log format %q", idx, container.MetricsType))
+		}
+	}
+
+	if a.Sampling != nil && (*a.Sampling < 0 || *a.Sampling > 1) {
+		problems = append(problems, fmt.Sprintf("sampling must be within [0, 1] (got %g)", *a.Sampling))
+	}
+
+	for key := range a.Tags {
+		if len(key) == 0 {
+			problems = append(problems, "tag name is empty")
+		} else if contains(reservedTags, key) {
+			problems = append(problems, fmt.Sprintf("tag %q is reserved", key))
+		}
+	}
+
+	for pattern, version := range a.Versions {
+		if len(pattern) == 0 || len(version) == 0 {
+			problems = append(problems, "backend URL patterns and versions can't be empty")
+			break
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid annotation (version %d): %s", a.Version, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Container returns config for a given container if it is configured for metrics
+func (a *GenericInfluxAnnotation) Container(name string) (ContainerMetricsConfig, bool) {
+	for _, container := range a.Containers {
+		if container.Name == name {
+			return container, true
+		}
+	}
+
+	return ContainerMetricsConfig{}, false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
 }
 
 type KubernetesMeta struct {
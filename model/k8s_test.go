@@ -0,0 +1,72 @@
+package model_test
+
+import (
+	. "github.com/Wikia/nsq-traefik-consumer/model"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GenericInfluxAnnotation", func() {
+	formats := []string{"combined", "json"}
+	reserved := []string{"frontend_name"}
+
+	It("should convert legacy annotation", func() {
+		annotation := GenericInfluxAnnotation{ContainerName: "traefik", MetricsType: "json"}
+
+		Expect(annotation.Normalize(formats, reserved)).To(Succeed())
+		Expect(annotation.Version).To(Equal(AnnotationV1))
+		Expect(annotation.Containers).To(Equal([]ContainerMetricsConfig{{Name: "traefik", MetricsType: "json"}}))
+
+		_, has := annotation.Container("traefik")
+		Expect(has).To(BeTrue())
+		_, has = annotation.Container("sidecar")
+		Expect(has).To(BeFalse())
+	})
+
+	It("should accept version 2 with multiple containers", func() {
+		sampling := 0.1
+		annotation := GenericInfluxAnnotation{
+			Version:    AnnotationV2,
+			Containers: []ContainerMetricsConfig{{Name: "public", MetricsType: "json"}, {Name: "internal", MetricsType: "combined"}},
+			Sampling:   &sampling,
+			Tags:       map[string]string{"team": "platform"},
+			Fields:     []string{"duration"},
+			Versions:   map[string]string{"canary": "v2"},
+		}
+
+		Expect(annotation.Normalize(formats, reserved)).To(Succeed())
+
+		container, has := annotation.Container("internal")
+		Expect(has).To(BeTrue())
+		Expect(container.MetricsType).To(Equal("combined"))
+	})
+
+	It("should report all problems at once", func() {
+		sampling := 1.5
+		annotation := GenericInfluxAnnotation{
+			Version:    AnnotationV2,
+			Containers: []ContainerMetricsConfig{{Name: "a", MetricsType: "json"}, {Name: "a", MetricsType: "xml"}, {MetricsType: "json"}},
+			Sampling:   &sampling,
+			Tags:       map[string]string{"frontend_name": "x"},
+			Versions:   map[string]string{"canary": ""},
+		}
+
+		err := annotation.Normalize(formats, reserved)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`containers[1]: duplicated container "a"`))
+		Expect(err.Error()).To(ContainSubstring(`containers[1]: unknown log format "xml"`))
+		Expect(err.Error()).To(ContainSubstring(`containers[2]: name is empty`))
+		Expect(err.Error()).To(ContainSubstring(`sampling must be within [0, 1]`))
+		Expect(err.Error()).To(ContainSubstring(`tag "frontend_name" is reserved`))
+		Expect(err.Error()).To(ContainSubstring(`backend URL patterns and versions can't be empty`))
+	})
+
+	It("should reject version 2 options in legacy annotation", func() {
+		annotation := GenericInfluxAnnotation{ContainerName: "traefik", MetricsType: "json", Fields: []string{"duration"}}
+		Expect(annotation.Normalize(formats, reserved)).NotTo(Succeed())
+
+		annotation = GenericInfluxAnnotation{Version: 3}
+		Expect(annotation.Normalize(formats, reserved)).NotTo(Succeed())
+	})
+})
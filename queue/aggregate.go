@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	metrics "github.com/Wikia/nsq-traefik-consumer/metrics"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// runAggregation periodically pushes points emitted by aggregators of the processor to the buffer
+func runAggregation(processor *metrics.TraefikMetricProcessor, interval time.Duration, metricsBuffer *MetricsBuffer) {
+	if interval <= 0 {
+		interval = metrics.DefaultAggregationInterval
+	}
+
+	go func() {
+		for {
+			<-time.After(interval)
+			if err := flushAggregates(processor, metricsBuffer, time.Now()); err != nil {
+				common.Log.WithError(err).Error("Error flushing aggregates")
+			}
+		}
+	}()
+}
+
+func flushAggregates(processor *metrics.TraefikMetricProcessor, metricsBuffer *MetricsBuffer, now time.Time) error {
+	points := processor.Flush(now)
+	if len(points) == 0 {
+		return nil
+	}
+
+	batch, err := client.NewBatchPoints(client.BatchPointsConfig{})
+	if err != nil {
+		return err
+	}
+	batch.AddPoints(points)
+
+	metricsBuffer.Lock()
+	metricsBuffer.Metrics.PushBack(batch)
+	metricsBuffer.Unlock()
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/metrics"
+	"github.com/Wikia/nsq-traefik-consumer/model"
+	"github.com/mitchellh/mapstructure"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+const (
+	metricsAnnotationKey = "influx_metrics"
+
+	DefaultAnnotationCacheSize = 1024
+)
+
+var errNoMetricsConfig = fmt.Errorf("no metrics config found in annotation")
+
+type annotationCacheKey struct {
+	podId string
+	hash  uint64
+}
+
+type annotationCacheEntry struct {
+	config *model.GenericInfluxAnnotation
+	err    error
+}
+
+// annotationCache keeps parsed pod annotations so they are not decoded for every log line.
+// Broken annotations are cached as well so they are reported only once per pod.
+type annotationCache struct {
+	cache  *common.LRUCache
+	hits   stats.Counter
+	misses stats.Counter
+	errors stats.Counter
+}
+
+func newAnnotationCache(size int) *annotationCache {
+	if size <= 0 {
+		size = DefaultAnnotationCacheSize
+	}
+
+	return &annotationCache{
+		cache:  common.NewLRUCache(size),
+		hits:   stats.GetOrRegisterCounter("annotation_cache_hits", stats.DefaultRegistry),
+		misses: stats.GetOrRegisterCounter("annotation_cache_misses", stats.DefaultRegistry),
+		errors: stats.GetOrRegisterCounter("annotation_errors", stats.DefaultRegistry),
+	}
+}
+
+// Get returns metrics config from the annotation found in a message envelope
+func (ac *annotationCache) Get(env *envelope) (*model.GenericInfluxAnnotation, error) {
+	key := annotationCacheKey{podId: string(env.PodId), hash: hashBytes(env.Annotation)}
+
+	if cached, has := ac.cache.Get(key); has {
+		ac.hits.Inc(1)
+		entry := cached.(annotationCacheEntry)
+		return entry.config, entry.err
+	}
+
+	ac.misses.Inc(1)
+	config, err := parseAnnotation(env)
+	if err == errNoMetricsConfig {
+		common.Log.WithField("pod_id", key.podId).Info("Skipping messages from pod - no metrics config found")
+	} else if err != nil {
+		ac.errors.Inc(1)
+		common.Log.WithError(err).WithFields(log.Fields{
+			"pod_id":     key.podId,
+			"annotation": string(env.Annotation),
+		}).Error("Invalid pod annotation - skipping messages from this pod")
+	}
+
+	ac.cache.Add(key, annotationCacheEntry{config: config, err: err})
+
+	return config, err
+}
+
+func parseAnnotation(env *envelope) (*model.GenericInfluxAnnotation, error) {
+	value, err := env.AnnotationValue()
+	if err != nil {
+		return nil, fmt.Errorf("error getting annotation: %s", err)
+	}
+
+	var wikiaConfig map[string]interface{}
+	err = json.Unmarshal([]byte(value), &wikiaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling pod config: %s", err)
+	}
+
+	influxConfig, has := wikiaConfig[metricsAnnotationKey]
+	if !has {
+		return nil, errNoMetricsConfig
+	}
+
+	annotationConfig := model.GenericInfluxAnnotation{}
+	err = mapstructure.Decode(influxConfig, &annotationConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal metrics config: %s", err)
+	}
+
+	err = annotationConfig.Normalize(metrics.SupportedFormats, metrics.ReservedTags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &annotationConfig, nil
+}
+
+// hashBytes calculates FNV-1a hash without allocating
+func hashBytes(data []byte) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+
+	hash := uint64(offset64)
+	for _, c := range data {
+		hash ^= uint64(c)
+		hash *= prime64
+	}
+
+	return hash
+}
@@ -0,0 +1,75 @@
+package queue
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("annotationCache", func() {
+	var cache *annotationCache
+
+	BeforeEach(func() {
+		cache = newAnnotationCache(2)
+		cache.hits.Clear()
+		cache.misses.Clear()
+	})
+
+	It("should parse annotation only once per pod", func() {
+		var env envelope
+		Expect(scanEnvelope([]byte(traefikMessage), "wikia_com/keys", &env)).To(Succeed())
+
+		for i := 0; i < 3; i++ {
+			config, err := cache.Get(&env)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.ContainerName).To(Equal("traefik"))
+			Expect(config.MetricsType).To(Equal("access_log_as_json"))
+		}
+
+		Expect(cache.misses.Count()).To(BeEquivalentTo(1))
+		Expect(cache.hits.Count()).To(BeEquivalentTo(2))
+	})
+
+	It("should reparse annotation when it changes", func() {
+		env := envelope{PodId: []byte("pod"), Annotation: []byte(`"{\"influx_metrics\":{\"container_name\":\"a\",\"type\":\"access_log_combined\"}}"`)}
+		config, _ := cache.Get(&env)
+		Expect(config.ContainerName).To(Equal("a"))
+
+		env.Annotation = []byte(`"{\"influx_metrics\":{\"container_name\":\"b\",\"type\":\"access_log_combined\"}}"`)
+		config, _ = cache.Get(&env)
+		Expect(config.ContainerName).To(Equal("b"))
+		Expect(cache.misses.Count()).To(BeEquivalentTo(2))
+	})
+
+	It("should understand version 2 of the annotation", func() {
+		env := envelope{PodId: []byte("pod"), Annotation: []byte(`"{\"influx_metrics\":{\"version\":2,\"sampling\":0.5,\"tags\":{\"team\":\"x\"},` +
+			`\"containers\":[{\"name\":\"a\",\"type\":\"access_log_combined\"},{\"name\":\"b\",\"type\":\"access_log_as_json\"}]}}"`)}
+
+		config, err := cache.Get(&env)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*config.Sampling).To(Equal(0.5))
+		Expect(config.Tags).To(HaveKeyWithValue("team", "x"))
+
+		container, has := config.Container("b")
+		Expect(has).To(BeTrue())
+		Expect(container.MetricsType).To(Equal("access_log_as_json"))
+	})
+
+	It("should cache broken annotations", func() {
+		env := envelope{PodId: []byte("pod"), Annotation: []byte(`"{\"influx_metrics\": 42"`)}
+
+		_, err := cache.Get(&env)
+		Expect(err).To(HaveOccurred())
+		_, err = cache.Get(&env)
+		Expect(err).To(HaveOccurred())
+
+		Expect(cache.misses.Count()).To(BeEquivalentTo(1))
+		Expect(cache.hits.Count()).To(BeEquivalentTo(1))
+	})
+
+	It("should report missing metrics config", func() {
+		env := envelope{PodId: []byte("pod"), Annotation: []byte(`"{\"other_key\":{}}"`)}
+
+		_, err := cache.Get(&env)
+		Expect(err).To(Equal(errNoMetricsConfig))
+	})
+})
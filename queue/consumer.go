@@ -15,7 +15,6 @@ import (
 	"github.com/Wikia/nsq-traefik-consumer/common"
 	metrics "github.com/Wikia/nsq-traefik-consumer/metrics"
 	"github.com/Wikia/nsq-traefik-consumer/model"
-	"github.com/mitchellh/mapstructure"
 	"github.com/nsqio/go-nsq"
 	stats "github.com/rcrowley/go-metrics"
 )
@@ -36,80 +35,94 @@ func NewConsumer(config common.NsqConfig) (*nsq.Consumer, error) {
 	return consumer, nil
 }
 
-func metricsProcessor(k8sConfig common.KubernetesConfig, measurement string, metricsConfig []common.RulesConfig, fields []string, metricsBuffer *MetricsBuffer) nsq.HandlerFunc {
-	processor, err := metrics.NewTraefikMetricProcessor(metricsConfig, fields)
+func metricsProcessor(config common.Config, processor *metrics.TraefikMetricProcessor, metricsBuffer *MetricsBuffer, deadLetters *deadLetterQueue) nsq.HandlerFunc {
+	runAggregation(processor, config.Aggregation.Interval, metricsBuffer)
 
+	gauge := stats.GetOrRegisterGauge("buffer_size", stats.DefaultRegistry)
+	counter := stats.GetOrRegisterCounter("logs_consumed", stats.DefaultRegistry)
+	skipped := stats.GetOrRegisterCounter("logs_skipped", stats.DefaultRegistry)
+	annotations := newAnnotationCache(config.Kubernetes.AnnotationCacheSize)
+
+	dedup, err := newDeduplicator(config.Deduplication)
 	if err != nil {
-		common.Log.WithError(err).Panic("Could not create metric processor")
+		common.Log.WithError(err).Panic("Could not create deduplicator")
 	}
 
-	gauge := stats.GetOrRegisterGauge("buffer_size", stats.DefaultRegistry)
-
 	return func(message *nsq.Message) error {
-		common.Log.WithField("message_id", string(message.ID[:nsq.MsgIDLength])).Info("Got a message")
-		entry := model.LogEntry{}
-		err := json.Unmarshal(message.Body, &entry)
-		if err != nil {
-			common.Log.WithError(err).WithField("body", string(message.Body)).Errorf("Error unmarshaling message")
-		} else {
-			entry.Log = strings.TrimSpace(entry.Log)
-			value, has := entry.Kubernetes.Annotations[k8sConfig.AnnotationKey]
-			if err != nil {
-				common.Log.WithError(err).Errorf("Error getting annotation")
-				return nil
-			}
-
-			if !has || len(value) == 0 {
-				common.Log.Debug("Skipping message - no proper annotation found")
-				return nil
-			}
-
-			var wikiaConfig map[string]interface{}
+		if log.GetLevel() >= log.DebugLevel {
+			common.Log.WithField("message_id", string(message.ID[:nsq.MsgIDLength])).Debug("Got a message")
+		}
 
-			err = json.Unmarshal([]byte(value), &wikiaConfig)
+		// fast path - most of the messages are not coming from Traefik so we reject them
+		// before decoding whole message
+		var env envelope
+		err := scanEnvelope(message.Body, config.Kubernetes.AnnotationKey, &env)
+		if err != nil {
+			deadLetters.Reject(message, reasonInvalidMessage, err)
+			return nil
+		}
 
-			if err != nil {
-				common.Log.WithError(err).WithField("value", string(value)).Error("Error unmarshaling pod config")
-				return nil
-			}
+		if !env.HasMetricsConfig() || len(env.ContainerName) == 0 {
+			skipped.Inc(1)
+			return nil
+		}
 
-			influxConfig, has := wikiaConfig["influx_metrics"]
-			if !has {
-				common.Log.WithField("annotation", value).Info("Skipping message - no metrics config found")
-				return nil
-			}
+		annotationConfig, err := annotations.Get(&env)
+		if err == errNoMetricsConfig {
+			skipped.Inc(1)
+			return nil
+		} else if err != nil {
+			deadLetters.Reject(message, reasonInvalidAnnotation, err)
+			return nil
+		}
 
-			var annotationConfig model.GenericInfluxAnnotation
-			err = mapstructure.Decode(influxConfig, &annotationConfig)
+		containerName := unescape(env.ContainerName)
+		container, has := annotationConfig.Container(containerName)
+		if !has {
+			common.Log.WithField("container_name", containerName).Debug("Skipping message - container not configured for metrics")
+			skipped.Inc(1)
+			return nil
+		}
 
-			if err != nil {
-				common.Log.WithError(err).Error("Could not unmarshal metrics config")
-				return nil
-			}
+		entry := model.LogEntry{}
+		err = json.Unmarshal(message.Body, &entry)
+		if err != nil {
+			deadLetters.Reject(message, reasonInvalidMessage, err)
+			return nil
+		}
+		entry.Log = strings.TrimSpace(entry.Log)
 
-			if entry.Kubernetes.ContainerName != annotationConfig.ContainerName {
-				common.Log.WithField("container_name", entry.Kubernetes.ContainerName).Info("Skipping message - container not configured for metrics")
-				return nil
-			}
+		if dedup != nil && dedup.IsDuplicate(message, &entry) {
+			common.Log.WithField("pod_id", entry.Kubernetes.PodId).Debug("Skipping duplicated message")
+			return nil
+		}
 
-			processedMetrics, err := processor.Process(entry, annotationConfig.MetricsType, message.Timestamp, measurement)
+		podConfig := metrics.PodConfig{
+			Format:   container.MetricsType,
+			Sampling: annotationConfig.Sampling,
+			Tags:     annotationConfig.Tags,
+			Fields:   annotationConfig.Fields,
+			Versions: annotationConfig.Versions,
+		}
+		processedMetrics, err := processor.Process(entry, podConfig, message.Timestamp, config.InfluxDB.Measurement)
 
-			if err != nil {
-				common.Log.WithError(err).Error("Error processing metrics")
-				return nil
-			} else if len(processedMetrics.Points()) == 0 {
-				return nil
+		if err != nil {
+			reason := reasonProcessingError
+			if processingErr, ok := err.(*metrics.ProcessingError); ok {
+				reason = processingErr.Reason
 			}
-
-			counter := stats.GetOrRegisterCounter("logs_consumed", stats.DefaultRegistry)
-			metricsBuffer.Lock()
-			metricsBuffer.Metrics.PushBack(processedMetrics)
-			metricsBuffer.Unlock()
-			counter.Inc(int64(len(processedMetrics.Points())))
-			gauge.Update(int64(metricsBuffer.Metrics.Len()))
-
+			deadLetters.Reject(message, reason, err)
+			return nil
+		} else if len(processedMetrics.Points()) == 0 {
+			return nil
 		}
 
+		metricsBuffer.Lock()
+		metricsBuffer.Metrics.PushBack(processedMetrics)
+		metricsBuffer.Unlock()
+		counter.Inc(int64(len(processedMetrics.Points())))
+		gauge.Update(int64(metricsBuffer.Metrics.Len()))
+
 		return nil
 	}
 }
@@ -132,7 +145,19 @@ func Consume(config common.Config, metricsBuffer *MetricsBuffer) error {
 		return err
 	}
 
-	consumer.AddHandler(metricsProcessor(config.Kubernetes, config.InfluxDB.Measurement, config.Rules, config.Fields, metricsBuffer))
+	deadLetters, err := newDeadLetterQueue(config.DeadLetter)
+	if err != nil {
+		return err
+	}
+	defer deadLetters.Close()
+
+	processor, err := metrics.NewTraefikMetricProcessor(config)
+	if err != nil {
+		return err
+	}
+	defer processor.Close()
+
+	consumer.AddHandler(metricsProcessor(config, processor, metricsBuffer, deadLetters))
 
 	err = consumer.ConnectToNSQLookupds(config.Nsq.Addresses)
 	if err != nil {
@@ -0,0 +1,262 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/nsqio/go-nsq"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+const (
+	DeadLetterNsq  = "nsq"
+	DeadLetterFile = "file"
+
+	DefaultDeadLetterMaxFileSize = 100 << 20
+	DefaultDeadLetterMaxFiles    = 5
+	DefaultDeadLetterLogInterval = 10 * time.Second
+
+	reasonInvalidMessage    = "invalid_message"
+	reasonInvalidAnnotation = "invalid_annotation"
+	reasonProcessingError   = "processing_error"
+)
+
+// deadLetter is stored for every message which could not be processed, so it can be processed again later
+type deadLetter struct {
+	Time      time.Time `json:"time"`
+	Reason    string    `json:"reason"`
+	Error     string    `json:"error"`
+	MessageId string    `json:"message_id"`
+	Body      string    `json:"body"`
+}
+
+type deadLetterOutput interface {
+	Write(record []byte) error
+	Close() error
+}
+
+// deadLetterQueue counts, logs (with rate limiting) and stores messages which could not be processed
+type deadLetterQueue struct {
+	output      deadLetterOutput
+	limiter     *common.LogLimiter
+	writeErrors stats.Counter
+}
+
+func newDeadLetterQueue(config common.DeadLetterConfig) (*deadLetterQueue, error) {
+	interval := config.LogInterval
+	if interval <= 0 {
+		interval = DefaultDeadLetterLogInterval
+	}
+
+	q := deadLetterQueue{
+		limiter:     common.NewLogLimiter(interval),
+		writeErrors: stats.GetOrRegisterCounter("dead_letter_write_errors", stats.DefaultRegistry),
+	}
+
+	var err error
+	switch config.Output {
+	case "":
+	case DeadLetterNsq:
+		q.output, err = newNsqDeadLetterOutput(config.NsqdAddress, config.Topic)
+	case DeadLetterFile:
+		q.output, err = openFileDeadLetterOutput(config.Path, config.MaxFileSize, config.MaxFiles)
+	default:
+		err = fmt.Errorf("unknown dead letter output: %s", config.Output)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &q, nil
+}
+
+// Reject handles message which could not be processed for the given reason
+func (q *deadLetterQueue) Reject(message *nsq.Message, reason string, err error) {
+	stats.GetOrRegisterCounter("failed_messages_"+reason, stats.DefaultRegistry).Inc(1)
+
+	if allowed, suppressed := q.limiter.Allow(reason); allowed {
+		// body holds unredacted request headers (cookies, tokens), so only its hash is logged
+		digest := sha256.Sum256(message.Body)
+		common.Log.WithError(err).WithFields(log.Fields{
+			"reason":      reason,
+			"suppressed":  suppressed,
+			"message_id":  string(message.ID[:]),
+			"body_size":   len(message.Body),
+			"body_sha256": hex.EncodeToString(digest[:]),
+		}).Error("Could not process message")
+	}
+
+	if q.output == nil {
+		return
+	}
+
+	record, _ := json.Marshal(deadLetter{
+		Time:      time.Now().UTC(),
+		Reason:    reason,
+		Error:     err.Error(),
+		MessageId: string(message.ID[:]),
+		Body:      string(message.Body),
+	})
+
+	if err := q.output.Write(append(record, '\n')); err != nil {
+		q.writeErrors.Inc(1)
+		if allowed, _ := q.limiter.Allow("dead_letter_write"); allowed {
+			common.Log.WithError(err).Error("Could not store dead letter")
+		}
+	}
+}
+
+// Close flushes and closes the output
+func (q *deadLetterQueue) Close() error {
+	if q.output == nil {
+		return nil
+	}
+
+	return q.output.Close()
+}
+
+// nsqDeadLetterOutput publishes dead letters to a separate NSQ topic
+type nsqDeadLetterOutput struct {
+	producer *nsq.Producer
+	topic    string
+}
+
+func newNsqDeadLetterOutput(address, topic string) (*nsqDeadLetterOutput, error) {
+	if len(address) == 0 || len(topic) == 0 {
+		return nil, fmt.Errorf("nsqd address and topic are required for dead letters")
+	}
+
+	producer, err := nsq.NewProducer(address, nsq.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	logger, level := common.NewNSQLogrusLoggerAtLevel(log.GetLevel())
+	producer.SetLogger(logger, level)
+
+	return &nsqDeadLetterOutput{producer: producer, topic: topic}, nil
+}
+
+func (o *nsqDeadLetterOutput) Write(record []byte) error {
+	return o.producer.Publish(o.topic, record)
+}
+
+func (o *nsqDeadLetterOutput) Close() error {
+	o.producer.Stop()
+	return nil
+}
+
+// fileDeadLetterOutput writes dead letters as JSON lines to a local file rotated when it gets too big.
+// Rotated files get numeric suffixes (.1 being the newest one).
+type fileDeadLetterOutput struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openFileDeadLetterOutput(path string, maxSize int64, maxFiles int) (*fileDeadLetterOutput, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("path is required for dead letters")
+	}
+
+	if maxSize <= 0 {
+		maxSize = DefaultDeadLetterMaxFileSize
+	}
+
+	if maxFiles <= 0 {
+		maxFiles = DefaultDeadLetterMaxFiles
+	}
+
+	o := fileDeadLetterOutput{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := o.open(); err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+func (o *fileDeadLetterOutput) open() error {
+	file, err := os.OpenFile(o.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	o.file = file
+	o.size = info.Size()
+
+	return nil
+}
+
+func (o *fileDeadLetterOutput) rotate() error {
+	if err := o.file.Close(); err != nil {
+		return err
+	}
+
+	for i := o.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", o.path, i), fmt.Sprintf("%s.%d", o.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(o.path, o.path+".1"); err != nil {
+		return err
+	}
+
+	return o.open()
+}
+
+func (o *fileDeadLetterOutput) Write(record []byte) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.file == nil {
+		// reopen after failed rotation
+		if err := o.open(); err != nil {
+			return err
+		}
+	}
+
+	if o.size > 0 && o.size+int64(len(record)) > o.maxSize {
+		if err := o.rotate(); err != nil {
+			o.file = nil
+			return err
+		}
+	}
+
+	n, err := o.file.Write(record)
+	o.size += int64(n)
+
+	return err
+}
+
+func (o *fileDeadLetterOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.file == nil {
+		return nil
+	}
+
+	err := o.file.Close()
+	o.file = nil
+
+	return err
+}
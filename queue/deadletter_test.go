@@ -0,0 +1,131 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/metrics"
+	"github.com/nsqio/go-nsq"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("deadLetterQueue", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "dead-letters")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	readDeadLetters := func(path string) []deadLetter {
+		file, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		letters := []deadLetter{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			letter := deadLetter{}
+			Expect(json.Unmarshal(scanner.Bytes(), &letter)).To(Succeed())
+			letters = append(letters, letter)
+		}
+
+		return letters
+	}
+
+	It("should store failed messages with the reason", func() {
+		path := filepath.Join(dir, "dead.jsonl")
+		deadLetters, err := newDeadLetterQueue(common.DeadLetterConfig{Output: DeadLetterFile, Path: path})
+		Expect(err).NotTo(HaveOccurred())
+
+		config := common.NewConfig()
+		config.Kubernetes.AnnotationKey = "wikia_com/keys"
+		config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+		processor, err := metrics.NewTraefikMetricProcessor(config)
+		Expect(err).NotTo(HaveOccurred())
+		handler := metricsProcessor(config, processor, NewMetricsBuffer(), deadLetters)
+
+		messages := map[string]string{
+			reasonInvalidMessage:    `{"kubernetes": {"container_name": "traefik"`,
+			reasonInvalidAnnotation: strings.Replace(traefikMessage, `access_log_as_json`, `unknown`, 1),
+			"invalid_log":           strings.Replace(traefikMessage, `{\"FrontendName\"`, `{broken`, 1),
+		}
+
+		for _, body := range messages {
+			Expect(handler(nsq.NewMessage(nsq.MessageID{'1'}, []byte(body)))).To(Succeed())
+		}
+		Expect(handler(nsq.NewMessage(nsq.MessageID{'2'}, []byte(otherMessage)))).To(Succeed())
+		Expect(deadLetters.Close()).To(Succeed())
+
+		letters := readDeadLetters(path)
+		Expect(letters).To(HaveLen(len(messages)))
+		for _, letter := range letters {
+			Expect(messages).To(HaveKeyWithValue(letter.Reason, letter.Body))
+			Expect(letter.Error).NotTo(BeEmpty())
+			Expect(letter.MessageId).To(HavePrefix("1"))
+		}
+	})
+
+	It("should not log bodies of failed messages", func() {
+		logs := &bytes.Buffer{}
+		out := common.Log.Logger.Out
+		common.Log.Logger.Out = logs
+		defer func() { common.Log.Logger.Out = out }()
+
+		deadLetters, err := newDeadLetterQueue(common.DeadLetterConfig{})
+		Expect(err).NotTo(HaveOccurred())
+
+		body := `{"log": "{\"RequestAuthorization\": \"Bearer secret-token\"`
+		deadLetters.Reject(nsq.NewMessage(nsq.MessageID{'1'}, []byte(body)), reasonInvalidMessage, fmt.Errorf("unexpected end of JSON input"))
+
+		Expect(logs.String()).To(ContainSubstring("Could not process message"))
+		Expect(logs.String()).To(ContainSubstring("body_sha256"))
+		Expect(logs.String()).NotTo(ContainSubstring("secret-token"))
+	})
+
+	It("should rotate files", func() {
+		path := filepath.Join(dir, "dead.jsonl")
+		output, err := openFileDeadLetterOutput(path, 100, 2)
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 10; i++ {
+			Expect(output.Write([]byte(fmt.Sprintf("%s %d\n", strings.Repeat("x", 40), i)))).To(Succeed())
+		}
+		Expect(output.Close()).To(Succeed())
+
+		files, err := filepath.Glob(path + "*")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(ConsistOf(path, path+".1", path+".2"))
+
+		for _, file := range files {
+			info, err := os.Stat(file)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Size()).To(BeNumerically("<=", 100))
+		}
+
+		newest, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(newest)).To(HaveSuffix(" 9\n"))
+	})
+
+	It("should reject unknown outputs", func() {
+		for _, config := range []common.DeadLetterConfig{{Output: "s3"}, {Output: DeadLetterFile}, {Output: DeadLetterNsq}} {
+			_, err := newDeadLetterQueue(config)
+			Expect(err).To(HaveOccurred(), config.Output)
+		}
+	})
+})
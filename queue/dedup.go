@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/model"
+	"github.com/nsqio/go-nsq"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+const (
+	DedupByMessageId = "message_id"
+	DedupByContent   = "content"
+
+	DefaultDedupWindow     = 10 * time.Minute
+	DefaultDedupMaxEntries = 100000
+)
+
+type dedupEntry struct {
+	hash uint64
+	seen time.Time
+}
+
+// deduplicator remembers messages seen within a time window (but no more than maxEntries of them),
+// so messages redelivered by NSQ are not counted twice. Only hashes of the keys are kept.
+type deduplicator struct {
+	sync.Mutex
+	byContent  bool
+	window     time.Duration
+	maxEntries int
+	seen       map[uint64]*list.Element
+	order      *list.List // oldest first
+	duplicates stats.Counter
+	now        func() time.Time
+}
+
+// newDeduplicator returns nil when deduplication is disabled
+func newDeduplicator(config common.DeduplicationConfig) (*deduplicator, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	d := deduplicator{
+		window:     config.Window,
+		maxEntries: config.MaxEntries,
+		seen:       map[uint64]*list.Element{},
+		order:      list.New(),
+		duplicates: stats.GetOrRegisterCounter("duplicates_dropped", stats.DefaultRegistry),
+		now:        time.Now,
+	}
+
+	switch config.Key {
+	case "", DedupByMessageId:
+	case DedupByContent:
+		d.byContent = true
+	default:
+		return nil, fmt.Errorf("unknown deduplication key: %s", config.Key)
+	}
+
+	if d.window <= 0 {
+		d.window = DefaultDedupWindow
+	}
+
+	if d.maxEntries <= 0 {
+		d.maxEntries = DefaultDedupMaxEntries
+	}
+
+	return &d, nil
+}
+
+// IsDuplicate checks if the message was already seen and remembers it otherwise
+func (d *deduplicator) IsDuplicate(message *nsq.Message, entry *model.LogEntry) bool {
+	var hash uint64
+	if d.byContent {
+		// time of capturing the line by the container runtime (with nanosecond precision) is part of the key,
+		// so identical requests served one after another are not taken for copies of the same message
+		hash = hashBytes([]byte(entry.Kubernetes.PodId + "\x00" + strconv.FormatInt(entry.Time.UnixNano(), 10) + "\x00" + entry.Log))
+	} else {
+		hash = hashBytes(message.ID[:])
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.now()
+	d.expire(now)
+
+	if _, has := d.seen[hash]; has {
+		d.duplicates.Inc(1)
+		return true
+	}
+
+	d.seen[hash] = d.order.PushBack(dedupEntry{hash: hash, seen: now})
+	if d.order.Len() > d.maxEntries {
+		d.remove(d.order.Front())
+	}
+
+	return false
+}
+
+func (d *deduplicator) expire(now time.Time) {
+	for oldest := d.order.Front(); oldest != nil && now.Sub(oldest.Value.(dedupEntry).seen) >= d.window; oldest = d.order.Front() {
+		d.remove(oldest)
+	}
+}
+
+func (d *deduplicator) remove(element *list.Element) {
+	delete(d.seen, element.Value.(dedupEntry).hash)
+	d.order.Remove(element)
+}
@@ -0,0 +1,120 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/metrics"
+	"github.com/Wikia/nsq-traefik-consumer/model"
+	"github.com/nsqio/go-nsq"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("deduplicator", func() {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	newDedup := func(config common.DeduplicationConfig) *deduplicator {
+		config.Enabled = true
+		d, err := newDeduplicator(config)
+		Expect(err).NotTo(HaveOccurred())
+		d.now = func() time.Time { return now }
+		return d
+	}
+
+	message := func(id string) *nsq.Message {
+		msgId := nsq.MessageID{}
+		copy(msgId[:], id)
+		return nsq.NewMessage(msgId, []byte(traefikMessage))
+	}
+
+	entry := func(podId, log string) *model.LogEntry {
+		return &model.LogEntry{Log: log, Time: now, Kubernetes: model.KubernetesMeta{PodId: podId}}
+	}
+
+	It("should drop redelivered messages", func() {
+		d := newDedup(common.DeduplicationConfig{})
+		d.duplicates.Clear()
+
+		Expect(d.IsDuplicate(message("a"), entry("pod", "line"))).To(BeFalse())
+		Expect(d.IsDuplicate(message("b"), entry("pod", "line"))).To(BeFalse())
+		Expect(d.IsDuplicate(message("a"), entry("pod", "line"))).To(BeTrue())
+		Expect(d.duplicates.Count()).To(BeEquivalentTo(1))
+	})
+
+	It("should drop messages with the same log line from the same pod", func() {
+		d := newDedup(common.DeduplicationConfig{Key: DedupByContent})
+
+		Expect(d.IsDuplicate(message("a"), entry("pod-1", "line"))).To(BeFalse())
+		Expect(d.IsDuplicate(message("b"), entry("pod-2", "line"))).To(BeFalse())
+		Expect(d.IsDuplicate(message("c"), entry("pod-1", "other line"))).To(BeFalse())
+		Expect(d.IsDuplicate(message("d"), entry("pod-1", "line"))).To(BeTrue())
+	})
+
+	It("should keep identical log lines written at different moments", func() {
+		d := newDedup(common.DeduplicationConfig{Key: DedupByContent})
+
+		first := entry("pod-1", `10.0.0.1 - - [01/Oct/2017:12:00:00 +0000] "GET /health HTTP/1.1" 200 2`)
+		second := entry("pod-1", first.Log)
+		second.Time = first.Time.Add(time.Millisecond)
+
+		Expect(d.IsDuplicate(message("a"), first)).To(BeFalse())
+		Expect(d.IsDuplicate(message("b"), second)).To(BeFalse())
+		Expect(d.IsDuplicate(message("c"), entry("pod-1", first.Log))).To(BeTrue())
+	})
+
+	It("should forget messages older than the window", func() {
+		d := newDedup(common.DeduplicationConfig{Window: time.Minute})
+
+		Expect(d.IsDuplicate(message("a"), nil)).To(BeFalse())
+		now = now.Add(30 * time.Second)
+		Expect(d.IsDuplicate(message("b"), nil)).To(BeFalse())
+		now = now.Add(30 * time.Second)
+
+		Expect(d.IsDuplicate(message("b"), nil)).To(BeTrue())
+		Expect(d.IsDuplicate(message("a"), nil)).To(BeFalse())
+		Expect(d.order.Len()).To(Equal(2))
+	})
+
+	It("should keep at most configured number of messages", func() {
+		d := newDedup(common.DeduplicationConfig{MaxEntries: 2})
+
+		for _, id := range []string{"a", "b", "c"} {
+			Expect(d.IsDuplicate(message(id), nil)).To(BeFalse())
+		}
+
+		Expect(d.order.Len()).To(Equal(2))
+		Expect(d.IsDuplicate(message("a"), nil)).To(BeFalse())
+		Expect(d.IsDuplicate(message("c"), nil)).To(BeTrue())
+	})
+
+	It("should be used by the handler", func() {
+		config := common.NewConfig()
+		config.Kubernetes.AnnotationKey = "wikia_com/keys"
+		config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", Sampling: 1}}
+		config.Fields = []string{"request_path"}
+		config.Deduplication = common.DeduplicationConfig{Enabled: true}
+
+		buffer := NewMetricsBuffer()
+		deadLetters, err := newDeadLetterQueue(config.DeadLetter)
+		Expect(err).NotTo(HaveOccurred())
+		processor, err := metrics.NewTraefikMetricProcessor(config)
+		Expect(err).NotTo(HaveOccurred())
+		handler := metricsProcessor(config, processor, buffer, deadLetters)
+
+		Expect(handler(message("a"))).To(Succeed())
+		Expect(handler(message("a"))).To(Succeed())
+		Expect(handler(message("b"))).To(Succeed())
+		Expect(buffer.Metrics.Len()).To(Equal(2))
+	})
+
+	It("should be disabled by default", func() {
+		d, err := newDeduplicator(common.DeduplicationConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d).To(BeNil())
+
+		_, err = newDeduplicator(common.DeduplicationConfig{Enabled: true, Key: "body"})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,261 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// envelope holds the few fields of a log message needed to decide whether it is worth decoding fully.
+// All slices point into the original message body and are valid only as long as the body is.
+type envelope struct {
+	Annotation    []byte // quoted (still escaped) JSON string with pod annotation
+	ContainerName []byte // raw container name (may contain JSON escapes)
+	PodId         []byte // raw pod id (may contain JSON escapes)
+}
+
+var (
+	metricsKeyBytes  = []byte(metricsAnnotationKey)
+	unicodeEscape    = []byte(`\u`)
+	errNotAnObject   = fmt.Errorf("message is not a JSON object")
+	errUnexpectedEnd = fmt.Errorf("unexpected end of JSON input")
+)
+
+// HasMetricsConfig cheaply checks if annotation can contain metrics configuration at all
+func (e *envelope) HasMetricsConfig() bool {
+	if len(e.Annotation) <= 2 {
+		return false
+	}
+
+	// key could be hidden behind unicode escapes - let the full decoder decide then
+	if bytes.Contains(e.Annotation, unicodeEscape) {
+		return true
+	}
+
+	return bytes.Contains(e.Annotation, metricsKeyBytes)
+}
+
+// AnnotationValue returns unescaped annotation value
+func (e *envelope) AnnotationValue() (string, error) {
+	var value string
+	err := json.Unmarshal(e.Annotation, &value)
+	return value, err
+}
+
+// scanEnvelope walks over the message body without decoding it and picks up
+// kubernetes.annotations[annotationKey], kubernetes.container_name and kubernetes.pod_id.
+// It does not allocate unless keys in the message use JSON escapes.
+func scanEnvelope(body []byte, annotationKey string, env *envelope) error {
+	*env = envelope{}
+
+	_, err := scanObject(body, skipWhitespace(body, 0), func(key []byte, escaped bool, pos int) (int, error) {
+		if !keyEquals(key, escaped, "kubernetes") {
+			return skipValue(body, pos)
+		}
+
+		return scanObject(body, pos, func(key []byte, escaped bool, pos int) (int, error) {
+			switch {
+			case keyEquals(key, escaped, "annotations"):
+				return scanObject(body, pos, func(key []byte, escaped bool, pos int) (int, error) {
+					if !keyEquals(key, escaped, annotationKey) || body[pos] != '"' {
+						return skipValue(body, pos)
+					}
+					start := pos
+					_, end, _, err := scanString(body, pos)
+					if err != nil {
+						return 0, err
+					}
+					env.Annotation = body[start:end]
+					return end, nil
+				})
+			case keyEquals(key, escaped, "container_name"):
+				return captureString(body, pos, &env.ContainerName)
+			case keyEquals(key, escaped, "pod_id"):
+				return captureString(body, pos, &env.PodId)
+			default:
+				return skipValue(body, pos)
+			}
+		})
+	})
+
+	return err
+}
+
+// scanObject calls fn for every key of an object starting at pos; fn gets position of the value
+// and has to return position right after it
+func scanObject(body []byte, pos int, fn func(key []byte, escaped bool, pos int) (int, error)) (int, error) {
+	if pos >= len(body) {
+		return 0, errUnexpectedEnd
+	}
+
+	if body[pos] != '{' {
+		if body[pos] == 'n' {
+			// null instead of an object
+			return skipValue(body, pos)
+		}
+		return 0, errNotAnObject
+	}
+
+	pos = skipWhitespace(body, pos+1)
+	if pos < len(body) && body[pos] == '}' {
+		return pos + 1, nil
+	}
+
+	for {
+		if pos >= len(body) {
+			return 0, errUnexpectedEnd
+		}
+
+		key, next, escaped, err := scanString(body, pos)
+		if err != nil {
+			return 0, err
+		}
+
+		pos = skipWhitespace(body, next)
+		if pos >= len(body) || body[pos] != ':' {
+			return 0, fmt.Errorf("expected ':' at offset %d", pos)
+		}
+
+		pos = skipWhitespace(body, pos+1)
+		if pos >= len(body) {
+			return 0, errUnexpectedEnd
+		}
+
+		pos, err = fn(key, escaped, pos)
+		if err != nil {
+			return 0, err
+		}
+
+		pos = skipWhitespace(body, pos)
+		if pos >= len(body) {
+			return 0, errUnexpectedEnd
+		}
+
+		switch body[pos] {
+		case ',':
+			pos = skipWhitespace(body, pos+1)
+		case '}':
+			return pos + 1, nil
+		default:
+			return 0, fmt.Errorf("unexpected character '%c' at offset %d", body[pos], pos)
+		}
+	}
+}
+
+// scanString returns contents of a string starting at pos (without quotes) and position right after it
+func scanString(body []byte, pos int) (content []byte, next int, escaped bool, err error) {
+	if pos >= len(body) || body[pos] != '"' {
+		return nil, 0, false, fmt.Errorf("expected string at offset %d", pos)
+	}
+
+	for i := pos + 1; i < len(body); i++ {
+		switch body[i] {
+		case '\\':
+			escaped = true
+			i++
+		case '"':
+			return body[pos+1 : i], i + 1, escaped, nil
+		}
+	}
+
+	return nil, 0, false, errUnexpectedEnd
+}
+
+func captureString(body []byte, pos int, target *[]byte) (int, error) {
+	if body[pos] != '"' {
+		return skipValue(body, pos)
+	}
+
+	content, next, _, err := scanString(body, pos)
+	if err != nil {
+		return 0, err
+	}
+	*target = content
+
+	return next, nil
+}
+
+// skipValue returns position right after the JSON value starting at pos
+func skipValue(body []byte, pos int) (int, error) {
+	if pos >= len(body) {
+		return 0, errUnexpectedEnd
+	}
+
+	switch body[pos] {
+	case '"':
+		_, next, _, err := scanString(body, pos)
+		return next, err
+	case '{', '[':
+		depth := 0
+		for i := pos; i < len(body); i++ {
+			switch body[i] {
+			case '"':
+				_, next, _, err := scanString(body, i)
+				if err != nil {
+					return 0, err
+				}
+				i = next - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1, nil
+				}
+			}
+		}
+		return 0, errUnexpectedEnd
+	default:
+		// numbers, booleans and null
+		i := pos
+		for i < len(body) && !isDelimiter(body[i]) {
+			i++
+		}
+		if i == pos {
+			return 0, fmt.Errorf("unexpected character '%c' at offset %d", body[pos], pos)
+		}
+		return i, nil
+	}
+}
+
+func skipWhitespace(body []byte, pos int) int {
+	for pos < len(body) && isWhitespace(body[pos]) {
+		pos++
+	}
+
+	return pos
+}
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDelimiter(c byte) bool {
+	return isWhitespace(c) || c == ',' || c == '}' || c == ']'
+}
+
+func keyEquals(key []byte, escaped bool, expected string) bool {
+	if !escaped {
+		return string(key) == expected
+	}
+
+	// rare case of escaped key (i.e. "wikia_com\/keys") - decode it properly
+	return unescape(key) == expected
+}
+
+// unescape returns decoded value of a raw string captured by scanEnvelope
+func unescape(raw []byte) string {
+	if bytes.IndexByte(raw, '\\') < 0 {
+		return string(raw)
+	}
+
+	quoted := make([]byte, 0, len(raw)+2)
+	quoted = append(append(append(quoted, '"'), raw...), '"')
+
+	var decoded string
+	if err := json.Unmarshal(quoted, &decoded); err != nil {
+		return string(raw)
+	}
+
+	return decoded
+}
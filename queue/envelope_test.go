@@ -0,0 +1,170 @@
+package queue
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/Wikia/nsq-traefik-consumer/metrics"
+	"github.com/Wikia/nsq-traefik-consumer/model"
+	"github.com/nsqio/go-nsq"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	traefikMessage = `{"log":"{\"FrontendName\":\"foo.wikia.com/bar\",\"RequestPath\":\"/bar\",\"RequestMethod\":\"GET\"}\n",` +
+		`"stream":"stdout","time":"2017-10-02T10:00:00.123Z","docker":{"container_id":"abc"},` +
+		`"kubernetes":{"namespace_name":"prod","pod_name":"traefik-1","pod_id":"1234-5678","labels":{"app":"traefik"},"host":"k8s-node-1",` +
+		`"annotations":{"wikia_com\/keys":"{\"influx_metrics\":{\"container_name\":\"traefik\",\"type\":\"access_log_as_json\"}}"},` +
+		`"container_name":"traefik"},"datacenter":"sjc","kubernetes_cluster_name":"prod"}`
+	otherMessage = `{"log":"some application is logging something unrelated to Traefik at all\n","stream":"stderr",` +
+		`"time":"2017-10-02T10:00:00.123Z","docker":{"container_id":"abc"},` +
+		`"kubernetes":{"namespace_name":"prod","pod_name":"app-1","pod_id":"8765-4321","labels":{"app":"app","team":"x"},"host":"k8s-node-1",` +
+		`"annotations":{"prometheus.io/scrape":"true","prometheus.io/port":"9102"},` +
+		`"container_name":"app"},"datacenter":"sjc","kubernetes_cluster_name":"prod","_ts":1506938400}`
+	sidecarMessage = `{"log":"sidecar output\n","kubernetes":{"pod_id":"1234-5678",` +
+		`"annotations":{"wikia_com/keys":"{\"influx_metrics\":{\"container_name\":\"traefik\",\"type\":\"access_log_as_json\"}}"},` +
+		`"container_name":"sidecar"}}`
+)
+
+var _ = Describe("scanEnvelope", func() {
+	It("should pick up annotation, container name and pod id", func() {
+		var env envelope
+		err := scanEnvelope([]byte(traefikMessage), "wikia_com/keys", &env)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(env.HasMetricsConfig()).To(BeTrue())
+		Expect(string(env.ContainerName)).To(Equal("traefik"))
+		Expect(string(env.PodId)).To(Equal("1234-5678"))
+
+		value, err := env.AnnotationValue()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal(`{"influx_metrics":{"container_name":"traefik","type":"access_log_as_json"}}`))
+	})
+
+	It("should report missing annotation", func() {
+		var env envelope
+		err := scanEnvelope([]byte(otherMessage), "wikia_com/keys", &env)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(env.HasMetricsConfig()).To(BeFalse())
+		Expect(string(env.ContainerName)).To(Equal("app"))
+	})
+
+	It("should handle null and empty objects", func() {
+		var env envelope
+		err := scanEnvelope([]byte(` {"log":"x", "kubernetes": {"annotations": null, "labels": {}, "container_name": null}} `), "wikia_com/keys", &env)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(env.HasMetricsConfig()).To(BeFalse())
+		Expect(env.ContainerName).To(BeEmpty())
+	})
+
+	It("should fail on malformed messages", func() {
+		var env envelope
+		for _, body := range []string{``, `[]`, `{"kubernetes":`, `{"kubernetes":{"annotations":{"a" "b"}}}`, `{"log":"unterminated}`} {
+			Expect(scanEnvelope([]byte(body), "wikia_com/keys", &env)).To(HaveOccurred(), body)
+		}
+	})
+
+	It("should agree with encoding/json", func() {
+		for _, body := range []string{traefikMessage, otherMessage, sidecarMessage} {
+			entry := model.LogEntry{}
+			Expect(json.Unmarshal([]byte(body), &entry)).To(Succeed())
+
+			var env envelope
+			Expect(scanEnvelope([]byte(body), "wikia_com/keys", &env)).To(Succeed())
+
+			expected := entry.Kubernetes.Annotations["wikia_com/keys"]
+			if len(expected) > 0 {
+				value, err := env.AnnotationValue()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal(expected))
+			}
+			Expect(unescape(env.ContainerName)).To(Equal(entry.Kubernetes.ContainerName))
+			Expect(unescape(env.PodId)).To(Equal(entry.Kubernetes.PodId))
+		}
+	})
+
+	It("should not allocate when rejecting messages", func() {
+		body := []byte(otherMessage)
+		allocs := testing.AllocsPerRun(100, func() {
+			var env envelope
+			scanEnvelope(body, "wikia_com/keys", &env)
+			env.HasMetricsConfig()
+		})
+
+		Expect(allocs).To(BeZero())
+	})
+})
+
+// legacyFilter mimics the message handler before the fast path was introduced
+func legacyFilter(body []byte, annotationKey string) (model.LogEntry, string, bool) {
+	entry := model.LogEntry{}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return entry, "", false
+	}
+
+	entry.Log = strings.TrimSpace(entry.Log)
+	value, has := entry.Kubernetes.Annotations[annotationKey]
+	if !has || len(value) == 0 {
+		return entry, "", false
+	}
+
+	var wikiaConfig map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &wikiaConfig); err != nil {
+		return entry, "", false
+	}
+
+	influxConfig, has := wikiaConfig[metricsAnnotationKey].(map[string]interface{})
+	if !has {
+		return entry, "", false
+	}
+
+	metricsType, _ := influxConfig["type"].(string)
+	return entry, metricsType, entry.Kubernetes.ContainerName == influxConfig["container_name"]
+}
+
+func benchmarkMessages() []*nsq.Message {
+	// most of the messages on the topic do not come from Traefik
+	bodies := []string{otherMessage, otherMessage, otherMessage, sidecarMessage, otherMessage, otherMessage, otherMessage, otherMessage, otherMessage, traefikMessage}
+	messages := make([]*nsq.Message, len(bodies))
+	for idx, body := range bodies {
+		messages[idx] = nsq.NewMessage(nsq.MessageID{}, []byte(body))
+	}
+
+	return messages
+}
+
+func BenchmarkLegacyHandler(b *testing.B) {
+	messages := benchmarkMessages()
+	processor, _ := metrics.NewTraefikMetricProcessor(common.NewConfig())
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		message := messages[i%len(messages)]
+		if entry, metricsType, ok := legacyFilter(message.Body, "wikia_com/keys"); ok {
+			processor.Process(entry, metrics.PodConfig{Format: metricsType}, message.Timestamp, "bench")
+		}
+	}
+}
+
+func BenchmarkFastPathHandler(b *testing.B) {
+	messages := benchmarkMessages()
+	config := common.NewConfig()
+	config.Kubernetes.AnnotationKey = "wikia_com/keys"
+	config.InfluxDB.Measurement = "bench"
+	deadLetters, _ := newDeadLetterQueue(config.DeadLetter)
+	processor, _ := metrics.NewTraefikMetricProcessor(config)
+	handler := metricsProcessor(config, processor, NewMetricsBuffer(), deadLetters)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		handler(messages[i%len(messages)])
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"container/list"
 
 	"github.com/Wikia/nsq-traefik-consumer/common"
-	"github.com/containous/traefik/log"
 	"github.com/influxdata/influxdb/client/v2"
 	stats "github.com/rcrowley/go-metrics"
 )
@@ -34,7 +33,12 @@ func GetInfluxClient(config common.InfluxDbConfig) (client.Client, error) {
 	return influxClient, nil
 }
 
-func RunSender(config common.InfluxDbConfig, metrics *MetricsBuffer) {
+func RunSender(config common.InfluxDbConfig, metrics *MetricsBuffer) error {
+	// fail early on invalid settings
+	if _, err := newPointUniquifier(config); err != nil {
+		return err
+	}
+
 	go func() {
 		for {
 			<-time.After(config.SendInterval)
@@ -44,6 +48,8 @@ func RunSender(config common.InfluxDbConfig, metrics *MetricsBuffer) {
 			}
 		}
 	}()
+
+	return nil
 }
 
 func NewMetricsBuffer() *MetricsBuffer {
@@ -63,17 +69,67 @@ func sendMetrics(config common.InfluxDbConfig, metrics *MetricsBuffer) error {
 
 	defer influxClient.Close()
 
+	return writeMetrics(config, metrics, influxClient)
+}
+
+// pointWriter is the part of InfluxDB client used to send points
+type pointWriter interface {
+	Write(bp client.BatchPoints) error
+}
+
+// pendingBatch collects points written to a single retention policy
+type pendingBatch struct {
+	points     client.BatchPoints
+	uniquifier *pointUniquifier
+}
+
+func newPendingBatch(config common.InfluxDbConfig, retentionPolicy string) (*pendingBatch, error) {
+	batch, err := batchConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	batch.RetentionPolicy = retentionPolicy
+
+	points, err := client.NewBatchPoints(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	uniquifier, err := newPointUniquifier(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pendingBatch{points: points, uniquifier: uniquifier}, nil
+}
+
+func (b *pendingBatch) Add(points []*client.Point) {
+	for _, pt := range points {
+		unique, err := b.uniquifier.Add(pt)
+		if err != nil {
+			common.Log.WithError(err).Error("Error making point unique")
+			continue
+		}
+		b.points.AddPoint(unique)
+	}
+}
+
+// writeMetrics empties the buffer sending points in batches (separate for every retention policy)
+func writeMetrics(config common.InfluxDbConfig, metrics *MetricsBuffer, writer pointWriter) error {
 	gauge := stats.GetOrRegisterGauge("buffer_size", stats.DefaultRegistry)
 	counter := stats.GetOrRegisterCounter("points_sent", stats.DefaultRegistry)
 
-	buffer, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Precision:       "ns",
-		Database:        config.Database,
-		RetentionPolicy: config.RetentionPolicy,
-	})
+	pending := map[string]*pendingBatch{}
+	flush := func(retentionPolicy string) {
+		batch := pending[retentionPolicy]
+		delete(pending, retentionPolicy)
 
-	if err != nil {
-		common.Log.WithError(err).Error("Error creating batch points for Influx")
+		err := writer.Write(batch.points)
+		if err != nil {
+			common.Log.WithError(err).WithField("retention_policy", retentionPolicy).Error("Error sending metrics to Influx DB")
+		}
+
+		counter.Inc(int64(len(batch.points.Points())))
 	}
 
 	for {
@@ -88,33 +144,32 @@ func sendMetrics(config common.InfluxDbConfig, metrics *MetricsBuffer) error {
 		gauge.Update(int64(metrics.Metrics.Len()))
 
 		bucket, _ := element.Value.(client.BatchPoints)
-		buffer.AddPoints(bucket.Points())
+		retentionPolicy := bucket.RetentionPolicy()
+		if len(retentionPolicy) == 0 {
+			retentionPolicy = config.RetentionPolicy
+		}
 
-		if len(buffer.Points()) >= config.BatchSize {
-			err = influxClient.Write(buffer)
+		batch, has := pending[retentionPolicy]
+		if !has {
+			var err error
+			batch, err = newPendingBatch(config, retentionPolicy)
 			if err != nil {
-				common.Log.WithError(err).Error("Error sending metrics to Influx DB")
+				return err
 			}
+			pending[retentionPolicy] = batch
+		}
 
-			counter.Inc(int64(len(buffer.Points())))
-			buffer, err = client.NewBatchPoints(client.BatchPointsConfig{
-				Precision:       "ns",
-				Database:        config.Database,
-				RetentionPolicy: config.RetentionPolicy,
-			})
-			if err != nil {
-				log.WithError(err).Error("Error recreating batch points for Influx")
-			}
+		batch.Add(bucket.Points())
+
+		if len(batch.points.Points()) >= config.BatchSize {
+			flush(retentionPolicy)
 		}
 	}
 
-	if len(buffer.Points()) > 0 {
-		err = influxClient.Write(buffer)
-		if err != nil {
-			common.Log.WithError(err).Error("Error sending metrics to Influx DB")
+	for retentionPolicy, batch := range pending {
+		if len(batch.points.Points()) > 0 {
+			flush(retentionPolicy)
 		}
-
-		counter.Inc(int64(len(buffer.Points())))
 	}
 
 	common.Log.WithField("count", counter.Count()).Info("Finished writing metrics to InfluxDB")
@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	metrics "github.com/Wikia/nsq-traefik-consumer/metrics"
+	"github.com/Wikia/nsq-traefik-consumer/model"
+	"github.com/influxdata/influxdb/client/v2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeWriter struct {
+	batches []client.BatchPoints
+}
+
+func (w *fakeWriter) Write(bp client.BatchPoints) error {
+	w.batches = append(w.batches, bp)
+	return nil
+}
+
+var _ = Describe("writeMetrics", func() {
+	bucket := func(retentionPolicy string, count int) client.BatchPoints {
+		bp, err := client.NewBatchPoints(client.BatchPointsConfig{RetentionPolicy: retentionPolicy})
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < count; i++ {
+			pt, err := client.NewPoint("test", nil, map[string]interface{}{"value": i}, time.Unix(int64(i), 0))
+			Expect(err).NotTo(HaveOccurred())
+			bp.AddPoint(pt)
+		}
+
+		return bp
+	}
+
+	It("should send points in batches grouped by retention policy", func() {
+		config := common.InfluxDbConfig{Database: "db", RetentionPolicy: "short_term", BatchSize: 3}
+		buffer := NewMetricsBuffer()
+		for _, bp := range []client.BatchPoints{bucket("", 2), bucket("long_term", 1), bucket("short_term", 2), bucket("long_term", 1)} {
+			buffer.Metrics.PushBack(bp)
+		}
+
+		writer := &fakeWriter{}
+		Expect(writeMetrics(config, buffer, writer)).To(Succeed())
+
+		Expect(buffer.Metrics.Len()).To(BeZero())
+		sizes := map[string]int{}
+		for _, bp := range writer.batches {
+			Expect(bp.Database()).To(Equal("db"))
+			Expect(bp.Precision()).To(Equal(DefaultPrecision))
+			sizes[bp.RetentionPolicy()] += len(bp.Points())
+		}
+		Expect(writer.batches).To(HaveLen(2))
+		Expect(sizes).To(Equal(map[string]int{"short_term": 4, "long_term": 2}))
+	})
+})
+
+var _ = Describe("flushAggregates", func() {
+	It("should push points of aggregators to the buffer", func() {
+		config := common.NewConfig()
+		config.Rules = []common.RulesConfig{{Id: "all", FrontendRegexp: ".*", TopK: common.TopKConfig{Dimensions: []string{"request_path"}}}}
+
+		processor, err := metrics.NewTraefikMetricProcessor(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		buffer := NewMetricsBuffer()
+		Expect(flushAggregates(processor, buffer, time.Now())).To(Succeed())
+		Expect(buffer.Metrics.Len()).To(Equal(0))
+
+		_, err = processor.Process(model.LogEntry{Log: `{"FrontendName": "foo", "RequestPath": "/bar"}`}, metrics.PodConfig{Format: metrics.JSON}, 0, "test")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(flushAggregates(processor, buffer, time.Now())).To(Succeed())
+		Expect(buffer.Metrics.Len()).To(Equal(1))
+		points := buffer.Metrics.Front().Value.(client.BatchPoints).Points()
+		Expect(points).To(HaveLen(1))
+		Expect(points[0].Tags()).To(HaveKeyWithValue(metrics.ReplicaTag, common.Replica))
+	})
+})
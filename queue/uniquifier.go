@@ -0,0 +1,145 @@
+package queue
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/influxdata/influxdb/client/v2"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+const (
+	UniquifierNone   = "none"
+	UniquifierOffset = "offset"
+	UniquifierTag    = "tag"
+
+	DefaultPrecision   = "ns"
+	DefaultSequenceTag = "seq"
+)
+
+// precisions supported by InfluxDB with their durations
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// batchConfig returns settings of batches sent to InfluxDB
+func batchConfig(config common.InfluxDbConfig) (client.BatchPointsConfig, error) {
+	precision := config.Precision
+	if len(precision) == 0 {
+		precision = DefaultPrecision
+	}
+
+	if _, known := precisions[precision]; !known {
+		return client.BatchPointsConfig{}, fmt.Errorf("unknown precision: %s", precision)
+	}
+
+	if precision == "us" {
+		// the only spelling InfluxDB understands
+		precision = "u"
+	}
+
+	return client.BatchPointsConfig{
+		Precision:       precision,
+		Database:        config.Database,
+		RetentionPolicy: config.RetentionPolicy,
+	}, nil
+}
+
+// pointUniquifier makes sure no two points in a batch have the same series and timestamp (after truncating it
+// to the write precision) - InfluxDB would keep only the last one of them otherwise. Colliding points are moved
+// by one unit of precision (offset mode, the default one) or get a sequence number tag (tag mode).
+type pointUniquifier struct {
+	mode      string
+	tag       string
+	precision time.Duration
+	seen      map[string]bool
+	changed   stats.Counter
+}
+
+func newPointUniquifier(config common.InfluxDbConfig) (*pointUniquifier, error) {
+	batch, err := batchConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	u := pointUniquifier{
+		mode:      config.Uniquifier,
+		tag:       config.SequenceTag,
+		precision: precisions[batch.Precision],
+		seen:      map[string]bool{},
+		changed:   stats.GetOrRegisterCounter("points_uniquified", stats.DefaultRegistry),
+	}
+
+	switch u.mode {
+	case "":
+		u.mode = UniquifierOffset
+	case UniquifierNone, UniquifierOffset, UniquifierTag:
+	default:
+		return nil, fmt.Errorf("unknown uniquifier: %s", config.Uniquifier)
+	}
+
+	if len(u.tag) == 0 {
+		u.tag = DefaultSequenceTag
+	}
+
+	return &u, nil
+}
+
+// Reset forgets points seen so far - it should be called for every new batch
+func (u *pointUniquifier) Reset() {
+	u.seen = map[string]bool{}
+}
+
+// Add registers point in the current batch and returns it (or its copy with a different timestamp or tags)
+func (u *pointUniquifier) Add(pt *client.Point) (*client.Point, error) {
+	if u.mode == UniquifierNone {
+		return pt, nil
+	}
+
+	tags := pt.Tags()
+	ts := pt.Time().Truncate(u.precision)
+	key := common.SeriesKey(pt.Name(), tags)
+
+	if !u.seen[pointKey(key, ts)] {
+		u.seen[pointKey(key, ts)] = true
+		return pt, nil
+	}
+
+	u.changed.Inc(1)
+
+	switch u.mode {
+	case UniquifierOffset:
+		for u.seen[pointKey(key, ts)] {
+			ts = ts.Add(u.precision)
+		}
+		u.seen[pointKey(key, ts)] = true
+	case UniquifierTag:
+		for seq := 1; ; seq++ {
+			tags[u.tag] = strconv.Itoa(seq)
+			if candidate := pointKey(common.SeriesKey(pt.Name(), tags), ts); !u.seen[candidate] {
+				u.seen[candidate] = true
+				break
+			}
+		}
+		ts = pt.Time()
+	}
+
+	fields, err := pt.Fields()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.NewPoint(pt.Name(), tags, fields, ts)
+}
+
+func pointKey(series string, ts time.Time) string {
+	return series + " " + strconv.FormatInt(ts.UnixNano(), 10)
+}
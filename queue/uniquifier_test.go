@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	"github.com/influxdata/influxdb/client/v2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pointUniquifier", func() {
+	ts := time.Date(2017, 10, 1, 12, 0, 0, 500, time.UTC)
+
+	point := func(tags map[string]string, ts time.Time) *client.Point {
+		pt, err := client.NewPoint("test", tags, map[string]interface{}{"duration": 1.5}, ts)
+		Expect(err).NotTo(HaveOccurred())
+		return pt
+	}
+
+	add := func(u *pointUniquifier, points ...*client.Point) []*client.Point {
+		result := []*client.Point{}
+		for _, pt := range points {
+			unique, err := u.Add(pt)
+			Expect(err).NotTo(HaveOccurred())
+			result = append(result, unique)
+		}
+		return result
+	}
+
+	It("should move colliding points by one unit of precision", func() {
+		u, err := newPointUniquifier(common.InfluxDbConfig{Precision: "ms", Uniquifier: UniquifierOffset})
+		Expect(err).NotTo(HaveOccurred())
+
+		points := add(u,
+			point(map[string]string{"a": "1"}, ts),
+			point(map[string]string{"a": "1"}, ts.Add(time.Microsecond)),
+			point(map[string]string{"a": "2"}, ts),
+			point(map[string]string{"a": "1"}, ts),
+			point(map[string]string{"a": "1"}, ts.Add(time.Millisecond)),
+		)
+
+		Expect(points[0].Time()).To(Equal(ts))
+		Expect(points[1].Time()).To(Equal(ts.Truncate(time.Millisecond).Add(time.Millisecond)))
+		Expect(points[2].Time()).To(Equal(ts))
+		Expect(points[3].Time()).To(Equal(ts.Truncate(time.Millisecond).Add(2 * time.Millisecond)))
+		Expect(points[4].Time()).To(Equal(ts.Truncate(time.Millisecond).Add(3 * time.Millisecond)))
+
+		fields, err := points[3].Fields()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fields).To(HaveKeyWithValue("duration", 1.5))
+	})
+
+	It("should add sequence tag to colliding points", func() {
+		u, err := newPointUniquifier(common.InfluxDbConfig{Precision: "s", Uniquifier: UniquifierTag})
+		Expect(err).NotTo(HaveOccurred())
+
+		points := add(u,
+			point(map[string]string{"a": "1"}, ts),
+			point(map[string]string{"a": "1"}, ts),
+			point(map[string]string{"a": "1"}, ts.Add(time.Millisecond)),
+		)
+
+		Expect(points[0].Tags()).NotTo(HaveKey(DefaultSequenceTag))
+		Expect(points[1].Tags()).To(HaveKeyWithValue(DefaultSequenceTag, "1"))
+		Expect(points[2].Tags()).To(HaveKeyWithValue(DefaultSequenceTag, "2"))
+		Expect(points[2].Time()).To(Equal(ts.Add(time.Millisecond)))
+	})
+
+	It("should forget points of the previous batch", func() {
+		u, err := newPointUniquifier(common.InfluxDbConfig{Uniquifier: UniquifierOffset})
+		Expect(err).NotTo(HaveOccurred())
+
+		add(u, point(nil, ts))
+		u.Reset()
+		Expect(add(u, point(nil, ts))[0].Time()).To(Equal(ts))
+	})
+
+	It("should keep all the colliding points by default", func() {
+		for _, precision := range []string{"", "s"} {
+			u, err := newPointUniquifier(common.InfluxDbConfig{Precision: precision})
+			Expect(err).NotTo(HaveOccurred())
+
+			points := add(u, point(nil, ts), point(nil, ts))
+			keys := map[string]bool{}
+			for _, pt := range points {
+				keys[pt.PrecisionString(precision)] = true
+			}
+			Expect(keys).To(HaveLen(2), precision)
+		}
+	})
+
+	It("should leave points intact when disabled", func() {
+		u, err := newPointUniquifier(common.InfluxDbConfig{Uniquifier: UniquifierNone})
+		Expect(err).NotTo(HaveOccurred())
+
+		points := add(u, point(nil, ts), point(nil, ts))
+		Expect(points[1].Time()).To(Equal(ts))
+	})
+
+	It("should reject invalid settings", func() {
+		_, err := newPointUniquifier(common.InfluxDbConfig{Precision: "days"})
+		Expect(err).To(HaveOccurred())
+
+		_, err = newPointUniquifier(common.InfluxDbConfig{Uniquifier: "random"})
+		Expect(err).To(HaveOccurred())
+
+		batch, err := batchConfig(common.InfluxDbConfig{Precision: "us"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(batch.Precision).To(Equal("u"))
+	})
+})
@@ -0,0 +1,204 @@
+package useragent
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	stats "github.com/rcrowley/go-metrics"
+)
+
+const (
+	DefaultField     = "request__user-agent"
+	DefaultCacheSize = 10000
+
+	BrowserField = "ua_browser"
+	OSField      = "ua_os"
+	DeviceField  = "ua_device"
+	BotField     = "ua_bot"
+
+	DeviceBot = "bot"
+	Other     = "other"
+)
+
+//go:embed rules.json
+var defaultRules []byte
+
+// Agent is a low-cardinality classification of a User-Agent header
+type Agent struct {
+	Browser string
+	OS      string
+	Device  string
+	Bot     bool
+}
+
+type ruleConfig struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Exclude string `json:"exclude"`
+}
+
+type ruleSetConfig struct {
+	Bots     []ruleConfig `json:"bots"`
+	Browsers []ruleConfig `json:"browsers"`
+	OS       []ruleConfig `json:"os"`
+	Devices  []ruleConfig `json:"devices"`
+}
+
+type rule struct {
+	name    string
+	pattern *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+func (r rule) matches(userAgent string) bool {
+	return r.pattern.MatchString(userAgent) && (r.exclude == nil || !r.exclude.MatchString(userAgent))
+}
+
+// Classifier turns raw User-Agent headers into browser family, OS family, device class and bot flag.
+// Rules are evaluated in order and the first matching one wins.
+type Classifier struct {
+	field    string
+	bots     []rule
+	browsers []rule
+	os       []rule
+	devices  []rule
+	cache    *common.LRUCache
+	detected stats.Counter
+}
+
+// NewClassifier creates classifier using embedded rules (or the ones from RulesFile); it returns nil
+// when classification is disabled
+func NewClassifier(config common.UserAgentConfig) (*Classifier, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	raw := defaultRules
+	if len(config.RulesFile) > 0 {
+		var err error
+		if raw, err = os.ReadFile(config.RulesFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var rules ruleSetConfig
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, fmt.Errorf("invalid user agent rules: %s", err)
+	}
+
+	c := Classifier{
+		field:    config.Field,
+		detected: stats.GetOrRegisterCounter("bots_detected", stats.DefaultRegistry),
+	}
+
+	if len(c.field) == 0 {
+		c.field = DefaultField
+	}
+
+	cacheSize := config.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = DefaultCacheSize
+	}
+	c.cache = common.NewLRUCache(cacheSize)
+
+	var err error
+	for _, group := range []struct {
+		config []ruleConfig
+		target *[]rule
+	}{
+		{rules.Bots, &c.bots},
+		{rules.Browsers, &c.browsers},
+		{rules.OS, &c.os},
+		{rules.Devices, &c.devices},
+	} {
+		if *group.target, err = compileRules(group.config); err != nil {
+			return nil, err
+		}
+	}
+
+	return &c, nil
+}
+
+func compileRules(configs []ruleConfig) ([]rule, error) {
+	rules := make([]rule, 0, len(configs))
+
+	for _, cfg := range configs {
+		r := rule{name: cfg.Name}
+		if len(r.name) == 0 {
+			return nil, fmt.Errorf("user agent rule %q has no name", cfg.Pattern)
+		}
+
+		var err error
+		if r.pattern, err = regexp.Compile(cfg.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern of user agent rule %s: %s", cfg.Name, err)
+		}
+
+		if len(cfg.Exclude) > 0 {
+			if r.exclude, err = regexp.Compile(cfg.Exclude); err != nil {
+				return nil, fmt.Errorf("invalid exclude pattern of user agent rule %s: %s", cfg.Name, err)
+			}
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// Classify returns classification of the given User-Agent
+func (c *Classifier) Classify(userAgent string) Agent {
+	if cached, has := c.cache.Get(userAgent); has {
+		return cached.(Agent)
+	}
+
+	agent := Agent{Browser: Other, OS: Other, Device: Other}
+
+	if len(userAgent) == 0 {
+		c.cache.Add(userAgent, agent)
+		return agent
+	}
+
+	agent.OS = firstMatch(c.os, userAgent)
+
+	if bot := firstMatch(c.bots, userAgent); bot != Other {
+		agent.Bot = true
+		agent.Browser = bot
+		agent.Device = DeviceBot
+	} else {
+		agent.Browser = firstMatch(c.browsers, userAgent)
+		agent.Device = firstMatch(c.devices, userAgent)
+	}
+
+	c.cache.Add(userAgent, agent)
+
+	return agent
+}
+
+// Enrich adds ua_* fields to the parsed log based on its User-Agent header
+func (c *Classifier) Enrich(parsedLog map[string]interface{}) {
+	userAgent, _ := parsedLog[c.field].(string)
+	agent := c.Classify(userAgent)
+
+	if agent.Bot {
+		c.detected.Inc(1)
+	}
+
+	parsedLog[BrowserField] = agent.Browser
+	parsedLog[OSField] = agent.OS
+	parsedLog[DeviceField] = agent.Device
+	parsedLog[BotField] = agent.Bot
+}
+
+func firstMatch(rules []rule, userAgent string) string {
+	for _, r := range rules {
+		if r.matches(userAgent) {
+			return r.name
+		}
+	}
+
+	return Other
+}
@@ -0,0 +1,92 @@
+package useragent_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/Wikia/nsq-traefik-consumer/common"
+	. "github.com/Wikia/nsq-traefik-consumer/useragent"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Classifier", func() {
+	var classifier *Classifier
+
+	BeforeEach(func() {
+		var err error
+		classifier, err = NewClassifier(common.UserAgentConfig{Enabled: true})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	agents := map[string]Agent{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/61.0.3163.100 Safari/537.36":                                                                            {Browser: "Chrome", OS: "Windows", Device: "desktop"},
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/58.0.3029.110 Safari/537.36 Edge/16.16299":                                                              {Browser: "Edge", OS: "Windows", Device: "desktop"},
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13) AppleWebKit/604.1.38 (KHTML, like Gecko) Version/11.0 Safari/604.1.38":                                                                            {Browser: "Safari", OS: "Mac OS", Device: "desktop"},
+		"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:56.0) Gecko/20100101 Firefox/56.0":                                                                                                                   {Browser: "Firefox", OS: "Linux", Device: "desktop"},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 11_0 like Mac OS X) AppleWebKit/604.1.38 (KHTML, like Gecko) Version/11.0 Mobile/15A372 Safari/604.1":                                                        {Browser: "Safari", OS: "iOS", Device: "mobile"},
+		"Mozilla/5.0 (iPad; CPU OS 11_0 like Mac OS X) AppleWebKit/604.1.34 (KHTML, like Gecko) CriOS/61.0.3163.73 Mobile/15A372 Safari/604.1":                                                           {Browser: "Chrome", OS: "iOS", Device: "tablet"},
+		"Mozilla/5.0 (Linux; Android 7.0; SM-G930V Build/NRD90M) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/59.0.3071.125 Mobile Safari/537.36":                                                       {Browser: "Chrome", OS: "Android", Device: "mobile"},
+		"Mozilla/5.0 (Linux; Android 7.0; SM-T810 Build/NRD90M) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/6.2 Chrome/56.0 Safari/537.36":                                                     {Browser: "Samsung Internet", OS: "Android", Device: "tablet"},
+		"Mozilla/5.0 (Windows NT 6.1; WOW64; Trident/7.0; rv:11.0) like Gecko":                                                                                                                           {Browser: "Internet Explorer", OS: "Windows", Device: "desktop"},
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                                                                                                       {Browser: "Googlebot", OS: Other, Device: DeviceBot, Bot: true},
+		"Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/41.0 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": {Browser: "Googlebot", OS: "Android", Device: DeviceBot, Bot: true},
+		"curl/7.54.0":                  {Browser: "curl", OS: Other, Device: DeviceBot, Bot: true},
+		"kube-probe/1.7":               {Browser: "Monitoring", OS: Other, Device: DeviceBot, Bot: true},
+		"SomeCrawler/1.0 (+https://x)": {Browser: "Other bot", OS: Other, Device: DeviceBot, Bot: true},
+		"":                             {Browser: Other, OS: Other, Device: Other},
+		"something completely unknown": {Browser: Other, OS: Other, Device: Other},
+	}
+
+	for userAgent, expected := range agents {
+		userAgent, expected := userAgent, expected
+		It("should classify '"+userAgent+"'", func() {
+			Expect(classifier.Classify(userAgent)).To(Equal(expected))
+			// the second time result comes from the cache
+			Expect(classifier.Classify(userAgent)).To(Equal(expected))
+		})
+	}
+
+	It("should add fields to parsed log", func() {
+		parsedLog := map[string]interface{}{"request__user-agent": "curl/7.54.0"}
+		classifier.Enrich(parsedLog)
+
+		Expect(parsedLog).To(HaveKeyWithValue(BrowserField, "curl"))
+		Expect(parsedLog).To(HaveKeyWithValue(OSField, Other))
+		Expect(parsedLog).To(HaveKeyWithValue(DeviceField, DeviceBot))
+		Expect(parsedLog).To(HaveKeyWithValue(BotField, true))
+	})
+
+	It("should be disabled by default", func() {
+		disabled, err := NewClassifier(common.UserAgentConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(disabled).To(BeNil())
+	})
+
+	It("should load rules from a file", func() {
+		file, err := ioutil.TempFile("", "rules")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(file.Name())
+
+		file.WriteString(`{"bots": [{"name": "Internal", "pattern": "^internal-"}], "devices": [{"name": "service", "pattern": "."}]}`)
+		file.Close()
+
+		custom, err := NewClassifier(common.UserAgentConfig{Enabled: true, RulesFile: file.Name()})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(custom.Classify("internal-client/1.0")).To(Equal(Agent{Browser: "Internal", OS: Other, Device: DeviceBot, Bot: true}))
+		Expect(custom.Classify("curl/7.54.0")).To(Equal(Agent{Browser: Other, OS: Other, Device: "service"}))
+	})
+
+	It("should reject invalid rules", func() {
+		file, err := ioutil.TempFile("", "rules")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(file.Name())
+
+		file.WriteString(`{"bots": [{"name": "Broken", "pattern": "("}]}`)
+		file.Close()
+
+		_, err = NewClassifier(common.UserAgentConfig{Enabled: true, RulesFile: file.Name()})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,13 @@
+package useragent_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestUseragent(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "UserAgent Suite")
+}